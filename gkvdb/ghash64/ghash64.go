@@ -0,0 +1,128 @@
+// Copyright 2018 gkvdb Author(https://gitee.com/johng/gkvdb). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://gitee.com/johng/gkvdb.
+
+// 64位哈希函数(xxHash64、SipHash-2-4)，用于数据库键名的散列计算.
+package ghash64
+
+import (
+    "encoding/binary"
+    "math/bits"
+)
+
+const (
+    prime1 uint64 = 11400714785074694791
+    prime2 uint64 = 14029467366897019727
+    prime3 uint64 = 1609587929392839161
+    prime4 uint64 = 9650029242287828579
+    prime5 uint64 = 2870177450012600261
+)
+
+// xxHash64哈希计算，seed为哈希种子
+func XXHash64(b []byte, seed uint64) uint64 {
+    n := len(b)
+    p := 0
+    h := uint64(0)
+    if n >= 32 {
+        v1 := seed + prime1 + prime2
+        v2 := seed + prime2
+        v3 := seed
+        v4 := seed - prime1
+        for ; p + 32 <= n; p += 32 {
+            v1 = xxRound(v1, binary.LittleEndian.Uint64(b[p : ]))
+            v2 = xxRound(v2, binary.LittleEndian.Uint64(b[p + 8 : ]))
+            v3 = xxRound(v3, binary.LittleEndian.Uint64(b[p + 16 : ]))
+            v4 = xxRound(v4, binary.LittleEndian.Uint64(b[p + 24 : ]))
+        }
+        h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+        h = xxMergeRound(h, v1)
+        h = xxMergeRound(h, v2)
+        h = xxMergeRound(h, v3)
+        h = xxMergeRound(h, v4)
+    } else {
+        h = seed + prime5
+    }
+    h += uint64(n)
+    for ; p + 8 <= n; p += 8 {
+        h ^= xxRound(0, binary.LittleEndian.Uint64(b[p : ]))
+        h  = bits.RotateLeft64(h, 27)*prime1 + prime4
+    }
+    if p + 4 <= n {
+        h ^= uint64(binary.LittleEndian.Uint32(b[p : ]))*prime1
+        h  = bits.RotateLeft64(h, 23)*prime2 + prime3
+        p += 4
+    }
+    for ; p < n; p++ {
+        h ^= uint64(b[p])*prime5
+        h  = bits.RotateLeft64(h, 11)*prime1
+    }
+    h ^= h >> 33
+    h *= prime2
+    h ^= h >> 29
+    h *= prime3
+    h ^= h >> 32
+    return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+    acc += input*prime2
+    acc  = bits.RotateLeft64(acc, 31)
+    acc *= prime1
+    return acc
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+    acc ^= xxRound(0, val)
+    acc  = acc*prime1 + prime4
+    return acc
+}
+
+// SipHash-2-4哈希计算，k0、k1为128位密钥的低64位和高64位(小端)
+func SipHash(b []byte, k0, k1 uint64) uint64 {
+    v0 := k0 ^ 0x736f6d6570736575
+    v1 := k1 ^ 0x646f72616e646f6d
+    v2 := k0 ^ 0x6c7967656e657261
+    v3 := k1 ^ 0x7465646279746573
+    n  := len(b)
+    for len(b) >= 8 {
+        m := binary.LittleEndian.Uint64(b)
+        v3 ^= m
+        v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+        v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+        v0 ^= m
+        b = b[8 : ]
+    }
+    m := uint64(n) << 56
+    for i := len(b) - 1; i >= 0; i-- {
+        m |= uint64(b[i]) << (8*uint(i))
+    }
+    v3 ^= m
+    v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+    v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+    v0 ^= m
+    v2 ^= 0xff
+    for i := 0; i < 4; i++ {
+        v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+    }
+    return v0 ^ v1 ^ v2 ^ v3
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+    v0 += v1
+    v1  = bits.RotateLeft64(v1, 13)
+    v1 ^= v0
+    v0  = bits.RotateLeft64(v0, 32)
+    v2 += v3
+    v3  = bits.RotateLeft64(v3, 16)
+    v3 ^= v2
+    v0 += v3
+    v3  = bits.RotateLeft64(v3, 21)
+    v3 ^= v0
+    v2 += v1
+    v1  = bits.RotateLeft64(v1, 17)
+    v1 ^= v2
+    v2  = bits.RotateLeft64(v2, 32)
+    return v0, v1, v2, v3
+}
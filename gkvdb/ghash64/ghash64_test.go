@@ -0,0 +1,53 @@
+package ghash64
+
+import (
+    "testing"
+)
+
+func TestXXHash64(t *testing.T) {
+    cases := []struct {
+        input string
+        seed  uint64
+        hash  uint64
+    }{
+        {"",    0, 0xef46db3751d8e999},
+        {"a",   0, 0xd24ec4f1a98c6e5b},
+        {"abc", 0, 0x44bc2cf5ad770999},
+        {"Nobody inspects the spammish repetition", 0, 0xfbcea83c8a378bf1},
+    }
+    for _, c := range cases {
+        if h := XXHash64([]byte(c.input), c.seed); h != c.hash {
+            t.Errorf("XXHash64(%q, %d) = %#x, want %#x", c.input, c.seed, h, c.hash)
+        }
+    }
+}
+
+func TestSipHash(t *testing.T) {
+    // 参考SipHash论文附录中的测试向量，密钥为00..0f
+    k0 := uint64(0x0706050403020100)
+    k1 := uint64(0x0f0e0d0c0b0a0908)
+    if h := SipHash([]byte{}, k0, k1); h != 0x726fdb47dd0e0e31 {
+        t.Errorf("SipHash(empty) = %#x", h)
+    }
+    msg := make([]byte, 15)
+    for i := range msg {
+        msg[i] = byte(i)
+    }
+    if h := SipHash(msg, k0, k1); h != 0xa129ca6149be45e5 {
+        t.Errorf("SipHash(00..0e) = %#x", h)
+    }
+}
+
+func BenchmarkXXHash64(b *testing.B) {
+    key := []byte("key_1234567890_value")
+    for i := 0; i < b.N; i++ {
+        XXHash64(key, 0)
+    }
+}
+
+func BenchmarkSipHash(b *testing.B) {
+    key := []byte("key_1234567890_value")
+    for i := 0; i < b.N; i++ {
+        SipHash(key, 0, 0)
+    }
+}
@@ -8,13 +8,14 @@
 //               当数据存储内容发生改变时，依靠碎片管理器对碎片进行回收再利用，且碎片大小 >= bucket
 
 // 索引文件结构    ：元数据文件偏移量倍数(36bit,64GB*元数据桶大小)|下一层级索引的文件偏移量倍数(重复分区标志位=1时有效) 元数据文件列表项大小(19bit,524287)|分区增量 深度分区标识符(1bit)
-// 元数据文件结构   :[键名哈希64(64bit) 键名长度(8bit) 键值长度(24bit,16MB) 数据文件偏移量(40bit,1TB)](变长)
-// 数据文件结构    ：[键名长度(8bit) 键名 键值](变长)
+// 元数据文件结构   :[键名哈希64(64bit) 键名长度(8bit|16bit) 键值长度(24bit,16MB) 数据文件偏移量(40bit,1TB)](变长)
+// 数据文件结构    ：[标志位(8bit,格式版本2) 键名长度(8bit|16bit) 键名 键值](变长)
 // BinLog文件结构 ：注意binlog中的事务编号不是递增的，但是是唯一的
 // [是否同步(8bit) 数据长度(32bit) 事务编号(64bit)] -- 事务开始
-// [表名长度(8bit) 键名长度(8bit) 键值长度(24bit,16MB) 表名 键名 键值 ](变长，当键值长度为0表示删除)
+// [标志位(8bit,格式版本2) 表名长度(8bit) 键名长度(8bit|16bit) 键值长度(24bit,16MB) 表名 键名 键值 ](变长，当键值长度为0表示删除)
 // ...
 // [事务编号(64bit)] -- 事务结束
+// 键名长度字段的大小由数据库的格式版本决定：格式版本1为8bit(255B)，格式版本2为16bit(64KB)
 
 // 基于DRH(Deep-Re-Hash)算法的高性能Key-Value嵌入式数据库.
 package gkvdb
@@ -24,22 +25,19 @@ import (
     "strconv"
     "errors"
     "github.com/gogf/gf/g/os/gfile"
-    "github.com/gogf/gf/g/encoding/ghash"
     "github.com/gogf/gf/g/container/gmap"
     "github.com/gogf/gf/g/container/gtype"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
     "os"
 )
 
 const (
     gDEFAULT_PART_SIZE       = 100000                   // 默认哈希表分区大小
+    gSCAN_PAUSE_PARTS        = 1000                     // 分段遍历时每一段的索引分区数量
     gMAX_TABLE_SIZE          = 0xFF                     // 表名最大长度(255byte)
-    gMAX_KEY_SIZE            = 0xFF                     // 键名最大长度(255byte)
     gMAX_VALUE_SIZE          = 0xFFFFFF                 // 键值最大长度(16MB)
-    gMETA_ITEM_SIZE          = 17                       // 元数据单项大小(byte)
-    gMAX_META_LIST_SIZE      = 65535*gMETA_ITEM_SIZE    // 阶数，元数据列表最大大小(byte)
     gMAX_DATA_FILE_SIZE      = 0xFFFFFFFFFF             // 数据文件最大大小(40bit, 1TB)
     gINDEX_BUCKET_SIZE       = 7                        // 索引文件数据块大小(byte)
-    gMETA_BUCKET_SIZE        = 5*gMETA_ITEM_SIZE        // 元数据数据分块大小(byte, 值越大，数据增长时占用的空间越大)
     gDATA_BUCKET_SIZE        = 32                       // 数据分块大小(byte, 值越大，数据增长时占用的空间越大)
     gFILE_POOL_CACHE_TIMEOUT = 60000                    // 文件指针池缓存时间(秒)
     gCACHE_DEFAULT_TIMEOUT   = 10000                    // gcache默认缓存时间(毫秒)
@@ -47,38 +45,174 @@ const (
     gAUTO_COMPACTING_TIMEOUT = 100                      // 自动进行数据整理的时间(毫秒)
     gBINLOG_MAX_SIZE         = 20*1024*1024             // binlog临时队列最大大小(byte)，超过该长度则强制性阻塞同步到数据文件
     gDEFAULT_TABLE_NAME      = "default"                // 默认的数据表名
+    gMEMORY_DB_PATH          = "/gkvdb"                 // 内存数据库在内存文件系统中的目录路径
+)
+
+var (
+    // 数据库(或者数据表)已关闭
+    ErrClosed = errors.New("database closed")
+    // 数据库目录已被其他进程打开
+    ErrLocked = errors.New("database locked by another process")
+    // 只读模式下执行写入操作
+    ErrReadOnly = errors.New("database opened in read-only mode")
+    // 事务中原子操作读取的数据在提交前已被其他事务修改，事务已回滚
+    ErrConflict = errors.New("transaction conflict: value changed by another transaction")
+    // binlog队列达到上限且写入背压策略为BackpressureFail
+    ErrBusy = errors.New("database busy: binlog queue is full")
+    // 加密的键值解密失败(密钥错误或者数据被篡改)
+    ErrDecrypt = errors.New("failed to decrypt value: wrong key or corrupted data")
+    // 数据已加密但是没有配置KeyProvider
+    ErrNoKeyProvider = errors.New("encrypted data requires a key provider")
+    // 数据表的二级索引在重新打开数据库之后还没有通过CreateIndex重新注册索引字段提取函数
+    ErrIndexNotRegistered = errors.New("secondary index of table is not registered, call CreateIndex first")
+    // 大事务已写入binlog并fsync(提交成功)，但是在同步到数据文件之前ctx被取消或者同步失败，由后台的同步线程继续同步，
+    // 同步完成之前大事务的数据可能只有部分可见
+    ErrApplyPending = errors.New("transaction committed to binlog, applying to data files in background")
 )
 
 // KV数据库
 type DB struct {
-    mu     sync.RWMutex             // API互斥锁
-    path   string                   // 数据文件存放目录路径
-    tables *gmap.StringInterfaceMap // 多表集合
-    binlog *BinLog                  // BinLog
-    closed *gtype.Bool              // 数据库是否关闭，以便异步线程进行判断处理
+    mu       sync.RWMutex                  // API互斥锁
+    tmu      sync.Mutex                    // 数据表创建互斥锁
+    memts    map[string]*MemTable          // 只读模式下已关闭的数据表的memtable(binlog中未同步的数据)，重新打开时继续使用(tmu保护)
+    emu      sync.Mutex                    // 事件队列互斥锁
+    events   *_EventQueue                  // 事件队列，第一次触发事件时创建
+    wg       sync.WaitGroup                // 后台线程等待组
+    path     string                        // 数据文件存放目录路径
+    fs       gvfs.FS                       // 文件系统
+    lock     *_Lock                        // 数据库目录锁
+    tables   *gmap.StringInterfaceMap      // 多表集合
+    binlog   *BinLog                       // BinLog
+    options  Options                       // 数据库选项
+    format   *_Format                      // 数据库文件格式
+    manifest *_Manifest                    // 数据库manifest信息
+    hash     HashFunc                      // 键名哈希函数
+    closed   *gtype.Bool                   // 数据库是否关闭，以便异步线程进行判断处理
+    readonly bool                          // 是否只读模式
+    rotating int32                         // 是否正在重新加密(原子操作)
+    imu      sync.RWMutex                  // 二级索引互斥锁
+    indexes  map[string][]*_SecondaryIndex // 二级索引，键名为数据表名
+    igen     int64                         // 二级索引版本，每一次注册、修改或者删除索引时递增(imu保护)
 }
 
-// 创建一个KV数据库，path指定数据库文件的存放目录绝对路径
-func New(path string) (*DB, error) {
+// 创建一个KV数据库，path指定数据库文件的存放目录绝对路径，options为可选的数据库选项
+func New(path string, options...Options) (*DB, error) {
     db := &DB {
         path   : path,
         tables : gmap.NewStringInterfaceMap(),
         closed : gtype.NewBool(),
     }
+    if len(options) > 0 {
+        db.options = options[0]
+    }
+    db.fs = db.getFS()
+    // 原地升级(Migrate)替换数据库目录的过程中进程异常退出时，完成替换或者恢复原有数据库目录
+    if db.fs == gvfs.OS {
+        if err := recoverMigration(path); err != nil {
+            return nil, err
+        }
+    }
     // 初始化数据库目录
-    if !gfile.Exists(path) {
-        gfile.Mkdir(path)
+    if !gvfs.Exists(db.fs, path) {
+        if err := db.fs.MkdirAll(path, 0755); err != nil {
+            return nil, err
+        }
+    }
+    return db.open()
+}
+
+// 创建一个纯内存的KV数据库，所有数据保存在内存文件系统中，不访问磁盘，数据库关闭之后数据随之释放；
+// 与磁盘数据库执行相同的代码逻辑，可选参数options中的FS选项无效
+func NewInMemory(options...Options) (*DB, error) {
+    option := Options{}
+    if len(options) > 0 {
+        option = options[0]
+    }
+    option.FS = gvfs.NewMemFS()
+    return New(gMEMORY_DB_PATH, option)
+}
+
+// 以只读模式打开已存在的数据库，多个只读进程可以同时打开同一个数据库，但不能与读写进程同时打开；
+// 只读模式不会开启数据同步及整理线程，不修改数据库的任何文件(锁文件不存在时创建空的锁文件)，binlog中未同步的数据仅加载到内存中，
+// 所有的写入操作都将返回ErrReadOnly；可选参数options中只有Logger、OnEvent及FS等选项有效
+func OpenReadOnly(path string, options...Options) (*DB, error) {
+    db := &DB {
+        path     : path,
+        tables   : gmap.NewStringInterfaceMap(),
+        closed   : gtype.NewBool(),
+        readonly : true,
+    }
+    if len(options) > 0 {
+        db.options = options[0]
+    }
+    db.fs = db.getFS()
+    if info, err := db.fs.Stat(path); err != nil || !info.IsDir() {
+        return nil, errors.New("database does not exist: " + path)
+    }
+    return db.open()
+}
+
+// 打开数据库，加锁并初始化manifest、binlog及相关服务
+func (db *DB) open() (*DB, error) {
+    // 数据库目录加锁，读写模式下同一时间只能有一个进程打开数据库
+    if lock, err := db.acquireLock(!db.readonly); err != nil {
+        return nil, err
+    } else {
+        db.lock = lock
+    }
+    // 初始化数据库manifest，并检查数据库格式兼容性
+    if manifest, err := db.initManifest(); err != nil {
+        db.lock.release()
+        return nil, err
+    } else {
+        db.manifest  = manifest
+        db.format, _ = getFormat(manifest.format)
+        db.hash,   _ = newHashFunc(manifest.hash, manifest.hashSeed)
+    }
+    // 键值加密，加密标志保存在数据记录及binlog数据项的标志位中，因此需要格式版本2
+    if db.options.KeyProvider != nil {
+        if db.format.version < gFORMAT_VERSION_2 {
+            db.lock.release()
+            return nil, errors.New("encryption requires format version " + strconv.Itoa(gFORMAT_VERSION_2) + ", use Migrate to upgrade the database")
+        }
+        db.format.cipher        = newCipher(db.options.KeyProvider)
+        db.format.maxValueSize -= gCIPHER_OVERHEAD
     }
     // 初始化BinLog
     if binlog, err := newBinLog(db); err != nil {
+        db.lock.release()
         return nil, err
     } else {
         db.binlog = binlog
     }
 
+    // 清理异常退出时遗留的事务落盘文件
+    if !db.readonly {
+        db.removeSpillFiles()
+    }
     // 自检并初始化相关服务
-    db.binlog.initFromFile()
-    go db.startAutoSyncingLoop()
+    if err := db.binlog.initFromFile(); err != nil {
+        // binlog恢复过程中打开的数据表已开启后台线程，需要关闭
+        db.closeTables()
+        db.stopEvents()
+        db.lock.release()
+        return nil, err
+    }
+    // 加载持久化保存的二级索引定义
+    if err := db.loadIndexes(); err != nil {
+        db.closeTables()
+        db.stopEvents()
+        db.lock.release()
+        return nil, err
+    }
+    if !db.readonly {
+        db.wg.Add(1)
+        go db.startAutoSyncingLoop()
+        if db.options.Sync == SyncPeriodic && (db.options.SyncInterval > 0 || db.options.SyncBytes == 0) {
+            db.wg.Add(1)
+            go db.startAutoFsyncLoop()
+        }
+    }
     return db, nil
 }
 
@@ -88,37 +222,94 @@ func (db *DB) getBinLogFilePath() string {
 }
 
 // 获得binlog文件打开指针
-func (db *DB) getBinlogFilePointer() (*os.File, error) {
-    return os.OpenFile(db.getBinLogFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+func (db *DB) getBinlogFilePointer() (gvfs.File, error) {
+    return db.openFile(db.getBinLogFilePath())
+}
+
+// 获取数据库使用的文件系统
+func (db *DB) getFS() gvfs.FS {
+    if db.options.FS != nil {
+        return db.options.FS
+    }
+    return gvfs.OS
+}
+
+// 打开数据库文件，只读模式下以只读方式打开且不创建文件
+func (db *DB) openFile(path string) (gvfs.File, error) {
+    if db.readonly {
+        return db.fs.OpenFile(path, os.O_RDONLY, 0)
+    }
+    return db.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+}
+
+// 检查数据库文件的访问权限，文件不存在或者能够以数据库的读写模式打开时返回true
+func (db *DB) isFileAccessible(path string) bool {
+    if !gvfs.Exists(db.fs, path) {
+        return true
+    }
+    pf, err := db.openFile(path)
+    if err != nil {
+        return false
+    }
+    pf.Close()
+    return true
+}
+
+// 读取文件指针中指定区间的数据，读取失败时返回nil
+func getBinContentsByTwoOffsets(pf gvfs.File, start int64, end int64) []byte {
+    buffer := make([]byte, end - start)
+    if _, err := pf.ReadAt(buffer, start); err != nil {
+        return nil
+    }
+    return buffer
 }
 
 // 关闭数据库链接，释放资源
-func (db *DB) Close() {
+// 关闭时会等待正在执行的写入操作完成，将binlog中未同步的数据同步到数据文件，并停止所有的后台线程，
+// 关闭之后数据库的所有操作都将返回ErrClosed
+func (db *DB) Close() error {
+    // 设置关闭标识，写锁保证正在执行的事务提交完成
+    db.mu.Lock()
+    if db.closed.Val() {
+        db.mu.Unlock()
+        return ErrClosed
+    }
+    db.closed.Set(true)
+    db.mu.Unlock()
+
+    // 停止binlog同步线程，并将未同步的数据同步到数据文件
+    db.binlog.close()
+    db.wg.Wait()
+    err := db.binlog.sync()
+
     // 关闭数据库所有的表
-    db.tables.RLockFunc(func(m map[string]interface{}) {
+    db.closeTables()
+    // 等待已触发的事件回调完成
+    db.stopEvents()
+    // 最后释放数据库目录锁
+    if e := db.lock.release(); err == nil {
+        err = e
+    }
+    return err
+}
+
+// 关闭并移除数据库所有的表
+func (db *DB) closeTables() {
+    tables := make([]*Table, 0)
+    db.tables.LockFunc(func(m map[string]interface{}) {
         for k, v := range m {
-            table := v.(*Table)
-            table.Close()
-            db.tables.Remove(k)
+            tables = append(tables, v.(*Table))
+            delete(m, k)
         }
     })
-    // 关闭binlog
-    db.binlog.close()
-    // 设置关闭标识，使得异步线程自动关闭
-    db.closed.Set(true)
+    for _, table := range tables {
+        table.close()
+    }
 }
 
-// 计算关键字的hash code，使用64位哈希函数
-func getHash64(key []byte) uint64 {
-    return ghash.BKDRHash64(key)
-}
-
-// 根据元数据的size计算cap
-func getMetaCapBySize(size int) int {
-    if size > 0 && size%gMETA_BUCKET_SIZE != 0 {
-        return size + gMETA_BUCKET_SIZE - size%gMETA_BUCKET_SIZE
-    }
-    return size
+// 计算关键字的hash code，使用数据库manifest中记录的64位哈希函数
+func (db *DB) getHash64(key []byte) uint64 {
+    return db.hash(key)
 }
 
 // 根据数据的size计算cap
@@ -137,18 +328,18 @@ func checkTableValid(name string) error {
     return nil
 }
 
-// 检测键名合法性
-func checkKeyValid(key []byte) error {
-    if len(key) > gMAX_KEY_SIZE || len(key) == 0 {
-        return errors.New("invalid key size, should be in 1 and " + strconv.Itoa(gMAX_KEY_SIZE) + " bytes")
+// 检测键名合法性，max为数据库格式允许的键名最大长度
+func checkKeyValid(key []byte, max int) error {
+    if len(key) > max || len(key) == 0 {
+        return errors.New("invalid key size, should be in 1 and " + strconv.Itoa(max) + " bytes")
     }
     return nil
 }
 
 // 检测键值合法性
-func checkValueValid(value []byte) error {
-    if len(value) > gMAX_VALUE_SIZE {
-        return errors.New("too large value size, max allowed: " + strconv.Itoa(gMAX_VALUE_SIZE) + " bytes")
+func checkValueValid(value []byte, maxValueSize int) error {
+    if len(value) > maxValueSize {
+        return errors.New("too large value size, max allowed: " + strconv.Itoa(maxValueSize) + " bytes")
     }
     return nil
 }
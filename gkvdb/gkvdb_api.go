@@ -1,5 +1,9 @@
 package gkvdb
 
+import (
+    "context"
+)
+
 // =================================================================================
 // 数据库操作
 // =================================================================================
@@ -48,20 +52,26 @@ func (db *DB) RemoveFrom(key []byte, name string) error {
 // 获取max条随机键值对，max=-1时获取所有数据返回
 // 该方法会强制性遍历整个数据库
 func (db *DB) Items(max int) map[string][]byte {
-    table, _ := db.Table(gDEFAULT_TABLE_NAME)
-    return table.Items(max)
+    if table, _ := db.Table(gDEFAULT_TABLE_NAME); table != nil {
+        return table.Items(max)
+    }
+    return nil
 }
 
 // 获取最多max个随机键名，构成列表返回
 func (db *DB) Keys(max int) []string {
-    table, _ := db.Table(gDEFAULT_TABLE_NAME)
-    return table.Keys(max)
+    if table, _ := db.Table(gDEFAULT_TABLE_NAME); table != nil {
+        return table.Keys(max)
+    }
+    return nil
 }
 
 // 获取最多max个随机键值，构成列表返回
 func (db *DB) Values(max int) [][]byte {
-    table, _ := db.Table(gDEFAULT_TABLE_NAME)
-    return table.Values(max)
+    if table, _ := db.Table(gDEFAULT_TABLE_NAME); table != nil {
+        return table.Values(max)
+    }
+    return nil
 }
 
 // =================================================================================
@@ -70,6 +80,12 @@ func (db *DB) Values(max int) [][]byte {
 
 // 保存数据(数据表)
 func (table *Table) Set(key []byte, value []byte) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
     tx := table.db.Begin()
     if err := tx.SetTo(key, value, table.name); err != nil {
         return err
@@ -79,14 +95,18 @@ func (table *Table) Set(key []byte, value []byte) error {
 
 // 查询数据(数据表)
 func (table *Table) Get(key []byte) []byte {
-    if v, ok := table.memt.get(key); ok {
-        return v
-    }
-    return table.get(key)
+    value, _ := table.GetCtx(context.Background(), key)
+    return value
 }
 
 // 删除数据(数据表)
 func (table *Table) Remove(key []byte) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
     tx := table.db.Begin()
     if err := tx.RemoveFrom(key, table.name); err != nil {
         return err
@@ -96,12 +116,17 @@ func (table *Table) Remove(key []byte) error {
 
 // 随机遍历数据表
 func (table *Table) Items(max int) map[string][]byte {
-    // 先查询内存表
-    m := table.memt.items(max)
-    if max == -1 || max - len(m) > 0 {
-        // 数据不够再遍历磁盘
-        return table.items(max - len(m), m)
+    if table.closed.Val() {
+        return nil
+    }
+    m := make(map[string][]byte)
+    if max == 0 {
+        return m
     }
+    table.scan(context.Background(), func(key, value []byte) bool {
+        m[string(key)] = value
+        return len(m) != max
+    })
     return m
 }
 
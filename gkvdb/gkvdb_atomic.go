@@ -0,0 +1,232 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "strconv"
+)
+
+// =================================================================================
+// 原子操作(事务)
+// 原子操作读取最新提交的数据(包括memtable中的数据)，并在事务提交时检查读取的数据是否已被其他事务修改，
+// 已被修改时提交返回ErrConflict并回滚事务；事务中已写入的键名直接在事务数据上进行操作
+// =================================================================================
+
+// 将键值作为10进制整数增加delta(键名不存在时初始值为0)，返回增加后的值
+func (tx *Transaction) Incr(key []byte, delta int64) (int64, error) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    value, err := tx.read(key, tx.table)
+    if err != nil {
+        return 0, err
+    }
+    number := int64(0)
+    if len(value) > 0 {
+        if number, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+            return 0, errors.New("value is not an integer")
+        }
+    }
+    number += delta
+    return number, tx.set(key, []byte(strconv.FormatInt(number, 10)), tx.table)
+}
+
+// 当键值等于old时将键值修改为value，old为nil表示键名不存在，value为nil表示删除，返回是否修改成功
+func (tx *Transaction) CompareAndSwap(key, old, value []byte) (bool, error) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    current, err := tx.read(key, tx.table)
+    if err != nil {
+        return false, err
+    }
+    if !bytes.Equal(current, old) {
+        return false, nil
+    }
+    return true, tx.set(key, value, tx.table)
+}
+
+// 当键名不存在时写入数据，返回是否写入成功
+func (tx *Transaction) SetNX(key, value []byte) (bool, error) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    current, err := tx.read(key, tx.table)
+    if err != nil {
+        return false, err
+    }
+    if current != nil {
+        return false, nil
+    }
+    return true, tx.set(key, value, tx.table)
+}
+
+// 写入数据，并返回写入之前的键值
+func (tx *Transaction) GetSet(key, value []byte) ([]byte, error) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    current, err := tx.read(key, tx.table)
+    if err != nil {
+        return nil, err
+    }
+    return current, tx.set(key, value, tx.table)
+}
+
+// 在键值末尾追加数据(键名不存在时直接写入)，返回追加后的键值长度
+func (tx *Transaction) Append(key, value []byte) (int, error) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    current, err := tx.read(key, tx.table)
+    if err != nil {
+        return 0, err
+    }
+    buffer := make([]byte, len(current) + len(value))
+    copy(buffer, current)
+    copy(buffer[len(current):], value)
+    return len(buffer), tx.set(key, buffer, tx.table)
+}
+
+// 读取原子操作的键值(内部调用，调用方加锁)，事务中已写入的数据优先，
+// 否则读取最新提交的数据，并记录读取的数据以便提交时进行检查，同一事务中多次读取返回相同的数据
+func (tx *Transaction) read(key []byte, name string) ([]byte, error) {
+    if v, ok, err := tx.pending(key, name); ok {
+        return v, err
+    }
+    if err := checkTableValid(name); err != nil {
+        return nil, err
+    }
+    if err := checkKeyValid(key, tx.db.format.maxKeySize); err != nil {
+        return nil, err
+    }
+    table, err := tx.db.Table(name)
+    if err != nil {
+        return nil, err
+    }
+    // 子事务通过父事务读取，由父事务记录读取的数据并在提交时检查
+    if tx.parent != nil {
+        tx.parent.mu.Lock()
+        value, err := tx.parent.read(key, name)
+        tx.parent.mu.Unlock()
+        if err != nil {
+            return nil, err
+        }
+        if operands, ok := tx.merges[name][string(key)]; ok {
+            return table.fold(key, value, operands)
+        }
+        return value, nil
+    }
+    if _, ok := tx.reads[name]; !ok {
+        tx.reads[name] = make(map[string][]byte)
+    }
+    value, ok := tx.reads[name][string(key)]
+    if !ok {
+        value = table.value(key)
+        tx.reads[name][string(key)] = value
+    }
+    // 事务中存在该键名的合并操作数时，返回合并后的键值
+    if operands, ok := tx.merges[name][string(key)]; ok {
+        return table.fold(key, value, operands)
+    }
+    return value, nil
+}
+
+// 检查原子操作读取的数据是否已被其他事务修改，在binlog写锁内执行
+func (tx *Transaction) checkReads() error {
+    for name, m := range tx.reads {
+        table, err := tx.db.table(name)
+        if err != nil {
+            return err
+        }
+        for k, v := range m {
+            if !bytes.Equal(table.value([]byte(k)), v) {
+                return ErrConflict
+            }
+        }
+    }
+    return tx.checkIndexReads()
+}
+
+// =================================================================================
+// 原子操作(数据表)
+// 每一次操作都在独立的事务中执行，其他事务并发修改同一键名时自动重试
+// =================================================================================
+
+// 将键值作为10进制整数增加delta(键名不存在时初始值为0)，返回增加后的值
+func (table *Table) Incr(key []byte, delta int64) (int64, error) {
+    number := int64(0)
+    err    := table.atomic(func(tx *Transaction) (err error) {
+        number, err = tx.Incr(key, delta)
+        return
+    })
+    return number, err
+}
+
+// 当键值等于old时将键值修改为value，old为nil表示键名不存在，value为nil表示删除，返回是否修改成功
+func (table *Table) CompareAndSwap(key, old, value []byte) (bool, error) {
+    swapped := false
+    err     := table.atomic(func(tx *Transaction) (err error) {
+        swapped, err = tx.CompareAndSwap(key, old, value)
+        return
+    })
+    return swapped, err
+}
+
+// 当键名不存在时写入数据，返回是否写入成功
+func (table *Table) SetNX(key, value []byte) (bool, error) {
+    ok  := false
+    err := table.atomic(func(tx *Transaction) (err error) {
+        ok, err = tx.SetNX(key, value)
+        return
+    })
+    return ok, err
+}
+
+// 写入数据，并返回写入之前的键值
+func (table *Table) GetSet(key, value []byte) ([]byte, error) {
+    var old []byte
+    err := table.atomic(func(tx *Transaction) (err error) {
+        old, err = tx.GetSet(key, value)
+        return
+    })
+    return old, err
+}
+
+// 在键值末尾追加数据(键名不存在时直接写入)，返回追加后的键值长度
+func (table *Table) Append(key, value []byte) (int, error) {
+    length := 0
+    err    := table.atomic(func(tx *Transaction) (err error) {
+        length, err = tx.Append(key, value)
+        return
+    })
+    return length, err
+}
+
+// 在独立的事务中执行原子操作并提交，提交冲突时重试
+func (table *Table) atomic(f func(tx *Transaction) error) error {
+    return table.atomicCtx(context.Background(), f)
+}
+
+// 在独立的事务中执行原子操作，ctx取消或者超时时停止重试并返回ctx的错误
+func (table *Table) atomicCtx(ctx context.Context, f func(tx *Transaction) error) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
+    for {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        tx := table.db.Begin(table.name)
+        if err := f(tx); err != nil {
+            return err
+        }
+        if err := tx.CommitCtx(ctx); err != ErrConflict {
+            return err
+        }
+    }
+}
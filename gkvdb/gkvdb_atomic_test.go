@@ -0,0 +1,111 @@
+package gkvdb
+
+import (
+    "sync"
+    "testing"
+)
+
+func TestAtomicConcurrentIncr(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    var wg sync.WaitGroup
+    for g := 0; g < 10; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 100; i++ {
+                if _, err := table.Incr([]byte("n"), 1); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if v := table.Get([]byte("n")); string(v) != "1000" {
+        t.Fatalf("incr: got %q, want 1000", v)
+    }
+    table.Set([]byte("s"), []byte("x"))
+    if _, err := table.Incr([]byte("s"), 1); err == nil {
+        t.Fatal("incr of non-integer value should fail")
+    }
+}
+
+func TestAtomicOperations(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    if ok, _ := table.SetNX([]byte("m"), []byte("x")); !ok {
+        t.Fatal("SetNX on missing key should succeed")
+    }
+    if ok, _ := table.SetNX([]byte("m"), []byte("y")); ok {
+        t.Fatal("SetNX on existing key should fail")
+    }
+    if ok, _ := table.CompareAndSwap([]byte("m"), []byte("y"), []byte("z")); ok {
+        t.Fatal("CompareAndSwap with wrong old value should fail")
+    }
+    if ok, _ := table.CompareAndSwap([]byte("m"), []byte("x"), []byte("z")); !ok {
+        t.Fatal("CompareAndSwap with matching old value should succeed")
+    }
+    // old为nil表示键名不存在，value为nil表示删除
+    if ok, _ := table.CompareAndSwap([]byte("new"), nil, []byte("1")); !ok {
+        t.Fatal("CompareAndSwap on missing key should succeed")
+    }
+    if ok, _ := table.CompareAndSwap([]byte("new"), []byte("1"), nil); !ok || table.Get([]byte("new")) != nil {
+        t.Fatal("CompareAndSwap to nil should remove the key")
+    }
+    if old, _ := table.GetSet([]byte("m"), []byte("ab")); string(old) != "z" {
+        t.Fatalf("GetSet: got %q, want z", old)
+    }
+    if n, _ := table.Append([]byte("m"), []byte("cd")); n != 4 || string(table.Get([]byte("m"))) != "abcd" {
+        t.Fatalf("Append: got %d %q", n, table.Get([]byte("m")))
+    }
+}
+
+func TestAtomicConflict(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    table.Set([]byte("m"), []byte("x"))
+
+    // 读取之后被其他事务修改，提交时返回ErrConflict并回滚
+    tx := db.Begin("c")
+    if ok, err := tx.CompareAndSwap([]byte("m"), []byte("x"), []byte("tx")); !ok || err != nil {
+        t.Fatalf("CompareAndSwap in transaction: %v %v", ok, err)
+    }
+    tx.Set([]byte("other"), []byte("1"))
+    table.Set([]byte("m"), []byte("y"))
+    if err := tx.Commit(); err != ErrConflict {
+        t.Fatalf("commit: got %v, want ErrConflict", err)
+    }
+    if v := table.Get([]byte("m")); string(v) != "y" {
+        t.Fatalf("conflicting transaction was applied: %q", v)
+    }
+    if table.Get([]byte("other")) != nil {
+        t.Fatal("conflicting transaction was partially applied")
+    }
+
+    // 事务中已写入的键名直接在事务数据上进行操作
+    tx = db.Begin("c")
+    tx.Set([]byte("q"), []byte("1"))
+    if n, _ := tx.Incr([]byte("q"), 2); n != 3 {
+        t.Fatalf("incr of pending value: got %d, want 3", n)
+    }
+    table.Set([]byte("q"), []byte("100"))
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if v := table.Get([]byte("q")); string(v) != "3" {
+        t.Fatalf("got %q, want 3", v)
+    }
+}
@@ -1,44 +1,76 @@
 package gkvdb
 
 import (
-    "os"
     "time"
+    "sync/atomic"
     "errors"
-    "github.com/gogf/gf/g/os/glog"
-    "github.com/gogf/gf/g/os/gfile"
-    "github.com/gogf/gf/g/encoding/gbinary"
     "github.com/gogf/gf/g/os/gmlock"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
 )
 
 // 数据文件自动整理
 func (table *Table) startAutoCompactingLoop() {
-    func() {
-        for !table.closed.Val() {
-            if err := table.autoCompactingData(); err != nil {
-                glog.Error("data compacting error:", err)
-                time.Sleep(time.Second)
-            }
-            if err := table.autoCompactingMeta(); err != nil {
-                glog.Error("meta compacting error:", err)
-                time.Sleep(time.Second)
-            }
-            time.Sleep(gAUTO_COMPACTING_TIMEOUT*time.Millisecond)
+    defer table.wg.Done()
+    for !table.closed.Val() {
+        if err := table.autoCompactingData(); err != nil {
+            table.db.logger().Errorf("data compacting error: %v", err)
+            table.db.emit(Event{Type: EventCompactionError, Table: table.name, File: "db", Err: err})
+            table.sleep(time.Second)
+        }
+        if err := table.autoCompactingMeta(); err != nil {
+            table.db.logger().Errorf("meta compacting error: %v", err)
+            table.db.emit(Event{Type: EventCompactionError, Table: table.name, File: "mt", Err: err})
+            table.sleep(time.Second)
         }
-    }()
+        table.sleep(gAUTO_COMPACTING_TIMEOUT*time.Millisecond)
+    }
 }
 
-// 开启自动同步线程
+// 休眠指定时间，数据表关闭时立即返回
+func (table *Table) sleep(d time.Duration) {
+    select {
+        case <- table.closeEvents:
+        case <- time.After(d):
+    }
+}
+
+// 开启定时fsync线程(SyncPeriodic策略)，按照时间间隔将已写入的binlog数据fsync到磁盘
+func (db *DB) startAutoFsyncLoop() {
+    defer db.wg.Done()
+    interval := db.options.SyncInterval
+    if interval <= 0 {
+        interval = gDEFAULT_SYNC_INTERVAL
+    }
+    for {
+        select {
+            case <- db.binlog.closeEvents:
+                return
+            case <- time.After(interval):
+                if err := db.binlog.groupSync(atomic.LoadInt64(&db.binlog.written)); err != nil {
+                    db.logger().Errorf("binlog fsync error: %v", err)
+                    db.emit(Event{Type: EventFsyncError, File: "binlog", Err: err})
+                }
+        }
+    }
+}
+
+// 开启自动同步线程，同步失败时间隔重试，直到同步成功或者数据库关闭
 func (db *DB) startAutoSyncingLoop() {
-    func() {
-        for {
-            select {
-                case <- db.binlog.syncEvents:
-                    db.binlog.sync()
-                case <- db.binlog.closeEvents:
-                    return
-            }
+    defer db.wg.Done()
+    for {
+        select {
+            case <- db.binlog.syncEvents:
+                for db.binlog.sync() != nil {
+                    select {
+                        case <- db.binlog.closeEvents:
+                            return
+                        case <- time.After(time.Second):
+                    }
+                }
+            case <- db.binlog.closeEvents:
+                return
         }
-    }()
+    }
 }
 
 
@@ -65,27 +97,28 @@ func (table *Table) autoCompactingData() error {
     // 返回参数
     var retmsg error = nil
     dbpath  := table.getDataFilePath()
-    dbsize  := gfile.Size(dbpath)
+    dbsize  := gvfs.Size(table.db.fs, dbpath)
     dbstart := index + int64(maxsize)
     if dbstart == dbsize {
         // 如果碎片正好在文件末尾,那么直接truncate
-        return os.Truncate(dbpath, int64(index))
+        return table.db.fs.Truncate(dbpath, int64(index))
     } else {
         if dbpf, retmsg := table.getDataFilePointer(); retmsg == nil {
             defer dbpf.Close()
             // 为防止截止位置超出文件长度，这里先获取键名长度
-            if buffer := gfile.GetBinContentsByTwoOffsets(dbpf, dbstart, dbstart + 1); buffer != nil {
-                klen   := gbinary.DecodeToUint8(buffer)
-                key    := gfile.GetBinContentsByTwoOffsets(dbpf, dbstart + 1, dbstart + 1 + int64(klen))
+            head := int64(table.db.format.dataHeadSize)
+            if buffer := getBinContentsByTwoOffsets(dbpf, dbstart, dbstart + head); buffer != nil {
+                _, klen := table.db.format.decodeDataHead(buffer)
+                key    := getBinContentsByTwoOffsets(dbpf, dbstart + head, dbstart + head + int64(klen))
                 record := &_Record {
-                    hash64  : uint(getHash64(key)),
+                    hash64  : uint(table.db.getHash64(key)),
                     key     : key,
                 }
                 // 查找对应数据的索引信息，并执行更新
                 if retmsg = table.getIndexInfoByRecord(record); retmsg == nil {
                     if record.meta.end > 0 {
                         if retmsg = table.getDataInfoByRecord(record); retmsg == nil {
-                            if dbbuffer := gfile.GetBinContentsByTwoOffsets(dbpf, record.data.start, record.data.end); dbbuffer != nil {
+                            if dbbuffer := getBinContentsByTwoOffsets(dbpf, record.data.start, record.data.end); dbbuffer != nil {
                                 record.data.start -= int64(maxsize)
                                 record.data.end   -= int64(maxsize)
                                 if _, retmsg = dbpf.WriteAt(dbbuffer, record.data.start); retmsg == nil {
@@ -99,6 +132,7 @@ func (table *Table) autoCompactingData() error {
                                             table.addDbFileSpace(int(record.data.start) + record.data.cap, maxsize)
                                             // 数据写入操作执行成功之后，才将旧数据添加进入碎片管理器
                                             table.addMtFileSpace(int(orecord.meta.start), orecord.meta.cap)
+                                            table.db.emit(Event{Type: EventCompactionMoved, Table: table.name, File: "db", Offset: record.data.start, Size: int64(maxsize)})
                                         }
                                     }
                                 }
@@ -146,13 +180,13 @@ func (table *Table) autoCompactingMeta() error {
 
     // 返回参数
     var retmsg error = nil
-    mtsize  := gfile.Size(table.getMetaFilePath())
+    mtsize  := gvfs.Size(table.db.fs, table.getMetaFilePath())
     mtstart := index + int64(maxsize)
     if mtstart == mtsize {
-        if err := os.Truncate(table.getMetaFilePath(), int64(index)); err == nil {
+        if err := table.db.fs.Truncate(table.getMetaFilePath(), int64(index)); err == nil {
             if index == 0 {
                 // 如果所有meta已被清空，那么重新初始化索引文件
-                gfile.PutBinContents(table.getIndexFilePath(), make([]byte, gINDEX_BUCKET_SIZE*gDEFAULT_PART_SIZE))
+                gvfs.WriteFile(table.db.fs, table.getIndexFilePath(), make([]byte, gINDEX_BUCKET_SIZE*gDEFAULT_PART_SIZE), 0755)
             }
             return nil
         } else {
@@ -162,15 +196,14 @@ func (table *Table) autoCompactingMeta() error {
         if mtpf, retmsg := table.getMetaFilePointer(); retmsg == nil {
             defer mtpf.Close()
             // 找到对应空闲块下一条meta item数据
-            if buffer := gfile.GetBinContentsByTwoOffsets(mtpf, mtstart, mtstart + gMETA_ITEM_SIZE); buffer != nil {
-                bits   := gbinary.DecodeBytesToBits(buffer)
-                hash64 := gbinary.DecodeBitsToUint(bits[0 : 64])
+            if buffer := getBinContentsByTwoOffsets(mtpf, mtstart, mtstart + int64(table.db.format.metaItemSize)); buffer != nil {
+                hash64, _, _, _ := table.db.format.decodeMeta(buffer)
                 record := &_Record {
                     hash64  : hash64,
                 }
                 // 查找对应的索引信息，并执行更新
                 if retmsg = table.getIndexInfoByRecord(record); retmsg == nil {
-                    if mtbuffer := gfile.GetBinContentsByTwoOffsets(mtpf, record.meta.start, record.meta.end); mtbuffer != nil {
+                    if mtbuffer := getBinContentsByTwoOffsets(mtpf, record.meta.start, record.meta.end); mtbuffer != nil {
                         record.meta.start -= int64(maxsize)
                         record.meta.end   -= int64(maxsize)
                         if _, retmsg = mtpf.WriteAt(mtbuffer, record.meta.start); retmsg == nil {
@@ -178,6 +211,7 @@ func (table *Table) autoCompactingMeta() error {
                             if retmsg = table.saveIndexByRecord(record); retmsg == nil {
                                 // 元数据迁移成功之后再将碎片空间往后挪
                                 table.addMtFileSpace(int(record.meta.start) + record.meta.cap, maxsize)
+                                table.db.emit(Event{Type: EventCompactionMoved, Table: table.name, File: "mt", Offset: record.meta.start, Size: int64(maxsize)})
                             }
                         }
                     } else {
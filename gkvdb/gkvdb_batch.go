@@ -0,0 +1,167 @@
+package gkvdb
+
+import (
+    "context"
+    "errors"
+    "math"
+    "sync"
+)
+
+const (
+    gWRITE_BATCH_BUFFER_SIZE = 64*1024 // 批量写入对象初始缓冲区大小(byte)
+)
+
+// 批量写入数据大小上限(byte)，binlog事务头中的数据长度按有符号32bit读取，并且-1(0xFFFFFFFF)表示大事务，
+// 因此上限需要小于math.MaxInt32(同时扣除事务头及事务尾的大小)，测试中可修改为较小的值
+var writeBatchMaxSize int64 = math.MaxInt32 - 13 - 8
+
+// 批量写入对象，写入的数据直接打包到binlog缓冲区中，提交时一次性写入binlog文件，
+// 提交或者重置之后缓冲区保留并在下一批次中重复使用，适用于大批量数据写入的场景
+type WriteBatch struct {
+    mu      sync.Mutex                   // 并发互斥锁
+    db      *DB                          // 所属数据库
+    table   string                       // 批量写入默认表
+    buffer  []byte                       // binlog事务缓冲区(包含事务头)
+    datamap map[string]map[string][]byte // 批量写入的数据(表名->键值对)，提交时写入memtable
+    count   int                          // 批量写入的数据项数量
+}
+
+// 创建一个批量写入对象，可选参数指定默认数据表
+func (db *DB) NewWriteBatch(table...string) *WriteBatch {
+    wb := &WriteBatch {
+        db     : db,
+        table  : gDEFAULT_TABLE_NAME,
+        buffer : make([]byte, 0, gWRITE_BATCH_BUFFER_SIZE),
+    }
+    if len(table) > 0 {
+        wb.table = table[0]
+    }
+    wb.Reset()
+    return wb
+}
+
+// 添加数据
+func (wb *WriteBatch) Put(key, value []byte) error {
+    return wb.PutTo(key, value, wb.table)
+}
+
+// 添加数据(针对数据表)
+func (wb *WriteBatch) PutTo(key, value []byte, name string) error {
+    if err := checkValueValid(value, wb.db.format.maxValueSize); err != nil {
+        return err
+    }
+    return wb.append(key, value, name)
+}
+
+// 删除数据
+func (wb *WriteBatch) Delete(key []byte) error {
+    return wb.DeleteFrom(key, wb.table)
+}
+
+// 删除数据(针对数据表)
+func (wb *WriteBatch) DeleteFrom(key []byte, name string) error {
+    return wb.append(key, nil, name)
+}
+
+// 批量写入的数据项数量
+func (wb *WriteBatch) Len() int {
+    wb.mu.Lock()
+    defer wb.mu.Unlock()
+    return wb.count
+}
+
+// 提交批量写入的数据，提交成功后批量写入对象自动重置
+func (wb *WriteBatch) Commit(sync...bool) error {
+    return wb.CommitCtx(context.Background(), sync...)
+}
+
+// 提交批量写入的数据，写入binlog之前的等待响应ctx的取消及超时
+func (wb *WriteBatch) CommitCtx(ctx context.Context, sync...bool) error {
+    wb.mu.Lock()
+    defer wb.mu.Unlock()
+
+    // 数据库关闭时会等待正在提交的批量写入完成
+    wb.db.mu.RLock()
+    defer wb.db.mu.RUnlock()
+    if wb.db.closed.Val() {
+        return ErrClosed
+    }
+    if wb.db.readonly {
+        return ErrReadOnly
+    }
+    if wb.count == 0 {
+        return nil
+    }
+    // 添加数据之后创建了索引的数据表不能写入，在binlog写锁内检查，保证回填索引时能够读取到批量写入的数据
+    check := func() error {
+        for name, _ := range wb.datamap {
+            if wb.db.isIndexTable(name) || wb.db.isIndexedTable(name) {
+                return errors.New("write batch cannot write to indexed table or index table: " + name)
+            }
+        }
+        return nil
+    }
+    txid   := wb.db.txid()
+    buffer := endBinLogTx(wb.buffer, txid)
+    if err := wb.db.binlog.write(ctx, buffer, wb.datamap, nil, check, sync...); err != nil {
+        // 去掉事务结束标识，以便重试提交
+        wb.buffer = buffer[0 : len(buffer) - 8]
+        return err
+    }
+    wb.reset()
+    return nil
+}
+
+// 重置批量写入对象，清空已添加的数据
+func (wb *WriteBatch) Reset() {
+    wb.mu.Lock()
+    wb.reset()
+    wb.mu.Unlock()
+}
+
+// 重置批量写入对象(内部调用)，已提交的数据被memtable及磁盘化队列引用，因此数据集合不能重复使用
+func (wb *WriteBatch) reset() {
+    wb.buffer  = beginBinLogTx(wb.buffer[0 : 0], 0)
+    wb.datamap = make(map[string]map[string][]byte)
+    wb.count   = 0
+}
+
+// 将数据项直接打包到binlog缓冲区中，同时记录到数据集合中(memtable及磁盘化队列不能引用可重用的缓冲区及调用方的数据)，
+// value为nil表示删除
+func (wb *WriteBatch) append(key, value []byte, name string) error {
+    if wb.db.readonly {
+        return ErrReadOnly
+    }
+    if err := checkTableValid(name); err != nil {
+        return err
+    }
+    // 批量写入不计算二级索引
+    if wb.db.isIndexTable(name) || wb.db.isIndexedTable(name) {
+        return errors.New("write batch cannot write to indexed table or index table: " + name)
+    }
+    if err := checkKeyValid(key, wb.db.format.maxKeySize); err != nil {
+        return err
+    }
+    wb.mu.Lock()
+    defer wb.mu.Unlock()
+    size := len(wb.buffer) - 13 + wb.db.format.binlogHeadSize + len(name) + len(key) + len(value) + gCIPHER_OVERHEAD
+    if int64(size) > writeBatchMaxSize {
+        return errors.New("write batch exceeds the max size of a binlog transaction, commit it before adding more data")
+    }
+    buffer, err := appendBinLogItem(wb.db.format, wb.buffer, 0, name, string(key), value)
+    if err != nil {
+        return err
+    }
+    if _, ok := wb.datamap[name]; !ok {
+        wb.datamap[name] = make(map[string][]byte)
+    }
+    var v []byte
+    if len(value) > 0 {
+        v = make([]byte, len(value))
+        copy(v, value)
+    }
+    wb.buffer = buffer
+    wb.datamap[name][string(key)] = v
+    wb.count++
+    return nil
+}
@@ -0,0 +1,122 @@
+package gkvdb
+
+import (
+    "fmt"
+    "math"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+func TestWriteBatch(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    wb    := db.NewWriteBatch()
+    value := make([]byte, 7)
+    for round := 0; round < 3; round++ {
+        for i := 0; i < 1000; i++ {
+            // 调用方重复使用键值缓冲区，批量写入对象需要保存键值的副本
+            copy(value, fmt.Sprintf("v%d_%04d", round, i))
+            if err := wb.Put([]byte(fmt.Sprintf("k%d", i)), value); err != nil {
+                t.Fatal(err)
+            }
+        }
+        wb.Delete([]byte("k5"))
+        wb.PutTo([]byte("x"), []byte("y"), "t2")
+        if wb.Len() != 1002 {
+            t.Fatalf("batch len: got %d, want 1002", wb.Len())
+        }
+        // 提交之后未同步到数据文件之前从memtable读取
+        db.binlog.smu.Lock()
+        err := wb.Commit()
+        v   := db.Get([]byte("k7"))
+        db.binlog.smu.Unlock()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if string(v) != fmt.Sprintf("v%d_0007", round) {
+            t.Fatalf("round %d: got %q", round, v)
+        }
+        if wb.Len() != 0 {
+            t.Fatalf("batch not reset after commit: %d", wb.Len())
+        }
+    }
+    wb.Put([]byte("k0"), []byte("discarded"))
+    wb.Reset()
+    if err := wb.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if v := db.Get([]byte("k0")); string(v) != "v2_0000" {
+        t.Fatalf("reset batch committed: %q", v)
+    }
+    if db.Get([]byte("k5")) != nil || string(db.GetFrom([]byte("x"), "t2")) != "y" {
+        t.Fatal("unexpected batch result")
+    }
+    db.Close()
+
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if v := db.Get([]byte("k999")); string(v) != "v2_0999" {
+        t.Fatalf("after reopen: got %q", v)
+    }
+    if n := len(db.Items(-1)); n != 999 {
+        t.Fatalf("items after reopen: got %d, want 999", n)
+    }
+}
+
+func TestWriteBatchClosed(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    wb := db.NewWriteBatch()
+    wb.Put([]byte("k"), []byte("v"))
+    db.Close()
+    if err := wb.Commit(); err != ErrClosed {
+        t.Fatalf("commit after close: %v", err)
+    }
+}
+
+func TestWriteBatchMaxSize(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 降低批量写入上限，测试边界
+    old := writeBatchMaxSize
+    defer func() { writeBatchMaxSize = old }()
+    wb    := db.NewWriteBatch()
+    value := make([]byte, 100)
+    wb.Put([]byte("k0"), value)
+    writeBatchMaxSize = int64(len(wb.buffer) - 13)*2 + gCIPHER_OVERHEAD
+    if err := wb.Put([]byte("k1"), value); err != nil {
+        t.Fatalf("batch at the size limit: %v", err)
+    }
+    if err := wb.Put([]byte("k2"), value); err == nil {
+        t.Fatal("batch over the size limit should fail")
+    }
+    if err := wb.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+
+    // 重新打开后从binlog恢复的批量写入数据完整
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if db.Get([]byte("k1")) == nil || db.Get([]byte("k2")) != nil {
+        t.Fatal("unexpected data after reopen")
+    }
+    // 默认上限不能超过binlog事务头中有符号32bit数据长度的范围
+    if old + 13 + 8 > math.MaxInt32 {
+        t.Fatalf("write batch max size %d overflows the binlog transaction head", old)
+    }
+}
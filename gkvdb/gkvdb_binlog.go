@@ -2,16 +2,15 @@ package gkvdb
 
 import (
     "bytes"
+    "context"
+    "encoding/binary"
     "errors"
     "github.com/gogf/gf/g/container/glist"
     "github.com/gogf/gf/g/encoding/gbinary"
-    "github.com/gogf/gf/g/os/gfile"
-    "github.com/gogf/gf/g/os/glog"
     "math"
-    "os"
     "sync"
     "sync/atomic"
-    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
 )
 
 // binlog操作对象
@@ -20,17 +19,39 @@ type BinLog struct {
     smu             sync.RWMutex     // binlog同步互斥锁
     db              *DB              // 所属数据库
     queue           *glist.List      // 同步打包数据队列
-    queuesize       int32            // 队列大小限制(byte)，注意不是binlog文件大小，是未同步的队列数据大小
+    queuesize       int64            // 队列大小限制(byte)，注意不是binlog文件大小，是未同步的队列数据大小
+    gate            sync.RWMutex     // 大事务写入闸门，大事务从写入到同步完成期间阻塞其他事务的写入
+    rgates          map[string]*sync.RWMutex // 数据表的查询闸门，大事务从写入到同步完成期间阻塞其修改的数据表的查询
+    rmu             sync.Mutex       // 查询闸门互斥锁
     syncEvents      chan struct{}    // 数据同步通知事件
     closeEvents     chan struct{}    // 数据库关闭事件
     limitFreeEvents chan struct{}    // 数据长度上限阻塞释放通知事件
+    lmu             sync.Mutex       // 数据长度上限阻塞释放通知事件互斥锁
+    stats           _BinLogStats     // 写入背压统计
+    wmu             sync.Mutex       // 大事务同步失败通知互斥锁
+    waiter          chan error       // 正在等待同步完成的大事务的同步失败通知(同一时间只有一个大事务在提交)
+
+    // 组提交(group commit)，并发的同步提交共用一次fsync
+    gmu             sync.Mutex       // 组提交互斥锁
+    gcond           *sync.Cond       // 组提交完成通知
+    written         int64            // 已写入binlog文件的事务序号(单调递增，不受binlog文件清空影响)
+    synced          int64            // 已fsync的事务序号
+    syncing         bool             // 是否有线程(leader)正在执行fsync
+    ferr            error            // 最近一次失败的fsync的错误
+    fseq            int64            // 最近一次失败的fsync覆盖的事务序号
+    wbytes          int64            // 已写入binlog文件的数据大小(byte，单调递增)
+    sbytes          int64            // 已fsync的binlog数据大小(byte)
 }
 
 // binlog写入项
 type BinLogItem struct {
-    size    int32                        // 数据项大小(byte)
-    txstart int64                        // 事务在binlog文件的开始位置
-    datamap map[string]map[string][]byte // 事务数据(可能有多个)
+    size     int64                          // 数据项大小(byte)
+    txstart  int64                          // 事务在binlog文件的开始位置
+    datamap  map[string]map[string][]byte   // 事务数据(可能有多个)
+    merges   map[string]map[string][][]byte // 事务中的合并操作数
+    resolved map[string]map[string]int      // 合并操作数已合并为datamap中的完整键值时，记录各键名合并的操作数数量
+    large    bool                           // 是否大事务，大事务的数据不加载到内存中，同步时直接从binlog文件读取
+    applied  chan struct{}                  // 大事务同步完成通知(仅提交中的大事务有效)
 }
 
 // 创建binlog对象
@@ -39,169 +60,464 @@ func newBinLog(db *DB) (*BinLog, error) {
         db              : db,
         queue           : glist.New(),
         syncEvents      : make(chan struct{}, math.MaxUint32),
-        closeEvents     : make(chan struct{}, 2),
+        closeEvents     : make(chan struct{}),
         limitFreeEvents : make(chan struct{}, 0),
     }
+    binlog.gcond = sync.NewCond(&binlog.gmu)
     path := db.getBinLogFilePath()
-    if gfile.Exists(path) && (!gfile.IsWritable(path) || !gfile.IsReadable(path)){
+    if !db.isFileAccessible(path) {
         return nil, errors.New("permission denied to binlog file: " + path)
     }
     return binlog, nil
 }
 
-// 关闭binlog
+// 获取数据表的查询闸门，数据表关闭之后保留，重新打开的数据表对象使用同一个闸门
+func (binlog *BinLog) readGate(name string) *sync.RWMutex {
+    binlog.rmu.Lock()
+    defer binlog.rmu.Unlock()
+    if binlog.rgates == nil {
+        binlog.rgates = make(map[string]*sync.RWMutex)
+    }
+    gate, ok := binlog.rgates[name]
+    if !ok {
+        gate = new(sync.RWMutex)
+        binlog.rgates[name] = gate
+    }
+    return gate
+}
+
+// 关闭binlog，通知所有的后台线程退出
 func (binlog *BinLog) close() {
-    binlog.closeEvents <- struct{}{}
+    close(binlog.closeEvents)
 }
 
 // 从binlog文件中恢复未同步数据到memtable中
-// 内部会检测异常数据写入，并忽略异常数据，以便异常数据不会进入到数据库中
-// 这里是数据库初始化操作，如果产生错误，那么输出错误信息到终端
-func (binlog *BinLog) initFromFile() {
-    blbuffer := gfile.GetBinContents(binlog.db.getBinLogFilePath())
-    if len(blbuffer) == 0 {
-        return
+// 内部会检测异常数据写入，并忽略异常数据，以便异常数据不会进入到数据库中；
+// 大事务的数据不加载到memtable，而是在初始化时直接同步到数据文件，同步失败时返回错误
+func (binlog *BinLog) initFromFile() error {
+    if !gvfs.Exists(binlog.db.fs, binlog.db.getBinLogFilePath()) {
+        return nil
+    }
+    blpf, err := binlog.db.getBinlogFilePointer()
+    if err != nil {
+        return err
+    }
+    defer blpf.Close()
+    info, err := blpf.Stat()
+    if err != nil {
+        return err
     }
-    // 在异常数据下，需要花费更多的时间进行数据纠正(字节不断递增计算下一条正确的binlog位置)
-    for i := 0; i < len(blbuffer); {
-        buffer := blbuffer[i : i + 13]
-        blsize := int(gbinary.DecodeToInt32(buffer[1 : 5]))
-        if blsize < 0 ||
-            i + 13 + blsize + 8 > len(blbuffer) ||
-            bytes.Compare(blbuffer[i + 5 : i + 13], blbuffer[i + 13 + blsize : i + 13 + blsize + 8]) != 0 {
-            glog.Errorfln("binlog was corrupt, ignore index: %d\n", i)
+    total   := info.Size()
+    large   := false
+    items   := make([]*BinLogItem, 0)
+    txitems := make(map[int64]*BinLogItem)
+    // 在异常数据下，需要花费更多的时间进行数据纠正(字节不断递增计算下一条正确的binlog位置)，
+    // 连续的损坏数据只报告一次
+    i       := int64(0)
+    corrupt := int64(-1)
+    for ; i + 13 + 8 <= total; {
+        flag, txid, hsize, blsize, ok := readBinLogTxHead(blpf, i, total)
+        if !ok {
+            if corrupt < 0 {
+                corrupt = i
+            }
             i++
-        } else {
+            continue
+        }
+        if corrupt >= 0 {
+            binlog.corrupted(corrupt, i)
+            corrupt = -1
+        }
+        switch flag {
             // 正常数据，判断并同步到memtable中
-            if gbinary.DecodeToInt8(buffer[0 : 1]) == 0 {
-                datamap := binlog.binlogBufferToDataMap(blbuffer[i + 13 : i + 13 + blsize])
-                for n, m := range datamap {
-                    if table, err := binlog.db.Table(n); err == nil {
-                        table.memt.set(m)
-                    } else {
-                        glog.Error(err)
+            case 0:
+                // 大事务(只读模式下无法同步到数据文件，仍然加载到memtable中)
+                if hsize > 13 && !binlog.db.readonly {
+                    item := &BinLogItem{txstart: i, large: true}
+                    items = append(items, item)
+                    large = true
+                    break
+                }
+                buffer := make([]byte, blsize)
+                if _, err := blpf.ReadAt(buffer, i + hsize); err != nil {
+                    return err
+                }
+                // 解密失败说明密钥不可用，不能忽略该事务
+                datamap, merges, err := binlog.binlogBufferToDataMap(buffer)
+                if err != nil {
+                    return err
+                }
+                item := &BinLogItem{size: hsize + blsize, txstart: i, datamap: datamap, merges: merges}
+                items = append(items, item)
+                txitems[i] = item
+            // 合并结果，使用合并后的完整键值替换对应事务中的合并操作数
+            case gBINLOG_TX_RESOLVED:
+                if item, ok := txitems[txid]; ok {
+                    buffer := make([]byte, blsize)
+                    if _, err := blpf.ReadAt(buffer, i + hsize); err != nil {
+                        return err
+                    }
+                    datamap, _, err := binlog.binlogBufferToDataMap(buffer)
+                    if err != nil {
+                        return err
                     }
+                    item.resolve(datamap, nil)
                 }
-                binlog.queuesize += int32(blsize) + 13
-                binlog.queue.PushFront(BinLogItem{int32(blsize) + 13, int64(i), datamap})
-            }
-            i += 13 + blsize + 8
         }
+        i += hsize + blsize + 8
+    }
+    if corrupt >= 0 {
+        binlog.corrupted(corrupt, total)
+    } else if i < total {
+        binlog.corrupted(i, total)
+    }
+    for _, item := range items {
+        if !item.large {
+            binlog.setMemTable(item.datamap, item.merges)
+        }
+        binlog.queuesize += item.size
+        binlog.queue.PushFront(*item)
     }
 
+    // 存在大事务时立即同步，保证数据库打开之后大事务的数据可见
+    if large {
+        return binlog.sync()
+    }
     // 判断继续执行同步
     if binlog.queue.Len() > 0 {
         binlog.syncEvents <- struct{}{}
     }
+    return nil
+}
+
+// 报告binlog文件中[start, end)位置的损坏数据
+func (binlog *BinLog) corrupted(start, end int64) {
+    binlog.db.logger().Errorf("binlog was corrupt, ignore %d bytes at index: %d", end - start, start)
+    binlog.db.emit(Event{Type: EventCorruption, File: "binlog", Offset: start, Size: end - start})
+}
+
+// 读取并校验binlog事务头，返回同步标识、事务编号、事务头大小及数据长度，事务不完整时ok为false；
+// 数据长度为0xFFFFFFFF时表示大事务，事务头之后的64bit为实际的数据长度
+func readBinLogTxHead(blpf gvfs.File, start int64, total int64) (flag int, txid int64, hsize int64, blsize int64, ok bool) {
+    buffer := make([]byte, 13 + 8)
+    if _, err := blpf.ReadAt(buffer, start); err != nil {
+        return
+    }
+    hsize  = 13
+    blsize = int64(gbinary.DecodeToInt32(buffer[1 : 5]))
+    if blsize == -1 {
+        hsize  = 13 + 8
+        blsize = gbinary.DecodeToInt64(buffer[13 : 21])
+    }
+    if blsize < 0 || start + hsize + blsize + 8 > total {
+        return
+    }
+    tail := make([]byte, 8)
+    if _, err := blpf.ReadAt(tail, start + hsize + blsize); err != nil {
+        return
+    }
+    if bytes.Compare(buffer[5 : 13], tail) != 0 {
+        return
+    }
+    return int(buffer[0]), gbinary.DecodeToInt64(buffer[5 : 13]), hsize, blsize, true
+}
+
+// 将事务数据写入到对应数据表的memtable中
+func (binlog *BinLog) setMemTable(datamap map[string]map[string][]byte, merges map[string]map[string][][]byte) error {
+    for n, m := range datamap {
+        if table, err := binlog.db.table(n); err == nil {
+            table.memt.set(m)
+        } else {
+            binlog.db.logger().Errorf("memtable write error: %v", err)
+            return err
+        }
+    }
+    for n, m := range merges {
+        if table, err := binlog.db.table(n); err == nil {
+            table.memt.merge(m)
+        } else {
+            binlog.db.logger().Errorf("memtable write error: %v", err)
+            return err
+        }
+    }
+    return nil
 }
 
-// 将二进制数据转换为事务对象
-func (binlog *BinLog) binlogBufferToDataMap(buffer []byte) map[string]map[string][]byte {
+// 将二进制数据转换为事务对象，返回事务数据及合并操作数，加密的键值解密失败时返回错误
+func (binlog *BinLog) binlogBufferToDataMap(buffer []byte) (map[string]map[string][]byte, map[string]map[string][][]byte, error) {
+    format  := binlog.db.format
+    head    := format.binlogHeadSize
     datamap := make(map[string]map[string][]byte)
+    merges  := make(map[string]map[string][][]byte)
     for i := 0; i < len(buffer); {
-        bits  := gbinary.DecodeBytesToBits(buffer[i : i + 5])
-        nlen  := int(gbinary.DecodeBits(bits[ 0 :  8]))
-        klen  := int(gbinary.DecodeBits(bits[ 8 : 16]))
-        vlen  := int(gbinary.DecodeBits(bits[16 : 40]))
-        name  := buffer[i + 5 : i + 5 + nlen]
-        key   := buffer[i + 5 + nlen : i + 5 + nlen + klen]
-        value := buffer[i + 5 + nlen + klen : i + 5 + nlen + klen + vlen]
+        flags, nlen, klen, vlen := format.decodeBinLogHead(buffer[i : i + head])
+        name  := buffer[i + head : i + head + nlen]
+        key   := buffer[i + head + nlen : i + head + nlen + klen]
+        value := buffer[i + head + nlen + klen : i + head + nlen + klen + vlen]
+        i += head + nlen + klen + vlen
+        value, err := format.open(key, value, flags & gBINLOG_FLAG_ENCRYPTED > 0)
+        if err != nil {
+            return nil, nil, err
+        }
+        // 合并操作数按照写入顺序保存
+        if flags & gBINLOG_FLAG_MERGE > 0 {
+            if _, ok := merges[string(name)]; !ok {
+                merges[string(name)] = make(map[string][][]byte)
+            }
+            merges[string(name)][string(key)] = append(merges[string(name)][string(key)], value)
+            continue
+        }
         if _, ok := datamap[string(name)]; !ok {
             datamap[string(name)] = make(map[string][]byte)
         }
+        // 键值长度为0表示删除，与事务中的删除操作保持一致使用nil表示
+        if vlen == 0 {
+            value = nil
+        }
         datamap[string(name)][string(key)] = value
-        i += 5 + nlen + klen + vlen
     }
-    return datamap
+    if len(merges) == 0 {
+        merges = nil
+    }
+    return datamap, merges, nil
 }
 
-// 是否binlog长度达到上限
-func (binlog *BinLog) reachLengthLimit() bool {
-    return atomic.LoadInt32(&binlog.queuesize) >= gBINLOG_MAX_SIZE
+// 使用合并后的完整键值替换事务中的合并操作数，counts记录各键名合并的操作数数量
+func (item *BinLogItem) resolve(datamap map[string]map[string][]byte, counts map[string]map[string]int) {
+    for n, m := range datamap {
+        if _, ok := item.datamap[n]; !ok {
+            item.datamap[n] = make(map[string][]byte)
+        }
+        for k, v := range m {
+            item.datamap[n][k] = v
+            if operands, ok := item.merges[n]; ok {
+                delete(operands, k)
+                if len(operands) == 0 {
+                    delete(item.merges, n)
+                }
+            }
+        }
+    }
+    if len(item.merges) == 0 {
+        item.merges = nil
+    }
+    item.resolved = counts
 }
 
 // 添加binlog到文件，支持批量添加
 // 返回写入的文件开始位置，以及是否有错误
 // 第二个参数表示是否强制写入到磁盘
-func (binlog *BinLog) writeByTx(tx *Transaction, sync...bool) error {
-    if binlog.reachLengthLimit() {
-        <- binlog.limitFreeEvents
-    }
-    // 内容序列
-    buffer := make([]byte, 0)
-    // 事务开始
-    buffer  = append(buffer, gbinary.EncodeInt8(0)...)
-    buffer  = append(buffer, gbinary.EncodeInt32(0)...)
-    buffer  = append(buffer, gbinary.EncodeInt64(tx.id)...)
-    // 数据列表
+func (binlog *BinLog) writeByTx(ctx context.Context, tx *Transaction, sync...bool) error {
+    // 预先计算binlog数据项大小，一次性分配内容序列
+    format := binlog.db.format
     blsize := 0
-    for ns, m := range tx.tables {
-        for ks, v := range m {
-            n      := []byte(ns)
-            k      := []byte(ks)
-            bits   := make([]gbinary.Bit, 0)
-            bits    = gbinary.EncodeBits(bits, len(n),   8)
-            bits    = gbinary.EncodeBits(bits, len(k),   8)
-            bits    = gbinary.EncodeBits(bits, len(v),  24)
-            buffer  = append(buffer, gbinary.EncodeBitsToBytes(bits)...)
-            buffer  = append(buffer, n...)
-            buffer  = append(buffer, k...)
-            buffer  = append(buffer, v...)
-            blsize += 5 + len(n) + len(k) + len(v)
-        }
-    }
-    // 事务结束
-    buffer  = append(buffer, gbinary.EncodeInt64(tx.id)...)
-    // 修改数据长度
-    copy(buffer[1:], gbinary.EncodeInt32(int32(blsize)))
+    for n, m := range tx.tables {
+        for k, v := range m {
+            blsize += format.binlogHeadSize + len(n) + len(k) + len(v)
+        }
+    }
+    for n, m := range tx.merges {
+        for k, operands := range m {
+            for _, v := range operands {
+                blsize += format.binlogHeadSize + len(n) + len(k) + len(v)
+            }
+        }
+    }
+    buffer := beginBinLogTx(make([]byte, 0, 13 + blsize + 8), tx.id)
+    err    := error(nil)
+    // 数据列表
+    for n, m := range tx.tables {
+        for k, v := range m {
+            if buffer, err = appendBinLogItem(format, buffer, 0, n, k, v); err != nil {
+                return err
+            }
+        }
+    }
+    // 合并操作数列表
+    for n, m := range tx.merges {
+        for k, operands := range m {
+            for _, v := range operands {
+                if buffer, err = appendBinLogItem(format, buffer, gBINLOG_FLAG_MERGE, n, k, v); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return binlog.write(ctx, endBinLogTx(buffer, tx.id), tx.tables, tx.merges, tx.checkReads, sync...)
+}
+
+// 将binlog数据项追加到buffer末尾，开启加密时键值加密之后写入
+func appendBinLogItem(format *_Format, buffer []byte, flags int, name string, key string, value []byte) ([]byte, error) {
+    value, encrypted, err := format.seal([]byte(key), value)
+    if err != nil {
+        return buffer, err
+    }
+    if encrypted {
+        flags |= gBINLOG_FLAG_ENCRYPTED
+    }
+    buffer = format.appendBinLogHead(buffer, flags, len(name), len(key), len(value))
+    buffer = append(buffer, name...)
+    buffer = append(buffer, key...)
+    buffer = append(buffer, value...)
+    return buffer, nil
+}
+
+// binlog事务开始：[是否同步(8bit) 数据长度(32bit) 事务编号(64bit)]，数据长度在事务结束时回写
+func beginBinLogTx(buffer []byte, txid int64) []byte {
+    buffer = append(buffer, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+    binary.LittleEndian.PutUint64(buffer[len(buffer) - 8 : ], uint64(txid))
+    return buffer
+}
+
+// binlog事务结束：[事务编号(64bit)]，并回写数据长度及事务编号，buffer必须以beginBinLogTx开始
+func endBinLogTx(buffer []byte, txid int64) []byte {
+    binary.LittleEndian.PutUint32(buffer[1 :  5], uint32(len(buffer) - 13))
+    binary.LittleEndian.PutUint64(buffer[5 : 13], uint64(txid))
+    buffer = append(buffer, 0, 0, 0, 0, 0, 0, 0, 0)
+    binary.LittleEndian.PutUint64(buffer[len(buffer) - 8 : ], uint64(txid))
+    return buffer
+}
+
+// 将打包好的事务写入binlog文件，并写入memtable及添加到磁盘化队列，datamap为事务数据(表名->键值对)，
+// check不为nil时在binlog写锁内执行检查(此时其他事务无法写入)，检查失败时不写入；
+// 最后的参数表示是否强制写入到磁盘，不指定时按照数据库的持久化策略执行，并发的同步写入通过组提交共用一次fsync；
+// 写入binlog文件之前的等待(队列长度上限、大事务同步)响应ctx的取消及超时，写入binlog文件之后不再响应
+func (binlog *BinLog) write(ctx context.Context, buffer []byte, datamap map[string]map[string][]byte, merges map[string]map[string][][]byte, check func() error, sync...bool) error {
+    if err := binlog.backpressure(ctx); err != nil {
+        return err
+    }
+    // 大事务写入期间等待其同步完成
+    if err := lockContext(ctx, binlog.gate.RLock, binlog.gate.RUnlock); err != nil {
+        return err
+    }
+    seq, err := binlog.append(buffer, datamap, merges, check)
+    binlog.gate.RUnlock()
+    if err != nil {
+        return err
+    }
+    if binlog.needSync(sync...) {
+        return binlog.groupSync(seq)
+    }
+    return nil
+}
+
+// 判断事务写入后是否需要fsync，事务指定的参数优先于数据库的持久化策略
+func (binlog *BinLog) needSync(sync...bool) bool {
+    if len(sync) > 0 {
+        return sync[0]
+    }
+    options := binlog.db.options
+    switch options.Sync {
+        case SyncAlways:
+            return true
+        case SyncPeriodic:
+            unsynced := atomic.LoadInt64(&binlog.wbytes) - atomic.LoadInt64(&binlog.sbytes)
+            return options.SyncBytes > 0 && unsynced >= int64(options.SyncBytes)
+    }
+    return false
+}
+
+// 将事务追加到binlog文件末尾，返回该事务的写入序号
+func (binlog *BinLog) append(buffer []byte, datamap map[string]map[string][]byte, merges map[string]map[string][][]byte, check func() error) (int64, error) {
+    blsize := len(buffer) - 13 - 8
 
     // 从指针池获取
     blpf, err := binlog.db.getBinlogFilePointer()
     if err != nil {
-        return err
+        return 0, err
     }
     defer blpf.Close()
 
     binlog.Lock()
     defer binlog.Unlock()
 
+    if check != nil {
+        if err := check(); err != nil {
+            return 0, err
+        }
+    }
+
     // 写到文件末尾
     start, err := blpf.Seek(0, 2)
     if err != nil {
-        return err
+        return 0, err
     }
 
     // 执行数据写入
     if _, err := blpf.WriteAt(buffer, start); err != nil {
-        return err
-    }
-    // 是否执行文件sync
-    if len(sync) > 0 && sync[0] {
-        if err := blpf.Sync(); err != nil {
-            return err
-        }
+        return 0, err
     }
 
     // 再写内存表(分别写入到对应表的memtable中)
-    for n, m := range tx.tables {
-        if table, err := tx.db.Table(n); err == nil {
-            table.memt.set(m)
-        } else {
-            os.Truncate(binlog.db.getBinLogFilePath(), start)
-            return err
-        }
+    if err := binlog.setMemTable(datamap, merges); err != nil {
+        binlog.db.fs.Truncate(binlog.db.getBinLogFilePath(), start)
+        return 0, err
     }
 
     // 添加到磁盘化队列
-    binlog.queue.PushFront(BinLogItem{int32(blsize) + 13, start, tx.tables})
+    binlog.queue.PushFront(BinLogItem{
+        size    : int64(blsize) + 13,
+        txstart : start,
+        datamap : datamap,
+        merges  : merges,
+    })
     // 增加数据队列长度记录
-    atomic.AddInt32(&binlog.queuesize, int32(blsize) + 13)
+    atomic.AddInt64(&binlog.queuesize, int64(blsize) + 13)
 
     // 发送同步通知事件
     binlog.syncEvents <- struct{}{}
+    atomic.AddInt64(&binlog.wbytes, int64(len(buffer)))
+    return atomic.AddInt64(&binlog.written, 1), nil
+}
+
+// 组提交，等待写入序号seq之前(包含)的事务全部fsync到磁盘；
+// 没有线程在执行fsync时当前线程成为leader，对当前已写入的所有事务执行一次fsync，其他线程等待leader完成，
+// 因此并发的同步提交只需要一次fsync；leader的fsync失败时，该次fsync覆盖的事务全部返回同样的错误，不再重试
+func (binlog *BinLog) groupSync(seq int64) error {
+    binlog.gmu.Lock()
+    defer binlog.gmu.Unlock()
+    for binlog.synced < seq {
+        if binlog.syncing {
+            binlog.gcond.Wait()
+            continue
+        }
+        // 失败的fsync已覆盖该事务时返回同样的错误(fsync失败之后操作系统可能已丢弃未写入的缓存，重试成功也不可信)
+        if binlog.fseq >= seq {
+            return binlog.ferr
+        }
+        binlog.syncing = true
+        // 序号在文件写入完成之后才递增，因此target之前的事务都已经写入到文件
+        target := atomic.LoadInt64(&binlog.written)
+        tbytes := atomic.LoadInt64(&binlog.wbytes)
+        binlog.gmu.Unlock()
+        err := binlog.fsync()
+        binlog.gmu.Lock()
+        binlog.syncing = false
+        if err == nil && target > binlog.synced {
+            binlog.synced = target
+            atomic.StoreInt64(&binlog.sbytes, tbytes)
+        }
+        if err != nil {
+            binlog.ferr, binlog.fseq = err, target
+        }
+        binlog.gcond.Broadcast()
+        if err != nil {
+            return err
+        }
+    }
     return nil
 }
 
+// 将binlog文件fsync到磁盘
+func (binlog *BinLog) fsync() error {
+    blpf, err := binlog.db.getBinlogFilePointer()
+    if err != nil {
+        return err
+    }
+    defer blpf.Close()
+    return blpf.Sync()
+}
+
 // 写入磁盘，标识事务已经同步，在对应位置只写入1个字节
 func (binlog *BinLog) markSynced(start int64) error {
     blpf, err := binlog.db.getBinlogFilePointer()
@@ -219,85 +535,226 @@ func (binlog *BinLog) markSynced(start int64) error {
     return nil
 }
 
-// 执行binlog同步
-func (binlog *BinLog) sync() {
-    if binlog.queue.Len() == 0 {
-        return
+// 执行binlog同步，同步失败时将数据项重新推入队列并返回错误，由调用方决定是否重试；
+// 数据文件fsync到磁盘之后才标识binlog事务已同步，保证已标识同步的事务确实已经写入磁盘
+func (binlog *BinLog) sync() error {
+    // 只读模式下binlog数据仅保存在memtable中，不同步到数据文件
+    if binlog.db.readonly || binlog.queue.Len() == 0 {
+        return nil
     }
     // binlog互斥锁保证同时只有一个线程在运行
     binlog.smu.Lock()
     defer binlog.smu.Unlock()
+
+    items  := make([]BinLogItem, 0)
+    names  := make(map[string]struct{})
+    reterr := error(nil)
     for {
-        if v := binlog.queue.PopBack(); v != nil {
-            wg   := sync.WaitGroup{}
-            item := v.(BinLogItem)
-            done := int32(0)
-            // 一般不会为空
-            if item.datamap == nil {
-                continue
+        v := binlog.queue.PopBack()
+        if v == nil {
+            break
+        }
+        item := v.(BinLogItem)
+        // 大事务直接从binlog文件流式写入数据文件
+        if item.large {
+            tables, err := binlog.applyStream(item.txstart)
+            if err != nil {
+                reterr = err
+                binlog.queue.PushBack(item)
+                break
             }
-            for n, m := range item.datamap {
-                wg.Add(1)
-                // 不同的数据表异步执行数据保存
-                name := n
-                data := m
-                go func() {
-                    defer wg.Done()
-                    // 获取数据表对象
-                    table, err := binlog.db.Table(name)
-                    if err != nil {
-                        atomic.StoreInt32(&done, -1)
-                        glog.Error(err)
-                        return
-                    }
-                    for k, v := range data {
-                        if len(v) == 0 {
-                            // 删除操作
-                            if err := table.remove([]byte(k)); err != nil {
-                                atomic.StoreInt32(&done, -1)
-                                glog.Error(err)
-                                return
-                            }
-                        } else {
-                            // 写入操作(新增/修改)
-                            if err := table.set([]byte(k), v); err != nil {
-                                atomic.StoreInt32(&done, -1)
-                                glog.Error(err)
-                                return
-                            }
-                        }
-                    }
-                }()
+            items = append(items, item)
+            for n, _ := range tables {
+                names[n] = struct{}{}
             }
-            wg.Wait()
-            // 同步失败，重新推入队列
-            if done < 0 {
+            continue
+        }
+        // 一般不会为空
+        if item.datamap == nil {
+            continue
+        }
+        // 合并操作数需要先与数据文件中的键值合并为完整键值(事务的合并操作数集合不为nil，需要判断是否为空)
+        if len(item.merges) > 0 {
+            if reterr = binlog.resolve(&item); reterr != nil {
                 binlog.queue.PushBack(item)
-                glog.Error("data sync failed, retry later")
-                time.Sleep(time.Second)
-            } else {
-                binlog.markSynced(item.txstart)
-                atomic.AddInt32(&binlog.queuesize, -item.size)
-            }
-        } else {
-            // 将binlog文件锁起来，
-            // 防止在文件大小矫正过程中内容发生改变
-            binlog.Lock()
-            // 必须要保证所有binlog已经同步完成才执行清空操作
-            if atomic.LoadInt32(&binlog.queuesize) <= 0 && binlog.queue.Len() == 0 {
-                // 清空数据库所有的表的缓存，由于该操作在binlog写锁内部执行，
-                // binlog写入完成之后才能写memtable，因此这里不存在memtable在清理的过程中写入数据的问题
-                binlog.db.tables.Iterator(func(k string, v interface{}) bool{
-                    v.(*Table).memt.clear()
-                    return true
-                })
-                atomic.StoreInt32(&binlog.queuesize, 0)
-                os.Truncate(binlog.db.getBinLogFilePath(), 0)
+                break
             }
-            binlog.Unlock()
-            close(binlog.limitFreeEvents)
-            binlog.limitFreeEvents = make(chan struct{}, 0)
+        }
+        // 同步失败，重新推入队列
+        if reterr = binlog.apply(item.datamap, item.resolved); reterr != nil {
+            binlog.queue.PushBack(item)
             break
         }
+        items = append(items, item)
+        for n, _ := range item.datamap {
+            names[n] = struct{}{}
+        }
     }
-}
\ No newline at end of file
+    if len(items) > 0 {
+        // 数据文件fsync失败时，按照原有顺序重新推入队列，下一次同步时重新写入
+        if err := binlog.fsyncTables(names); err != nil {
+            for i := len(items) - 1; i >= 0; i-- {
+                binlog.queue.PushBack(items[i])
+            }
+            binlog.syncFailed(err)
+            return err
+        }
+        for _, item := range items {
+            binlog.markSynced(item.txstart)
+            atomic.AddInt64(&binlog.queuesize, -item.size)
+        }
+    }
+    // 通知提交中的大事务同步完成，需要在memtable清空之后通知，防止大事务之前的旧数据覆盖大事务的数据
+    defer func() {
+        for _, item := range items {
+            if item.applied != nil {
+                close(item.applied)
+            }
+        }
+    }()
+    if reterr != nil {
+        binlog.syncFailed(reterr)
+        return reterr
+    }
+
+    // 将binlog文件锁起来，
+    // 防止在文件大小矫正过程中内容发生改变
+    binlog.Lock()
+    // 必须要保证所有binlog已经同步完成才执行清空操作
+    if atomic.LoadInt64(&binlog.queuesize) <= 0 && binlog.queue.Len() == 0 {
+        // 清空数据库所有的表的缓存，由于该操作在binlog写锁内部执行，
+        // binlog写入完成之后才能写memtable，因此这里不存在memtable在清理的过程中写入数据的问题
+        binlog.db.tables.Iterator(func(k string, v interface{}) bool{
+            v.(*Table).memt.clear()
+            return true
+        })
+        atomic.StoreInt64(&binlog.queuesize, 0)
+        binlog.db.fs.Truncate(binlog.db.getBinLogFilePath(), 0)
+    }
+    binlog.Unlock()
+    binlog.lmu.Lock()
+    close(binlog.limitFreeEvents)
+    binlog.limitFreeEvents = make(chan struct{}, 0)
+    binlog.lmu.Unlock()
+    return nil
+}
+
+// 报告数据同步失败
+func (binlog *BinLog) syncFailed(err error) {
+    binlog.db.logger().Errorf("data sync failed, retry later: %v", err)
+    binlog.db.emit(Event{Type: EventSyncRetry, Err: err})
+    // 通知正在等待同步完成的大事务，失败通知未被接收时丢弃之后的通知
+    binlog.wmu.Lock()
+    if binlog.waiter != nil {
+        select {
+            case binlog.waiter <- err:
+            default:
+        }
+    }
+    binlog.wmu.Unlock()
+}
+
+// 将事务中的合并操作数与数据文件中的键值合并为完整键值，合并结果写入binlog并fsync之后再替换事务中的合并操作数，
+// 由于合并操作不是幂等的，异常重启后通过binlog中的合并结果恢复该事务，避免合并操作数被重复合并
+func (binlog *BinLog) resolve(item *BinLogItem) error {
+    format  := binlog.db.format
+    datamap := make(map[string]map[string][]byte)
+    counts  := make(map[string]map[string]int)
+    buffer  := beginBinLogTx(nil, item.txstart)
+    for n, m := range item.merges {
+        table, err := binlog.db.table(n)
+        if err != nil {
+            return err
+        }
+        datamap[n] = make(map[string][]byte)
+        counts[n]  = make(map[string]int)
+        for k, operands := range m {
+            value, err := table.fold([]byte(k), table.get([]byte(k)), operands)
+            if err != nil {
+                return err
+            }
+            datamap[n][k] = value
+            counts[n][k]  = len(operands)
+            if buffer, err = appendBinLogItem(format, buffer, 0, n, k, value); err != nil {
+                return err
+            }
+        }
+    }
+    buffer    = endBinLogTx(buffer, item.txstart)
+    buffer[0] = gBINLOG_TX_RESOLVED
+
+    blpf, err := binlog.db.getBinlogFilePointer()
+    if err != nil {
+        return err
+    }
+    defer blpf.Close()
+    binlog.Lock()
+    start, err := blpf.Seek(0, 2)
+    if err == nil {
+        _, err = blpf.WriteAt(buffer, start)
+    }
+    binlog.Unlock()
+    if err != nil {
+        return err
+    }
+    if err := blpf.Sync(); err != nil {
+        return err
+    }
+    item.resolve(datamap, counts)
+    return nil
+}
+
+// 将事务数据写入到对应数据表的数据文件中，不同的数据表异步执行数据保存，
+// resolved中的键名为合并操作数的合并结果，写入数据文件的同时从memtable中移除已合并的操作数
+func (binlog *BinLog) apply(datamap map[string]map[string][]byte, resolved map[string]map[string]int) error {
+    wg     := sync.WaitGroup{}
+    emu    := sync.Mutex{}
+    reterr := error(nil)
+    for n, m := range datamap {
+        wg.Add(1)
+        name := n
+        data := m
+        go func() {
+            defer wg.Done()
+            // 获取数据表对象
+            table, err := binlog.db.table(name)
+            if err == nil {
+                for k, v := range data {
+                    if count, ok := resolved[name][k]; ok {
+                        err = table.setMerged([]byte(k), v, count)
+                    } else if len(v) == 0 {
+                        // 删除操作
+                        err = table.remove([]byte(k))
+                    } else {
+                        // 写入操作(新增/修改)
+                        err = table.set([]byte(k), v)
+                    }
+                    if err != nil {
+                        break
+                    }
+                }
+            }
+            if err != nil {
+                emu.Lock()
+                reterr = err
+                emu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    return reterr
+}
+
+// 将指定数据表的数据文件fsync到磁盘
+func (binlog *BinLog) fsyncTables(names map[string]struct{}) error {
+    for name, _ := range names {
+        table, err := binlog.db.table(name)
+        if err != nil {
+            return err
+        }
+        if err := table.fsync(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,262 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/gob"
+    "encoding/json"
+    "errors"
+    "reflect"
+    "strconv"
+)
+
+const (
+    gCODEC_VERSION_SIZE  = 4    // 键值前缀的结构版本号大小(byte)
+    gCODEC_UPGRADE_BATCH = 1000 // 遍历时迁移后的数据写回的批量大小
+)
+
+// 键值编解码接口，用于结构化数据与键值之间的转换，Marshal的结果不能为空(空键值表示删除)
+type Codec interface {
+    Marshal(v interface{}) ([]byte, error)
+    Unmarshal(data []byte, v interface{}) error
+}
+
+// 使用函数实现的编解码(例如protobuf、msgpack等第三方编解码库)
+type CodecFuncs struct {
+    MarshalFunc   func(v interface{}) ([]byte, error)
+    UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+// JSON编解码(encoding/json)
+type jsonCodec struct {}
+
+// gob编解码(encoding/gob)，每一条键值独立编码，包含完整的类型信息
+type gobCodec struct {}
+
+var (
+    // 内置的JSON编解码
+    JSONCodec Codec = jsonCodec{}
+    // 内置的gob编解码
+    GobCodec  Codec = gobCodec{}
+)
+
+// 结构版本迁移函数，将version版本写入的编码数据转换为当前版本的编码数据
+type CodecMigrateFunc func(version uint32, data []byte) ([]byte, error)
+
+// 结构化数据表选项，通过NewTyped的可选参数传递
+type TypedOptions struct {
+    // 当前的结构版本号，大于0时键值以4字节的版本号(大端序)开头，读取到旧版本的数据时通过Migrate转换；
+    // 为0时不保存版本号，不能与保存了版本号的数据表混用
+    Version uint32
+    // 结构版本迁移函数，读取到版本号小于Version的数据时调用，为nil时读取旧版本数据返回错误
+    Migrate CodecMigrateFunc
+    // 是否将迁移后的数据写回数据表(原子操作，数据在读取之后被修改时不写回)，默认只在读取时转换；
+    // 写回失败不影响读取的结果，只输出警告日志
+    Upgrade bool
+}
+
+// 结构化数据表，通过Codec将Go对象保存到数据表，或者从数据表读取到Go对象
+type TypedTable struct {
+    table   *Table       // 数据表
+    codec   Codec        // 编解码
+    options TypedOptions // 选项
+}
+
+// 创建结构化数据表，options为可选的结构版本选项
+func NewTyped(table *Table, codec Codec, options...TypedOptions) *TypedTable {
+    typed := &TypedTable {
+        table : table,
+        codec : codec,
+    }
+    if len(options) > 0 {
+        typed.options = options[0]
+    }
+    return typed
+}
+
+// 获取底层的数据表对象
+func (typed *TypedTable) Table() *Table {
+    return typed.table
+}
+
+// 编码后保存数据
+func (typed *TypedTable) Put(key []byte, v interface{}) error {
+    return typed.PutCtx(context.Background(), key, v)
+}
+
+// 编码后保存数据，ctx取消或者超时时返回ctx的错误
+func (typed *TypedTable) PutCtx(ctx context.Context, key []byte, v interface{}) error {
+    value, err := typed.encode(v)
+    if err != nil {
+        return err
+    }
+    return typed.table.SetCtx(ctx, key, value)
+}
+
+// 查询数据并解码到v(必须为指针)，返回键名是否存在，不存在时v不被修改
+func (typed *TypedTable) Get(key []byte, v interface{}) (bool, error) {
+    return typed.GetCtx(context.Background(), key, v)
+}
+
+// 查询数据并解码到v(必须为指针)，返回键名是否存在，ctx取消或者超时时返回ctx的错误
+func (typed *TypedTable) GetCtx(ctx context.Context, key []byte, v interface{}) (bool, error) {
+    value, err := typed.table.GetCtx(ctx, key)
+    if err != nil || value == nil {
+        return false, err
+    }
+    upgraded, err := typed.decode(value, v)
+    if err != nil {
+        return false, err
+    }
+    if upgraded != nil {
+        typed.upgrade(ctx, key, value, upgraded)
+    }
+    return true, nil
+}
+
+// 删除数据
+func (typed *TypedTable) Remove(key []byte) error {
+    return typed.table.Remove(key)
+}
+
+// 遍历数据表，每一条数据解码到v(必须为指针，解码前重置为零值)之后调用f，f返回false时停止遍历
+func (typed *TypedTable) Iterate(v interface{}, f func(key []byte) bool) error {
+    return typed.IterateCtx(context.Background(), v, f)
+}
+
+// 遍历数据表，f返回false时停止遍历，解码失败或者ctx取消、超时时停止遍历并返回对应的错误
+func (typed *TypedTable) IterateCtx(ctx context.Context, v interface{}, f func(key []byte) bool) error {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Ptr || rv.IsNil() {
+        return errors.New("typed iteration requires a non-nil pointer")
+    }
+    if typed.table.closed.Val() {
+        return ErrClosed
+    }
+    // 遍历磁盘化数据时持有数据表的锁，迁移后的数据暂存之后在遍历暂停时分批写回
+    var derr error
+    upgrades := make([][3][]byte, 0)
+    flush    := func() {
+        for _, item := range upgrades {
+            typed.upgrade(ctx, item[0], item[1], item[2])
+        }
+        upgrades = upgrades[ : 0]
+    }
+    var pause func() error
+    if typed.options.Upgrade && !typed.table.db.readonly {
+        pause = func() error {
+            if len(upgrades) >= gCODEC_UPGRADE_BATCH {
+                flush()
+            }
+            return nil
+        }
+    }
+    err := typed.table.scanPaused(ctx, func(key, value []byte) bool {
+        rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+        upgraded, err := typed.decode(value, v)
+        if err != nil {
+            derr = err
+            return false
+        }
+        if upgraded != nil {
+            upgrades = append(upgrades, [3][]byte{key, value, upgraded})
+        }
+        return f(key)
+    }, pause)
+    flush()
+    if err == nil {
+        err = derr
+    }
+    return err
+}
+
+// 将对象编码为键值，需要时添加结构版本号前缀
+func (typed *TypedTable) encode(v interface{}) ([]byte, error) {
+    data, err := typed.codec.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    if typed.options.Version == 0 {
+        if len(data) == 0 {
+            return nil, errors.New("codec produced an empty value")
+        }
+        return data, nil
+    }
+    value := make([]byte, gCODEC_VERSION_SIZE, gCODEC_VERSION_SIZE + len(data))
+    binary.BigEndian.PutUint32(value, typed.options.Version)
+    return append(value, data...), nil
+}
+
+// 将键值解码到对象，旧版本的数据先迁移到当前版本，开启Upgrade时返回需要写回的键值
+func (typed *TypedTable) decode(value []byte, v interface{}) ([]byte, error) {
+    if typed.options.Version == 0 {
+        return nil, typed.codec.Unmarshal(value, v)
+    }
+    if len(value) < gCODEC_VERSION_SIZE {
+        return nil, errors.New("invalid typed value: missing schema version")
+    }
+    version := binary.BigEndian.Uint32(value)
+    data    := value[gCODEC_VERSION_SIZE : ]
+    if version > typed.options.Version {
+        return nil, errors.New("unsupported schema version: " + strconv.FormatUint(uint64(version), 10))
+    }
+    if version < typed.options.Version {
+        if typed.options.Migrate == nil {
+            return nil, errors.New("no migration for schema version: " + strconv.FormatUint(uint64(version), 10))
+        }
+        migrated, err := typed.options.Migrate(version, data)
+        if err != nil {
+            return nil, err
+        }
+        if err := typed.codec.Unmarshal(migrated, v); err != nil {
+            return nil, err
+        }
+        if !typed.options.Upgrade || typed.table.db.readonly {
+            return nil, nil
+        }
+        upgraded := make([]byte, gCODEC_VERSION_SIZE, gCODEC_VERSION_SIZE + len(migrated))
+        binary.BigEndian.PutUint32(upgraded, typed.options.Version)
+        return append(upgraded, migrated...), nil
+    }
+    return nil, typed.codec.Unmarshal(data, v)
+}
+
+// 将迁移后的键值写回数据表(尽力而为)，数据在读取之后被修改时不写回，写回失败时输出警告日志
+func (typed *TypedTable) upgrade(ctx context.Context, key, old, value []byte) {
+    err := typed.table.atomicCtx(ctx, func(tx *Transaction) error {
+        _, err := tx.CompareAndSwap(key, old, value)
+        return err
+    })
+    if err != nil {
+        typed.table.db.logger().Warnf("failed upgrading typed value of key %q in table %s: %s", key, typed.table.name, err.Error())
+    }
+}
+
+func (c CodecFuncs) Marshal(v interface{}) ([]byte, error) {
+    return c.MarshalFunc(v)
+}
+
+func (c CodecFuncs) Unmarshal(data []byte, v interface{}) error {
+    return c.UnmarshalFunc(data, v)
+}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+    return json.Unmarshal(data, v)
+}
+
+func (c gobCodec) Marshal(v interface{}) ([]byte, error) {
+    buffer := bytes.NewBuffer(nil)
+    if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+func (c gobCodec) Unmarshal(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,199 @@
+package gkvdb
+
+import (
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+type codecTestUser struct {
+    Name  string
+    Email string
+}
+
+func TestTypedCodecs(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("u")
+    upper    := CodecFuncs {
+        MarshalFunc   : func(v interface{}) ([]byte, error) {
+            return []byte(strings.ToUpper(v.(*codecTestUser).Name)), nil
+        },
+        UnmarshalFunc : func(data []byte, v interface{}) error {
+            v.(*codecTestUser).Name = string(data)
+            return nil
+        },
+    }
+    for _, codec := range []Codec{JSONCodec, GobCodec, upper} {
+        typed := NewTyped(table, codec)
+        if err := typed.Put([]byte("a"), &codecTestUser{"alice", "alice@example.com"}); err != nil {
+            t.Fatal(err)
+        }
+        var user codecTestUser
+        if ok, err := typed.Get([]byte("a"), &user); !ok || err != nil {
+            t.Fatalf("get: %v %v", ok, err)
+        }
+        if user.Name != "alice" && user.Name != "ALICE" {
+            t.Fatalf("got %+v", user)
+        }
+        if ok, err := typed.Get([]byte("missing"), &user); ok || err != nil {
+            t.Fatalf("get missing key: %v %v", ok, err)
+        }
+        typed.Remove([]byte("a"))
+        if ok, _ := typed.Get([]byte("a"), &user); ok {
+            t.Fatal("removed key still exists")
+        }
+    }
+}
+
+func TestTypedSchemaVersion(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("v")
+    v1 := NewTyped(table, JSONCodec, TypedOptions{Version : 1})
+    for i := 0; i < 5; i++ {
+        v1.Put([]byte(fmt.Sprintf("k%d", i)), map[string]string{"name" : fmt.Sprintf("n%d", i)})
+    }
+    migrations := 0
+    migrate    := func(version uint32, data []byte) ([]byte, error) {
+        migrations++
+        if version != 1 {
+            return nil, fmt.Errorf("unexpected version %d", version)
+        }
+        var m map[string]string
+        if err := json.Unmarshal(data, &m); err != nil {
+            return nil, err
+        }
+        return json.Marshal(codecTestUser{Name : m["name"], Email : m["name"] + "@migrated"})
+    }
+
+    // 没有迁移函数时读取旧版本数据返回错误
+    var user codecTestUser
+    if _, err := NewTyped(table, JSONCodec, TypedOptions{Version : 2}).Get([]byte("k0"), &user); err == nil {
+        t.Fatal("reading old version without Migrate should fail")
+    }
+    // 只在读取时迁移，不写回数据表
+    v2 := NewTyped(table, JSONCodec, TypedOptions{Version : 2, Migrate : migrate})
+    if ok, err := v2.Get([]byte("k0"), &user); !ok || err != nil || user.Email != "n0@migrated" {
+        t.Fatalf("migrate on read: %+v %v", user, err)
+    }
+    if ok, err := v2.Get([]byte("k0"), &user); !ok || err != nil || migrations != 2 {
+        t.Fatalf("migration should run on every read without Upgrade: %d", migrations)
+    }
+
+    // 开启Upgrade时迁移后的数据写回数据表，之后不再迁移
+    migrations = 0
+    upgraded  := NewTyped(table, JSONCodec, TypedOptions{Version : 2, Migrate : migrate, Upgrade : true})
+    n  := 0
+    err = upgraded.Iterate(&user, func(key []byte) bool {
+        if user.Email != user.Name + "@migrated" {
+            t.Fatalf("%s: got %+v", key, user)
+        }
+        n++
+        return true
+    })
+    if err != nil || n != 5 || migrations != 5 {
+        t.Fatalf("iterate: %d items, %d migrations, error %v", n, migrations, err)
+    }
+    if ok, err := v2.Get([]byte("k1"), &user); !ok || err != nil || migrations != 5 {
+        t.Fatalf("upgraded value was migrated again: %d", migrations)
+    }
+    // 旧版本不能读取新版本的数据
+    if _, err := v1.Get([]byte("k1"), &user); err == nil {
+        t.Fatal("reading newer version should fail")
+    }
+    // 不保存版本号的数据表不能读取保存了版本号的数据
+    if _, err := NewTyped(table, JSONCodec).Get([]byte("k1"), &user); err == nil {
+        t.Fatal("reading versioned value without version should fail")
+    }
+}
+
+func TestTypedUpgradeBestEffort(t *testing.T) {
+    logger := &recordLogger{}
+    db, err := New("/db", Options{FS : gvfs.NewMemFS(), Logger : logger})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("v")
+    NewTyped(table, JSONCodec, TypedOptions{Version : 1}).Put([]byte("k"), codecTestUser{Name : "n"})
+
+    // 迁移之后ctx被取消，写回失败不影响读取的结果
+    ctx, cancel := context.WithCancel(context.Background())
+    migrate     := func(version uint32, data []byte) ([]byte, error) {
+        cancel()
+        return data, nil
+    }
+    var user codecTestUser
+    typed := NewTyped(table, JSONCodec, TypedOptions{Version : 2, Migrate : migrate, Upgrade : true})
+    if ok, err := typed.GetCtx(ctx, []byte("k"), &user); !ok || err != nil || user.Name != "n" {
+        t.Fatalf("got %v %v %+v, want true <nil>", ok, err, user)
+    }
+    if v := table.Get([]byte("k")); binary.BigEndian.Uint32(v) != 1 {
+        t.Fatalf("upgrade should not be written back with a cancelled ctx: version %d", binary.BigEndian.Uint32(v))
+    }
+    logger.mu.Lock()
+    defer logger.mu.Unlock()
+    if len(logger.warns) != 1 || !strings.Contains(logger.warns[0], context.Canceled.Error()) {
+        t.Fatalf("unexpected warnings: %v", logger.warns)
+    }
+}
+
+func TestTypedUpgradeBatches(t *testing.T) {
+    db, err := New("/db", Options{FS : gvfs.NewMemFS()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("v")
+    v1 := NewTyped(table, JSONCodec, TypedOptions{Version : 1})
+    for i := 0; i < 3*gCODEC_UPGRADE_BATCH; i++ {
+        v1.Put([]byte(fmt.Sprintf("k%d", i)), codecTestUser{Name : fmt.Sprintf("n%d", i)})
+    }
+    // 数据全部同步到数据文件，遍历时持有数据表的锁
+    if err := db.binlog.sync(); err != nil {
+        t.Fatal(err)
+    }
+    migrate := func(version uint32, data []byte) ([]byte, error) {
+        return data, nil
+    }
+    // 遍历结束之前，先遍历到的数据已经分批写回(暂停同步，写回的数据保留在memtable中)
+    db.binlog.smu.Lock()
+    defer db.binlog.smu.Unlock()
+    var first []byte
+    var user codecTestUser
+    n       := 0
+    flushed := false
+    typed   := NewTyped(table, JSONCodec, TypedOptions{Version : 2, Migrate : migrate, Upgrade : true})
+    err      = typed.Iterate(&user, func(key []byte) bool {
+        if first == nil {
+            first = append([]byte(nil), key...)
+        } else if v, ok := table.memt.get(first); ok && binary.BigEndian.Uint32(v) == 2 {
+            flushed = true
+        }
+        n++
+        return true
+    })
+    if err != nil || n != 3*gCODEC_UPGRADE_BATCH {
+        t.Fatalf("iterate: %d items, error %v", n, err)
+    }
+    if !flushed {
+        t.Fatal("upgrades were not flushed during iteration")
+    }
+    table.Iterate(func(key, value []byte) bool {
+        if binary.BigEndian.Uint32(value) != 2 {
+            t.Fatalf("%s not upgraded", key)
+        }
+        return true
+    })
+}
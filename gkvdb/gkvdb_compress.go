@@ -0,0 +1,157 @@
+package gkvdb
+
+import (
+    "bytes"
+    "compress/flate"
+    "errors"
+    "io"
+    "io/ioutil"
+    "strconv"
+    "sync"
+)
+
+const (
+    gDATA_FLAG_COMPRESSED = 0x02 // 数据记录标志位：键值已压缩(格式版本2)
+    gCOMPRESS_MIN_SIZE    = 64   // 小于该大小(byte)的键值不压缩
+)
+
+// 键值压缩算法，压缩后的数据以1个字节的压缩算法编号开头保存在数据文件中，
+// Decompress的结果大于limit时需要返回错误(防止损坏的数据解压出超大的键值)
+type Compressor interface {
+    Compress(value []byte) ([]byte, error)
+    Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// 压缩算法注册项
+type _CompressorEntry struct {
+    id         byte       // 压缩算法编号，保存在压缩后的数据中
+    compressor Compressor // 压缩算法
+}
+
+// flate压缩(标准库compress/flate)
+type flateCompressor struct {
+    level int
+}
+
+var (
+    compressMu      sync.RWMutex
+    compressEntries = map[string]_CompressorEntry {
+        "flate" : {1, flateCompressor{flate.DefaultCompression}},
+    }
+    // 压缩算法编号与压缩算法的映射，用于解压
+    compressByID    = map[byte]Compressor {
+        1 : flateCompressor{flate.DefaultCompression},
+    }
+)
+
+// 注册自定义的键值压缩算法，id为保存在压缩数据中的算法编号(1为内置的flate，0保留)；
+// 数据表通过Options.Compressors指定使用的压缩算法名称，数据文件中存在该算法压缩的数据时必须注册同名同编号的压缩算法；
+// 编号为0或者编号已被其他名称的压缩算法使用时panic(不同的压缩算法使用同一个编号将无法正确解压)
+func RegisterCompressor(name string, id byte, c Compressor) {
+    compressMu.Lock()
+    defer compressMu.Unlock()
+    if id == 0 {
+        panic("gkvdb: compressor id 0 is reserved")
+    }
+    for n, entry := range compressEntries {
+        if entry.id == id && n != name {
+            panic("gkvdb: compressor id " + strconv.Itoa(int(id)) + " already registered by " + n)
+        }
+    }
+    if entry, ok := compressEntries[name]; ok {
+        delete(compressByID, entry.id)
+    }
+    compressEntries[name] = _CompressorEntry{id, c}
+    compressByID[id]      = c
+}
+
+// 根据压缩算法名称获取注册项
+func getCompressor(name string) (_CompressorEntry, error) {
+    compressMu.RLock()
+    entry, ok := compressEntries[name]
+    compressMu.RUnlock()
+    if !ok || entry.id == 0 {
+        return entry, errors.New("unsupported compressor: " + name)
+    }
+    return entry, nil
+}
+
+// 根据压缩算法编号获取压缩算法
+func getCompressorByID(id byte) (Compressor, error) {
+    compressMu.RLock()
+    c, ok := compressByID[id]
+    compressMu.RUnlock()
+    if ok {
+        return c, nil
+    }
+    return nil, errors.New("unsupported compressor id: " + strconv.Itoa(int(id)))
+}
+
+func (c flateCompressor) Compress(value []byte) ([]byte, error) {
+    buffer    := bytes.NewBuffer(make([]byte, 0, len(value)/2))
+    writer, _ := flate.NewWriter(buffer, c.level)
+    if _, err := writer.Write(value); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+func (c flateCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+    reader := flate.NewReader(bytes.NewReader(data))
+    defer reader.Close()
+    value, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit) + 1))
+    if err != nil {
+        return nil, err
+    }
+    if len(value) > limit {
+        return nil, errors.New("decompressed value exceeds max value size")
+    }
+    return value, nil
+}
+
+// 将键值编码为数据文件中保存的格式(先压缩后加密)，返回编码后的键值及数据记录标志位；
+// 压缩后没有变小的键值不压缩
+func (table *Table) encodeValue(key, value []byte) ([]byte, int, error) {
+    flags := 0
+    if table.compressor != nil && len(value) >= gCOMPRESS_MIN_SIZE {
+        data, err := table.compressor.compressor.Compress(value)
+        if err != nil {
+            return nil, 0, err
+        }
+        if len(data) + 1 < len(value) {
+            value  = append([]byte{table.compressor.id}, data...)
+            flags |= gDATA_FLAG_COMPRESSED
+        }
+    }
+    value, encrypted, err := table.db.format.seal(key, value)
+    if err != nil {
+        return nil, 0, err
+    }
+    if encrypted {
+        flags |= gDATA_FLAG_ENCRYPTED
+    }
+    return value, flags, nil
+}
+
+// 将数据文件中保存的键值解码为原始键值(先解密后解压)，同时返回加密使用的密钥编号(未加密时为-1)
+func (table *Table) decodeValue(key, value []byte, flags int) ([]byte, int64, error) {
+    encrypted := flags & gDATA_FLAG_ENCRYPTED > 0
+    keyid     := sealedKeyID(value, encrypted)
+    value, err := table.db.format.open(key, value, encrypted)
+    if err != nil {
+        return nil, keyid, err
+    }
+    if flags & gDATA_FLAG_COMPRESSED > 0 && len(value) > 0 {
+        compressor, err := getCompressorByID(value[0])
+        if err != nil {
+            return nil, keyid, err
+        }
+        if value, err = compressor.Decompress(value[1 : ], gMAX_VALUE_SIZE); err != nil {
+            return nil, keyid, err
+        }
+    }
+    return value, keyid, nil
+}
@@ -0,0 +1,131 @@
+package gkvdb
+
+import (
+    "bytes"
+    "compress/flate"
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const gTEST_COMPRESSOR_ID = 200 // 测试使用的压缩算法编号
+
+// 测试使用的自定义压缩算法，记录解压次数
+type countingCompressor struct {
+    flateCompressor
+    decompressed *int64
+}
+
+func (c countingCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+    atomic.AddInt64(c.decompressed, 1)
+    return c.flateCompressor.Decompress(data, limit)
+}
+
+var testDecompressed int64
+
+func init() {
+    RegisterCompressor("test_counting", gTEST_COMPRESSOR_ID, countingCompressor{flateCompressor{flate.BestCompression}, &testDecompressed})
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+    fs    := gvfs.NewMemFS()
+    value := []byte(strings.Repeat(`{"name":"alice","email":"alice@example.com"},`, 40))
+    db, err := New("/db", Options{FS : fs, Compressors : map[string]string{"c" : "flate", "x" : "test_counting"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    c, _ := db.Table("c")
+    p, _ := db.Table("p")
+    x, _ := db.Table("x")
+    for i := 0; i < 50; i++ {
+        key := []byte(fmt.Sprintf("k%d", i))
+        c.Set(key, value)
+        p.Set(key, value)
+        x.Set(key, value)
+    }
+    // 小于压缩大小下限的键值不压缩
+    c.Set([]byte("small"), []byte("tiny"))
+    db.Close()
+    if cs, ps := gvfs.Size(fs, "/db/c.db"), gvfs.Size(fs, "/db/p.db"); cs*4 > ps {
+        t.Fatalf("data file not compressed: %d bytes, uncompressed %d bytes", cs, ps)
+    }
+
+    // 修改压缩设置不影响已写入的数据，同时开启加密
+    keys := newTestKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    db, err = New("/db", Options{FS : fs, KeyProvider : keys, Compressors : map[string]string{"c" : "flate"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    c, _ = db.Table("c")
+    x, _ = db.Table("x")
+    if v := c.Get([]byte("k7")); !bytes.Equal(v, value) {
+        t.Fatalf("compressed value: got %q", v)
+    }
+    if v := c.Get([]byte("small")); string(v) != "tiny" {
+        t.Fatalf("small value: got %q", v)
+    }
+    before := atomic.LoadInt64(&testDecompressed)
+    if v := x.Get([]byte("k7")); !bytes.Equal(v, value) {
+        t.Fatalf("value compressed by custom compressor: got %q", v)
+    }
+    if atomic.LoadInt64(&testDecompressed) == before {
+        t.Fatal("custom compressor was not used for decompression")
+    }
+    c.Set([]byte("k8"), append(value, 'x'))
+    n := 0
+    c.Iterate(func(key, v []byte) bool {
+        if string(key) != "small" && !bytes.HasPrefix(v, value) {
+            t.Fatalf("%s: got %q", key, v)
+        }
+        n++
+        return true
+    })
+    if n != 51 {
+        t.Fatalf("iterate: got %d items, want 51", n)
+    }
+    db.Close()
+
+    db, err = New("/db", Options{FS : fs, KeyProvider : keys})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    c, _ = db.Table("c")
+    if v := c.Get([]byte("k8")); !bytes.Equal(v, append(value, 'x')) {
+        t.Fatalf("compressed and encrypted value: got %q", v)
+    }
+}
+
+func TestCompressorRegistry(t *testing.T) {
+    db, err := NewInMemory(Options{Compressors : map[string]string{"x" : "not_registered"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if _, err := db.Table("x"); err == nil {
+        t.Fatal("table with unsupported compressor should fail to open")
+    }
+    // 同一名称重复注册同一编号是允许的
+    RegisterCompressor("test_counting", gTEST_COMPRESSOR_ID, countingCompressor{flateCompressor{flate.BestCompression}, &testDecompressed})
+    mustPanic := func(name string, id byte) {
+        defer func() {
+            if recover() == nil {
+                t.Fatalf("registering %s with id %d should panic", name, id)
+            }
+        }()
+        RegisterCompressor(name, id, flateCompressor{flate.BestSpeed})
+    }
+    mustPanic("test_other", gTEST_COMPRESSOR_ID)
+    mustPanic("test_other", 1)
+    mustPanic("test_other", 0)
+    if _, err := getCompressor("test_other"); err == nil {
+        t.Fatal("rejected compressor was registered")
+    }
+    if c, err := getCompressorByID(gTEST_COMPRESSOR_ID); err != nil {
+        t.Fatal(err)
+    } else if _, ok := c.(countingCompressor); !ok {
+        t.Fatalf("compressor id %d was replaced", gTEST_COMPRESSOR_ID)
+    }
+}
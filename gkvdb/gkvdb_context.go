@@ -0,0 +1,109 @@
+package gkvdb
+
+import (
+    "context"
+)
+
+// =================================================================================
+// 支持context的操作
+// 等待锁、binlog队列长度上限及大事务同步时响应ctx的取消及超时，返回ctx.Err()；
+// 写入操作在写入binlog之后不再响应取消，保证返回ctx错误时数据一定没有写入；
+// 大事务写入binlog之后等待同步时取消返回ErrApplyPending，表示事务已提交
+// =================================================================================
+
+// 保存数据(默认表)
+func (db *DB) SetCtx(ctx context.Context, key []byte, value []byte) error {
+    return db.SetToCtx(ctx, key, value, gDEFAULT_TABLE_NAME)
+}
+
+// 保存数据(数据表)
+func (db *DB) SetToCtx(ctx context.Context, key []byte, value []byte, name string) error {
+    tx := db.Begin(name)
+    if err := tx.Set(key, value); err != nil {
+        return err
+    }
+    return tx.CommitCtx(ctx)
+}
+
+// 查询数据(默认表)
+func (db *DB) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+    return db.GetFromCtx(ctx, key, gDEFAULT_TABLE_NAME)
+}
+
+// 查询数据(数据表)
+func (db *DB) GetFromCtx(ctx context.Context, key []byte, name string) ([]byte, error) {
+    table, err := db.Table(name)
+    if err != nil {
+        return nil, err
+    }
+    return table.GetCtx(ctx, key)
+}
+
+// 保存数据(数据表)
+func (table *Table) SetCtx(ctx context.Context, key []byte, value []byte) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
+    tx := table.db.Begin(table.name)
+    if err := tx.Set(key, value); err != nil {
+        return err
+    }
+    return tx.CommitCtx(ctx)
+}
+
+// 查询数据(数据表)
+func (table *Table) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+    if table.closed.Val() {
+        return nil, ErrClosed
+    }
+    // 修改该数据表的大事务同步期间等待同步完成，保证大事务整体可见
+    gate := table.db.binlog.readGate(table.name)
+    if err := lockContext(ctx, gate.RLock, gate.RUnlock); err != nil {
+        return nil, err
+    }
+    defer gate.RUnlock()
+    return table.valueCtx(ctx, key)
+}
+
+// 遍历数据表(包括未同步到数据文件的数据)，f返回false时停止遍历
+func (table *Table) Iterate(f func(key, value []byte) bool) {
+    table.IterateCtx(context.Background(), f)
+}
+
+// 遍历数据表，f返回false时停止遍历，ctx取消或者超时时停止遍历并返回ctx的错误
+func (table *Table) IterateCtx(ctx context.Context, f func(key, value []byte) bool) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    return table.scan(ctx, f)
+}
+
+// 在ctx有效期内加锁，ctx取消或者超时时返回ctx的错误；
+// ctx不会被取消时直接加锁，否则在独立的goroutine中加锁，放弃加锁之后该goroutine获得锁时立即释放
+func lockContext(ctx context.Context, lock func(), unlock func()) error {
+    if ctx.Done() == nil {
+        lock()
+        return nil
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    locked := make(chan struct{})
+    go func() {
+        lock()
+        close(locked)
+    }()
+    select {
+        case <- locked:
+            return nil
+        case <- ctx.Done():
+            go func() {
+                <- locked
+                unlock()
+            }()
+            return ctx.Err()
+    }
+}
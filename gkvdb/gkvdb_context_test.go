@@ -0,0 +1,104 @@
+package gkvdb
+
+import (
+    "context"
+    "fmt"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestContextCancel(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("t")
+    for i := 0; i < 100; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    db.binlog.sync()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err := table.GetCtx(ctx, []byte("k1")); err != context.Canceled {
+        t.Fatalf("get with canceled context: %v", err)
+    }
+    if err := table.SetCtx(ctx, []byte("k1"), []byte("x")); err != context.Canceled {
+        t.Fatalf("set with canceled context: %v", err)
+    }
+    if v := table.Get([]byte("k1")); string(v) != "v" {
+        t.Fatalf("canceled set was written: %q", v)
+    }
+
+    // 遍历过程中取消
+    ctx, cancel = context.WithCancel(context.Background())
+    n  := 0
+    err = table.IterateCtx(ctx, func(key, value []byte) bool {
+        if n++; n == 10 {
+            cancel()
+        }
+        return true
+    })
+    if err != context.Canceled || n > 20 {
+        t.Fatalf("iterate: got %v after %d items", err, n)
+    }
+}
+
+func TestContextTimeout(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("t")
+    table.Set([]byte("k1"), []byte("v"))
+    db.binlog.sync()
+
+    // 数据表写锁被占用时读取超时
+    table.cache.Clear()
+    table.mu.Lock()
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    start       := time.Now()
+    if _, err := table.GetCtx(ctx, []byte("k1")); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+        t.Fatalf("get while table locked: %v", err)
+    }
+    if err := table.IterateCtx(ctx, func(key, value []byte) bool { return true }); err != context.DeadlineExceeded {
+        t.Fatalf("iterate while table locked: %v", err)
+    }
+    cancel()
+    table.mu.Unlock()
+    if v, err := table.GetCtx(context.Background(), []byte("k1")); err != nil || string(v) != "v" {
+        t.Fatalf("get after unlock: %q %v", v, err)
+    }
+
+    // binlog队列达到上限时提交超时，事务不写入，之后可以重新提交
+    atomic.StoreInt64(&db.binlog.queuesize, gBINLOG_MAX_SIZE)
+    ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+    tx := db.Begin("t")
+    tx.Set([]byte("blocked"), []byte("1"))
+    if err := tx.CommitCtx(ctx); err != context.DeadlineExceeded {
+        t.Fatalf("commit with full binlog queue: %v", err)
+    }
+    cancel()
+    atomic.StoreInt64(&db.binlog.queuesize, 0)
+    if table.Get([]byte("blocked")) != nil {
+        t.Fatal("transaction written after timeout")
+    }
+    if err := tx.Commit(); err != nil || string(table.Get([]byte("blocked"))) != "1" {
+        t.Fatalf("retry commit: %v", err)
+    }
+
+    // 大事务同步期间写入超时
+    db.binlog.gate.Lock()
+    ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+    if err := table.SetCtx(ctx, []byte("g"), []byte("1")); err != context.DeadlineExceeded {
+        t.Fatalf("set while gate locked: %v", err)
+    }
+    cancel()
+    db.binlog.gate.Unlock()
+    if err := table.SetCtx(context.Background(), []byte("g"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+}
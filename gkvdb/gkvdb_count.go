@@ -0,0 +1,216 @@
+package gkvdb
+
+import (
+    "context"
+    "errors"
+    "os"
+    "sync/atomic"
+    "github.com/gogf/gf/g/encoding/gbinary"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gCOUNT_FILE_SIZE = 9 // 键名数量文件大小(byte)：[键名数量(8)][正常关闭标志(1)]
+)
+
+// 键名数量文件，保存数据文件中的键名数量，只有正常关闭的数据表保存的数量才是可信的
+func (table *Table) getCountFilePath() string {
+    return table.db.path + gfile.Separator + table.name + ".cnt"
+}
+
+// 读取上次正常关闭时保存的键名数量，文件不存在、内容不完整或者上次没有正常关闭时返回-1(需要重新统计)
+func (table *Table) loadCount() int64 {
+    buffer, err := gvfs.ReadFile(table.db.fs, table.getCountFilePath())
+    if err != nil || len(buffer) != gCOUNT_FILE_SIZE || buffer[8] != 1 {
+        return -1
+    }
+    if count := gbinary.DecodeToInt64(buffer[0 : 8]); count >= 0 {
+        return count
+    }
+    return -1
+}
+
+// 保存键名数量，clean表示数据表是否正常关闭；
+// 数据表打开时先标记为非正常关闭，异常退出后重新打开时通过遍历元数据重新统计
+func (table *Table) saveCount(count int64, clean bool) error {
+    pf, err := table.db.fs.OpenFile(table.getCountFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+    if err != nil {
+        return err
+    }
+    defer pf.Close()
+
+    buffer := append(gbinary.EncodeInt64(count), 0)
+    if clean {
+        buffer[8] = 1
+    }
+    if _, err := pf.WriteAt(buffer, 0); err != nil {
+        return err
+    }
+    return pf.Sync()
+}
+
+// 修改数据文件中的键名数量(内部调用，调用方加写锁)，数量未知时不修改
+func (table *Table) addCount(delta int64) {
+    if count := atomic.LoadInt64(&table.count); count >= 0 {
+        atomic.StoreInt64(&table.count, count + delta)
+    }
+}
+
+// 获取数据文件中的键名数量(内部调用，调用方加锁)，数量未知时遍历元数据重新统计
+func (table *Table) diskCount() int64 {
+    if count := atomic.LoadInt64(&table.count); count >= 0 {
+        return count
+    }
+    count := table.countKeys()
+    if count >= 0 {
+        atomic.StoreInt64(&table.count, count)
+    }
+    return count
+}
+
+// 遍历索引及元数据统计数据文件中的键名数量，只读取元数据不读取数据文件，统计失败时返回-1
+func (table *Table) countKeys() int64 {
+    mtpf, err := table.getMetaFilePointer()
+    if err != nil {
+        // 只读模式下数据表文件可能不存在
+        if table.db.readonly {
+            return 0
+        }
+        return -1
+    }
+    defer mtpf.Close()
+
+    ixbuffer, err := gvfs.ReadFile(table.db.fs, table.getIndexFilePath())
+    if err != nil {
+        return -1
+    }
+    format := table.db.format
+    count  := int64(0)
+    _, err  = table.walkIndex(ixbuffer, 0, gDEFAULT_PART_SIZE, func(mtindex int, mtsize int) (bool, error) {
+        if table.mtsp.Contains(mtindex, mtsize) {
+            return true, nil
+        }
+        mtbuffer := getBinContentsByTwoOffsets(mtpf, int64(mtindex), int64(mtindex + mtsize))
+        if mtbuffer == nil {
+            return false, errors.New("failed reading meta file of table: " + table.name)
+        }
+        for i := 0; i + format.metaItemSize <= len(mtbuffer); i += format.metaItemSize {
+            if table.mtsp.Contains(mtindex + i, format.metaItemSize) {
+                continue
+            }
+            if _, klen, vlen, _ := format.decodeMeta(mtbuffer[i : i + format.metaItemSize]); klen > 0 && vlen > 0 {
+                count++
+            }
+        }
+        return true, nil
+    })
+    if err != nil {
+        return -1
+    }
+    return count
+}
+
+// 查询键名是否存在于数据文件中(内部调用，调用方加锁)，只读取元数据及数据记录中的键名，不读取键值
+func (table *Table) existsOnDisk(key []byte) (bool, error) {
+    record, err := table.searchRecordByKey(key, false)
+    if err != nil {
+        return false, err
+    }
+    return record.meta.match == 0 && record.data.vlen > 0, nil
+}
+
+// 获取数据表的键名数量(包括未同步到数据文件的数据)，统计失败(例如数据表已关闭)时返回0，需要区分错误时使用LenCtx
+func (table *Table) Len() int {
+    n, _ := table.LenCtx(context.Background())
+    return n
+}
+
+// 获取数据表的键名数量，ctx取消或者超时时返回ctx的错误；
+// 数据文件中的键名数量在写入时维护，不需要遍历数据表，只需要额外查询memtable中的键名在数据文件中是否存在
+func (table *Table) LenCtx(ctx context.Context) (int, error) {
+    if table.closed.Val() {
+        return 0, ErrClosed
+    }
+    binlog := table.db.binlog
+    gate   := binlog.readGate(table.name)
+    if err := lockContext(ctx, gate.RLock, gate.RUnlock); err != nil {
+        return 0, err
+    }
+    defer gate.RUnlock()
+    // binlog读锁内只获取memtable的快照，查询数据文件时不阻塞其他事务的写入
+    if err := lockContext(ctx, binlog.RLock, binlog.RUnlock); err != nil {
+        return 0, err
+    }
+    datamap, mergeKeys := table.memt.snapshot()
+    binlog.RUnlock()
+
+    // 存在未合并操作数的键名先计算合并后的键值(合并时需要获取数据表读锁)
+    for _, k := range mergeKeys {
+        v, err := table.mergedCtx(ctx, []byte(k))
+        if err != nil {
+            return 0, err
+        }
+        datamap[k] = v
+    }
+
+    if err := lockContext(ctx, table.mu.RLock, table.mu.RUnlock); err != nil {
+        return 0, err
+    }
+    defer table.mu.RUnlock()
+
+    count := table.diskCount()
+    if count < 0 {
+        return 0, errors.New("failed counting keys of table: " + table.name)
+    }
+    // memtable快照中的键名以快照中的键值为准，获取快照之后已同步到数据文件的键名在两边同时计算，结果不变
+    for k, v := range datamap {
+        if err := ctx.Err(); err != nil {
+            return 0, err
+        }
+        exists, err := table.existsOnDisk([]byte(k))
+        if err != nil {
+            return 0, err
+        }
+        if v != nil && !exists {
+            count++
+        } else if v == nil && exists {
+            count--
+        }
+    }
+    return int(count), nil
+}
+
+// 查询键名是否存在(包括未同步到数据文件的数据)
+func (table *Table) Exists(key []byte) bool {
+    exists, _ := table.ExistsCtx(context.Background(), key)
+    return exists
+}
+
+// 查询键名是否存在，ctx取消或者超时时返回ctx的错误；查询数据文件时只对比键名，不读取及解码键值
+func (table *Table) ExistsCtx(ctx context.Context, key []byte) (bool, error) {
+    if table.closed.Val() {
+        return false, ErrClosed
+    }
+    gate := table.db.binlog.readGate(table.name)
+    if err := lockContext(ctx, gate.RLock, gate.RUnlock); err != nil {
+        return false, err
+    }
+    defer gate.RUnlock()
+
+    if v, ok := table.memt.get(key); ok {
+        return v != nil, nil
+    }
+    if _, _, operands := table.memt.operands(key); operands != nil {
+        v, err := table.mergedCtx(ctx, key)
+        return v != nil, err
+    }
+    if v := table.cache.Get("value_cache_" + string(key)); v != nil && v.([]byte) != nil {
+        return true, nil
+    }
+    if err := lockContext(ctx, table.mu.RLock, table.mu.RUnlock); err != nil {
+        return false, err
+    }
+    defer table.mu.RUnlock()
+    return table.existsOnDisk(key)
+}
@@ -0,0 +1,152 @@
+package gkvdb
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+func TestLenUnsyncedMemTable(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("t")
+    for i := 0; i < 1000; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    db.binlog.sync()
+    if n := table.Len(); n != 1000 {
+        t.Fatalf("synced len: got %d, want 1000", n)
+    }
+
+    // 阻止binlog同步到数据文件，所有写入都保留在memtable中
+    db.binlog.smu.Lock()
+    for i := 0; i < 20000; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("vv"))
+    }
+    for i := 0; i < 2000; i += 2 {
+        table.Remove([]byte(fmt.Sprintf("k%d", i)))
+    }
+    table.Remove([]byte("none"))
+    n := table.Len()
+    db.binlog.smu.Unlock()
+    if n != 19000 {
+        t.Fatalf("unsynced len: got %d, want 19000", n)
+    }
+    if table.Exists([]byte("k0")) || !table.Exists([]byte("k1")) || !table.Exists([]byte("k19999")) || table.Exists([]byte("none")) {
+        t.Fatal("unexpected exists result")
+    }
+    db.binlog.sync()
+    if n := table.Len(); n != 19000 {
+        t.Fatalf("len after sync: got %d, want 19000", n)
+    }
+}
+
+func TestLenAcrossReplay(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("t")
+    for i := 0; i < 500; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    db.binlog.sync()
+    // 未同步的写入只保存在binlog中，复制文件模拟进程异常退出
+    db.binlog.smu.Lock()
+    for i := 0; i < 100; i++ {
+        table.Remove([]byte(fmt.Sprintf("k%d", i)))
+    }
+    for i := 500; i < 800; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    crashed := copyMemFS(fs)
+    db.binlog.smu.Unlock()
+    db.Close()
+
+    db, err = New("/db", Options{FS : crashed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ = db.Table("t")
+    if n := table.Len(); n != 700 {
+        t.Fatalf("len after replay: got %d, want 700", n)
+    }
+    db.binlog.sync()
+    if n := table.Len(); n != 700 {
+        t.Fatalf("len after replay and sync: got %d, want 700", n)
+    }
+    db.Close()
+
+    // 正常关闭之后使用保存的键名数量
+    db, err = New("/db", Options{FS : crashed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ = db.Table("t")
+    if n := table.Len(); n != 700 {
+        t.Fatalf("len after clean reopen: got %d, want 700", n)
+    }
+    db.Close()
+
+    // 键名数量需要重新统计时元数据文件读取失败返回错误，而不是返回不完整的统计结果
+    broken := copyMemFS(crashed)
+    info, _ := broken.Stat("/db/t.mt")
+    broken.Remove("/db/t.cnt")
+    broken.Truncate("/db/t.mt", info.Size()/2)
+    db, err = New("/db", Options{FS : broken})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ = db.Table("t")
+    if _, err := table.LenCtx(context.Background()); err == nil {
+        t.Fatal("len with truncated meta file should fail")
+    }
+}
+
+func TestLenDoesNotBlockWriters(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("t")
+    db.binlog.smu.Lock()
+    for i := 0; i < 100; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    // 统计过程中等待数据表的锁时不持有binlog的锁，其他事务可以继续写入
+    table.mu.Lock()
+    counted := make(chan int, 1)
+    go func() { counted <- table.Len() }()
+    time.Sleep(50*time.Millisecond)
+    written := make(chan error, 1)
+    go func() { written <- table.Set([]byte("new"), []byte("v")) }()
+    select {
+        case err := <- written:
+            if err != nil {
+                t.Fatal(err)
+            }
+        case <- time.After(5*time.Second):
+            t.Fatal("write blocked by Len")
+    }
+    table.mu.Unlock()
+    if n := <- counted; n != 100 && n != 101 {
+        t.Fatalf("len: got %d, want 100 or 101", n)
+    }
+    db.binlog.smu.Unlock()
+    db.Close()
+
+    // 数据表关闭之后Len返回0，LenCtx返回ErrClosed
+    if n := table.Len(); n != 0 {
+        t.Fatalf("len after close: got %d, want 0", n)
+    }
+    if _, err := table.LenCtx(context.Background()); err != ErrClosed {
+        t.Fatalf("got %v, want %v", err, ErrClosed)
+    }
+}
@@ -0,0 +1,592 @@
+package gkvdb
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "bytes"
+    "errors"
+    "strings"
+    "runtime"
+    "strconv"
+    "testing"
+    "path/filepath"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// =================================================================================
+// 崩溃一致性故障注入测试
+// 数据库运行在包装了内存文件系统的故障文件系统上，在第N次写入时注入故障：
+// 崩溃模式下在该次写入时对文件系统做两份快照，之后的写入全部失败，并分别使用快照重新打开数据库：
+// 进程崩溃快照中已执行的写入全部保留(binlog的写入只保留前半部分，模拟写入撕裂)；
+// 断电快照中只保留fsync过的文件内容(目录操作及截断视为立即持久化)，模拟操作系统缓存的丢失。
+// 错误模式下该次写入返回I/O错误，数据库继续运行，关闭后重新打开。
+// 重新打开后检查所有已确认提交的事务都可以读取，故障时正在提交的事务要么完全可见，要么完全不可见。
+// 默认根据一次无故障运行的写入次数抽样注入故障(每个写入位置至少注入一次)，
+// 设置环境变量GKVDB_CRASH_EXHAUSTIVE=1时依次在每一次写入时注入故障
+// =================================================================================
+
+const (
+    crashHashName  = "crash-test" // 测试使用的哈希函数，键名全部落在同一个索引分区，以便触发重新分区
+    crashMetaItems = 16           // 测试中元数据列表的最大数据项数量
+    crashMaxWrites = 100000       // 写入次数上限，防止工作负载无法结束
+    crashSamples   = 24           // 抽样注入故障的写入次数
+    crashSiteRuns  = 2            // 每个写入位置额外注入故障的次数
+)
+
+// 故障注入模式
+const (
+    faultCrash = iota
+    faultError
+)
+
+var (
+    errCrashed  = errors.New("simulated crash")
+    errInjected = errors.New("injected I/O error")
+)
+
+// 需要覆盖的写入位置，每个位置都至少需要有一次故障注入
+var crashSites = []string {
+    "insertDataByRecord",
+    "checkDeepRehash",
+    "autoCompactingData",
+    "autoCompactingMeta",
+    "writeByTx",
+}
+
+func init() {
+    // 键名的数字后缀乘以分区大小作为哈希值，所有键名落在第一个索引分区
+    RegisterHash(crashHashName, 0, func(seed []byte) HashFunc {
+        return func(key []byte) uint64 {
+            n, _ := strconv.ParseUint(string(key[1:]), 10, 64)
+            return (n + 1)*gDEFAULT_PART_SIZE
+        }
+    })
+}
+
+// 故障文件系统，所有的写入操作串行执行，在指定的写入次数时注入故障
+type faultFS struct {
+    gvfs.FS
+    mu       sync.Mutex
+    mode     int               // 故障注入模式
+    at       int               // 注入故障的写入次数(为0时不注入故障，只记录每一次写入的位置)
+    writes   int               // 已执行的写入次数
+    crashed  bool              // 是否已崩溃(崩溃模式)
+    snapshot *gvfs.MemFS       // 崩溃时的文件系统快照(进程崩溃)
+    durable  *gvfs.MemFS       // 崩溃时的文件系统快照(断电，只保留fsync过的文件内容)
+    synced   map[string][]byte // 文件最近一次fsync时的内容
+    site     string            // 注入故障的写入位置
+    sites    []string          // 无故障运行时每一次写入的位置
+}
+
+type faultFile struct {
+    gvfs.File
+    fs *faultFS
+}
+
+func newFaultFS(mode int, at int) *faultFS {
+    return &faultFS{FS : gvfs.NewMemFS(), mode : mode, at : at, synced : make(map[string][]byte)}
+}
+
+// 写入之前调用(调用方加锁)，返回非nil时写入不执行；崩溃时对文件系统做快照，并对binlog的写入模拟撕裂
+func (fs *faultFS) before(name string, data []byte, offset int64) error {
+    if fs.crashed {
+        return errCrashed
+    }
+    fs.writes++
+    if fs.at == 0 {
+        fs.sites = append(fs.sites, crashSite())
+        return nil
+    }
+    if fs.writes != fs.at {
+        return nil
+    }
+    fs.site = crashSite()
+    if fs.mode == faultError {
+        return errInjected
+    }
+    fs.crashed  = true
+    fs.snapshot = copyMemFS(fs.FS)
+    fs.durable  = copyMemFS(fs.FS)
+    for _, path := range listMemFS(fs.durable) {
+        gvfs.WriteFile(fs.durable, path, fs.synced[path], 0644)
+    }
+    if offset >= 0 && len(data) > 1 && filepath.Base(name) == "binlog" {
+        if pf, err := fs.snapshot.OpenFile(name, os.O_RDWR, 0); err == nil {
+            pf.WriteAt(data[0 : len(data)/2], offset)
+            pf.Close()
+        }
+    }
+    return errCrashed
+}
+
+// 获取执行当前写入的数据库方法名称
+func crashSite() string {
+    pcs    := make([]uintptr, 32)
+    frames := runtime.CallersFrames(pcs[0 : runtime.Callers(3, pcs)])
+    first  := ""
+    for {
+        frame, more := frames.Next()
+        name        := frame.Function[strings.LastIndex(frame.Function, ".") + 1:]
+        for _, site := range crashSites {
+            if name == site {
+                return site
+            }
+        }
+        if first == "" && strings.Contains(frame.Function, "gkvdb.(") && !strings.Contains(frame.Function, "fault") {
+            first = name
+        }
+        if !more {
+            return first
+        }
+    }
+}
+
+// 复制内存文件系统中的所有目录及文件
+func copyMemFS(src gvfs.FS) *gvfs.MemFS {
+    dst := gvfs.NewMemFS()
+    var walk func(dir string)
+    walk = func(dir string) {
+        dst.MkdirAll(dir, 0755)
+        infos, _ := src.ReadDir(dir)
+        for _, info := range infos {
+            path := filepath.Join(dir, info.Name())
+            if info.IsDir() {
+                walk(path)
+            } else {
+                content, _ := gvfs.ReadFile(src, path)
+                gvfs.WriteFile(dst, path, content, 0644)
+            }
+        }
+    }
+    walk(string(filepath.Separator))
+    return dst
+}
+
+// 列出内存文件系统中所有文件的路径
+func listMemFS(fs gvfs.FS) []string {
+    paths := make([]string, 0)
+    var walk func(dir string)
+    walk = func(dir string) {
+        infos, _ := fs.ReadDir(dir)
+        for _, info := range infos {
+            path := filepath.Join(dir, info.Name())
+            if info.IsDir() {
+                walk(path)
+            } else {
+                paths = append(paths, path)
+            }
+        }
+    }
+    walk(string(filepath.Separator))
+    return paths
+}
+
+// 截断文件已fsync的内容(调用方加锁)，截断视为立即持久化
+func (fs *faultFS) truncateSynced(name string, size int64) {
+    if content, ok := fs.synced[name]; ok && int64(len(content)) > size {
+        fs.synced[name] = content[0 : size]
+    }
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (gvfs.File, error) {
+    if flag & os.O_TRUNC != 0 {
+        fs.mu.Lock()
+        defer fs.mu.Unlock()
+        if err := fs.before(name, nil, -1); err != nil {
+            return nil, err
+        }
+        fs.truncateSynced(name, 0)
+    }
+    file, err := fs.FS.OpenFile(name, flag, perm)
+    if err != nil {
+        return nil, err
+    }
+    return &faultFile{file, fs}, nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.before(name, nil, -1); err != nil {
+        return err
+    }
+    delete(fs.synced, name)
+    return fs.FS.Remove(name)
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.before(newpath, nil, -1); err != nil {
+        return err
+    }
+    // 重命名视为立即持久化，目标文件的内容为源文件已fsync的内容
+    if content, ok := fs.synced[oldpath]; ok {
+        fs.synced[newpath] = content
+    } else {
+        delete(fs.synced, newpath)
+    }
+    delete(fs.synced, oldpath)
+    return fs.FS.Rename(oldpath, newpath)
+}
+
+func (fs *faultFS) Truncate(name string, size int64) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.before(name, nil, -1); err != nil {
+        return err
+    }
+    fs.truncateSynced(name, size)
+    return fs.FS.Truncate(name, size)
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+    f.fs.mu.Lock()
+    defer f.fs.mu.Unlock()
+    if err := f.fs.before(f.Name(), b, -1); err != nil {
+        return 0, err
+    }
+    return f.File.Write(b)
+}
+
+func (f *faultFile) WriteAt(b []byte, offset int64) (int, error) {
+    f.fs.mu.Lock()
+    defer f.fs.mu.Unlock()
+    if err := f.fs.before(f.Name(), b, offset); err != nil {
+        return 0, err
+    }
+    return f.File.WriteAt(b, offset)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+    f.fs.mu.Lock()
+    defer f.fs.mu.Unlock()
+    if err := f.fs.before(f.Name(), nil, -1); err != nil {
+        return err
+    }
+    f.fs.truncateSynced(f.Name(), size)
+    return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+    f.fs.mu.Lock()
+    defer f.fs.mu.Unlock()
+    if f.fs.crashed {
+        return errCrashed
+    }
+    if err := f.File.Sync(); err != nil {
+        return err
+    }
+    content, err := gvfs.ReadFile(f.fs.FS, f.Name())
+    if err != nil {
+        return err
+    }
+    f.fs.synced[f.Name()] = content
+    return nil
+}
+
+// 工作负载中的一个事务，value为nil表示删除
+type crashOp struct {
+    table string
+    key   string
+    value []byte
+}
+
+// 已确认提交的数据模型，pending为故障时正在提交的事务(可能可见也可能不可见，但必须是原子的)
+type crashModel struct {
+    data    map[string]map[string][]byte
+    pending []crashOp
+}
+
+func (m *crashModel) apply(ops []crashOp) {
+    for _, op := range ops {
+        if _, ok := m.data[op.table]; !ok {
+            m.data[op.table] = make(map[string][]byte)
+        }
+        if op.value == nil {
+            delete(m.data[op.table], op.key)
+        } else {
+            m.data[op.table][op.key] = op.value
+        }
+    }
+}
+
+// 生成测试键值
+func crashValue(key string, version int, size int) []byte {
+    prefix := fmt.Sprintf("%s-%d-", key, version)
+    return []byte(prefix + strings.Repeat("v", size - len(prefix)))
+}
+
+// 测试的工作负载：写入触发重新分区的数据、在事务中修改多个数据表、删除及扩容键值产生碎片，并执行数据整理
+func crashWorkload() [][]crashOp {
+    txs := make([][]crashOp, 0)
+    for i := 0; i < 24; i += 2 {
+        txs = append(txs, []crashOp {
+            {gDEFAULT_TABLE_NAME, "k" + strconv.Itoa(i),     crashValue("k" + strconv.Itoa(i),     1, 40)},
+            {gDEFAULT_TABLE_NAME, "k" + strconv.Itoa(i + 1), crashValue("k" + strconv.Itoa(i + 1), 1, 600)},
+        })
+    }
+    txs = append(txs, []crashOp {
+        {gDEFAULT_TABLE_NAME, "k0", crashValue("k0", 2, 900)},
+        {gDEFAULT_TABLE_NAME, "k3", nil},
+        {"other",             "t0", crashValue("t0", 1, 100)},
+        {"other",             "t1", crashValue("t1", 1, 700)},
+    })
+    for i := 5; i < 12; i += 2 {
+        txs = append(txs, []crashOp {{gDEFAULT_TABLE_NAME, "k" + strconv.Itoa(i), nil}})
+    }
+    txs = append(txs, []crashOp {
+        {gDEFAULT_TABLE_NAME, "k2", crashValue("k2", 2, 20)},
+        {"other",             "t1", nil},
+        {"other",             "t2", crashValue("t2", 1, 30)},
+    })
+    return txs
+}
+
+// 在故障文件系统上执行工作负载，返回已确认提交的数据模型
+func runCrashWorkload(t *testing.T, fs *faultFS) *crashModel {
+    model := &crashModel{data : make(map[string]map[string][]byte)}
+    // 每一次提交都执行fsync，断电之后已确认提交的事务也不能丢失
+    db, err := New("/db", Options{FS : fs, Hash : crashHashName, Sync : SyncAlways, Logger : crashLogger{}})
+    if err != nil {
+        // 崩溃发生在数据库初始化阶段
+        return model
+    }
+    // 缩小元数据列表的上限以便触发重新分区，需要在写入数据之前修改
+    db.format.maxMetaListSize = crashMetaItems*db.format.metaItemSize
+    for i, ops := range crashWorkload() {
+        tx := db.Begin()
+        for _, op := range ops {
+            if op.value == nil {
+                tx.RemoveFrom([]byte(op.key), op.table)
+            } else {
+                tx.SetTo([]byte(op.key), op.value, op.table)
+            }
+        }
+        if err := tx.Commit(); err != nil {
+            model.pending = append(model.pending, ops...)
+            if fs.mode == faultCrash {
+                break
+            }
+            continue
+        }
+        // 后续的写入覆盖了故障时正在提交的事务的键名，这些键名的值已确定
+        model.resolve(ops)
+        model.apply(ops)
+        // 定期将数据同步到数据文件并进行数据整理
+        if i%4 == 3 {
+            db.binlog.sync()
+            for _, name := range []string{gDEFAULT_TABLE_NAME, "other"} {
+                if table, err := db.Table(name); err == nil {
+                    table.autoCompactingData()
+                    table.autoCompactingMeta()
+                }
+            }
+        }
+    }
+    db.Close()
+    if fs.mode == faultError && len(model.pending) > 0 && fs.writes < fs.at {
+        t.Fatalf("transaction failed without injected fault")
+    }
+    return model
+}
+
+// 从pending中移除已被覆盖的键名
+func (m *crashModel) resolve(ops []crashOp) {
+    pending := m.pending[0 : 0]
+    for _, p := range m.pending {
+        covered := false
+        for _, op := range ops {
+            if op.table == p.table && op.key == p.key {
+                covered = true
+                break
+            }
+        }
+        if !covered {
+            pending = append(pending, p)
+        }
+    }
+    m.pending = pending
+}
+
+// 重新打开数据库，检查数据与模型一致，故障时正在提交的事务要么完全可见，要么完全不可见
+func verifyCrashModel(fs gvfs.FS, model *crashModel) error {
+    if !gvfs.Exists(fs, "/db") {
+        return nil
+    }
+    db, err := New("/db", Options{FS : fs, Logger : crashLogger{}})
+    if err != nil {
+        return fmt.Errorf("reopen failed: %v", err)
+    }
+    defer db.Close()
+    // pending中的数据项全部可见或者全部不可见
+    visible := -1
+    for _, op := range model.pending {
+        v     := db.GetFrom([]byte(op.key), op.table)
+        state := 0
+        if bytes.Equal(v, op.value) {
+            state = 1
+        } else if !bytes.Equal(v, model.data[op.table][op.key]) {
+            return fmt.Errorf("pending key %s/%s has unexpected value %q", op.table, op.key, v)
+        }
+        // 修改前后的键值相同时无法区分
+        if bytes.Equal(op.value, model.data[op.table][op.key]) {
+            continue
+        }
+        if visible >= 0 && visible != state {
+            return fmt.Errorf("pending transaction partially visible at %s/%s", op.table, op.key)
+        }
+        visible = state
+    }
+    expected := make(map[string]map[string][]byte)
+    for name, m := range model.data {
+        expected[name] = make(map[string][]byte)
+        for k, v := range m {
+            expected[name][k] = v
+        }
+    }
+    if visible == 1 {
+        (&crashModel{data : expected}).apply(model.pending)
+    }
+    for _, name := range []string{gDEFAULT_TABLE_NAME, "other"} {
+        keys := make([]string, 0)
+        for k, v := range expected[name] {
+            keys = append(keys, k)
+            if got := db.GetFrom([]byte(k), name); !bytes.Equal(got, v) {
+                return fmt.Errorf("acknowledged key %s/%s = %q, want %q", name, k, got, v)
+            }
+        }
+        table, err := db.Table(name)
+        if err != nil {
+            return err
+        }
+        actual := table.Keys(-1)
+        // 键名数量在重新打开(binlog重放或者重新统计)之后与遍历结果一致
+        if n := table.Len(); n != len(actual) {
+            return fmt.Errorf("table %s len %d, want %d", name, n, len(actual))
+        }
+        // 未确定的pending键名不参与比较
+        if visible < 0 {
+            actual = filterPending(actual, name, model.pending)
+            keys   = filterPending(keys,   name, model.pending)
+        }
+        sort.Strings(keys)
+        sort.Strings(actual)
+        if strings.Join(keys, ",") != strings.Join(actual, ",") {
+            return fmt.Errorf("table %s keys %v, want %v", name, actual, keys)
+        }
+    }
+    return nil
+}
+
+func filterPending(keys []string, name string, pending []crashOp) []string {
+    result := make([]string, 0, len(keys))
+    for _, k := range keys {
+        skip := false
+        for _, op := range pending {
+            if op.table == name && op.key == k {
+                skip = true
+            }
+        }
+        if !skip {
+            result = append(result, k)
+        }
+    }
+    return result
+}
+
+// 测试中不输出日志
+type crashLogger struct {}
+
+func (crashLogger) Infof(format string, v ...interface{})  {}
+func (crashLogger) Warnf(format string, v ...interface{})  {}
+func (crashLogger) Errorf(format string, v ...interface{}) {}
+
+// 在第at次写入时注入故障并检查重新打开后的数据，返回注入故障的写入位置，工作负载的写入次数不足at次时返回false
+func runCrashPoint(t *testing.T, mode int, at int) (string, bool) {
+    fs    := newFaultFS(mode, at)
+    model := runCrashWorkload(t, fs)
+    fs.mu.Lock()
+    writes, site := fs.writes, fs.site
+    snapshots    := []gvfs.FS{fs.snapshot, fs.durable}
+    fs.mu.Unlock()
+    if writes < at {
+        return "", false
+    }
+    if mode == faultError {
+        snapshots = []gvfs.FS{fs.FS}
+    }
+    for i, snapshot := range snapshots {
+        if err := verifyCrashModel(snapshot, model); err != nil {
+            t.Fatalf("fault at write %d (%s, snapshot %d): %v", at, site, i, err)
+        }
+    }
+    return site, true
+}
+
+// 抽样注入故障的写入次数：按照无故障运行的写入次数等间隔抽样，并且每个写入位置的前几次写入都注入故障；
+// 返回的sites为无故障运行时每一次写入的位置
+func crashPoints(t *testing.T, mode int) (points []int, sites []string) {
+    fs := newFaultFS(mode, 0)
+    runCrashWorkload(t, fs)
+    sites   = fs.sites
+    stride := len(sites)/crashSamples + 1
+    counts := make(map[string]int)
+    for i, site := range sites {
+        if i%stride == 0 || counts[site] < crashSiteRuns {
+            points = append(points, i + 1)
+        }
+        counts[site]++
+    }
+    return
+}
+
+func testCrashConsistency(t *testing.T, mode int) {
+    covered := make(map[string]bool)
+    if os.Getenv("GKVDB_CRASH_EXHAUSTIVE") != "" {
+        for at := 1; at < crashMaxWrites; at++ {
+            site, ok := runCrashPoint(t, mode, at)
+            // 工作负载执行完成之前没有到达故障注入的写入次数，所有的写入位置都已测试
+            if !ok {
+                break
+            }
+            covered[site] = true
+        }
+    } else {
+        points, sites := crashPoints(t, mode)
+        for _, at := range points {
+            if site, ok := runCrashPoint(t, mode, at); ok {
+                covered[site] = true
+            }
+        }
+        // 后台线程导致写入顺序不完全确定，未覆盖的写入位置使用无故障运行中该位置的其他写入次数补充
+        for i, site := range sites {
+            if !covered[site] {
+                if site, ok := runCrashPoint(t, mode, i + 1); ok {
+                    covered[site] = true
+                }
+            }
+        }
+    }
+    for _, site := range crashSites {
+        if !covered[site] {
+            t.Errorf("no fault injected in %s", site)
+        }
+    }
+}
+
+func TestCrashConsistency(t *testing.T) {
+    if testing.Short() {
+        t.Skip("skipping crash consistency test in short mode")
+    }
+    testCrashConsistency(t, faultCrash)
+}
+
+func TestIOErrorConsistency(t *testing.T) {
+    if testing.Short() {
+        t.Skip("skipping I/O error consistency test in short mode")
+    }
+    testCrashConsistency(t, faultError)
+}
@@ -0,0 +1,251 @@
+package gkvdb
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    gCIPHER_KEYID_SIZE     = 4                                                       // 密钥编号大小(byte)
+    gCIPHER_NONCE_SIZE     = 12                                                      // AES-GCM随机数大小(byte)
+    gCIPHER_TAG_SIZE       = 16                                                      // AES-GCM认证标签大小(byte)
+    gCIPHER_OVERHEAD       = gCIPHER_KEYID_SIZE + gCIPHER_NONCE_SIZE + gCIPHER_TAG_SIZE // 加密后键值增加的大小(byte)
+    gDATA_FLAG_ENCRYPTED   = 0x01                                                    // 数据记录标志位：键值已加密(格式版本2)
+    gROTATE_PARTITION_STEP = 1000                                                    // 重新加密时每次遍历的索引分区数量
+)
+
+// 密钥提供接口，密钥长度为16、24或者32字节(对应AES-128、AES-192、AES-256)；
+// 同一编号必须始终对应同一密钥，密钥轮换时返回新的编号及密钥，旧的密钥在重新加密完成之前需要保持可用；
+// 注意：只有键值被加密，键名以明文保存在数据文件及binlog中，包括二级索引表的键名(由索引字段提取函数从键值中提取的索引值)，
+// 因此敏感数据不能作为键名，也不能作为索引值，需要索引敏感字段时应当在IndexFunc中返回其摘要(如HMAC)，查询时使用同样的摘要
+type KeyProvider interface {
+    // 返回当前用于加密的密钥编号及密钥，每一次加密都会调用，需要快速返回
+    CurrentKey() (id uint32, key []byte, err error)
+    // 根据密钥编号返回解密使用的密钥，同一编号只会调用一次(结果会被缓存)
+    Key(id uint32) ([]byte, error)
+}
+
+// 键值加密器，每一条记录使用独立的随机数进行AES-GCM加密，并以键名作为附加认证数据，
+// 加密后的格式为：[密钥编号(32bit) 随机数(96bit) 密文 认证标签(128bit)]
+type _Cipher struct {
+    mu       sync.RWMutex
+    provider KeyProvider
+    aeads    map[uint32]cipher.AEAD // 按照密钥编号缓存的加密对象
+}
+
+// 创建键值加密器
+func newCipher(provider KeyProvider) *_Cipher {
+    return &_Cipher {
+        provider : provider,
+        aeads    : make(map[uint32]cipher.AEAD),
+    }
+}
+
+// 获取密钥编号对应的加密对象，key为nil时通过KeyProvider获取密钥
+func (c *_Cipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+    c.mu.RLock()
+    aead, ok := c.aeads[id]
+    c.mu.RUnlock()
+    if ok {
+        return aead, nil
+    }
+    if key == nil {
+        var err error
+        if key, err = c.provider.Key(id); err != nil {
+            return nil, err
+        }
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    if aead, err = cipher.NewGCM(block); err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    c.aeads[id] = aead
+    c.mu.Unlock()
+    return aead, nil
+}
+
+// 使用当前密钥加密键值
+func (c *_Cipher) seal(key, value []byte) ([]byte, error) {
+    id, secret, err := c.provider.CurrentKey()
+    if err != nil {
+        return nil, err
+    }
+    aead, err := c.aead(id, secret)
+    if err != nil {
+        return nil, err
+    }
+    buffer := make([]byte, gCIPHER_KEYID_SIZE + gCIPHER_NONCE_SIZE, len(value) + gCIPHER_OVERHEAD)
+    binary.BigEndian.PutUint32(buffer, id)
+    if _, err := rand.Read(buffer[gCIPHER_KEYID_SIZE : ]); err != nil {
+        return nil, err
+    }
+    return aead.Seal(buffer, buffer[gCIPHER_KEYID_SIZE : ], value, key), nil
+}
+
+// 解密键值
+func (c *_Cipher) open(key, value []byte) ([]byte, error) {
+    if len(value) < gCIPHER_OVERHEAD {
+        return nil, ErrDecrypt
+    }
+    aead, err := c.aead(binary.BigEndian.Uint32(value), nil)
+    if err != nil {
+        return nil, err
+    }
+    nonce  := value[gCIPHER_KEYID_SIZE : gCIPHER_KEYID_SIZE + gCIPHER_NONCE_SIZE]
+    result, err := aead.Open(nil, nonce, value[gCIPHER_KEYID_SIZE + gCIPHER_NONCE_SIZE : ], key)
+    if err != nil {
+        return nil, ErrDecrypt
+    }
+    return result, nil
+}
+
+// 判断记录是否需要重新加密(未加密或者加密使用的不是当前密钥)，keyid为记录的密钥编号，未加密时为-1
+func (c *_Cipher) stale(keyid int64) bool {
+    if keyid < 0 {
+        return true
+    }
+    id, _, err := c.provider.CurrentKey()
+    return err == nil && int64(id) != keyid
+}
+
+// 加密键值(未开启加密或者键值为空时原样返回)，返回的bool表示键值是否已加密
+func (format *_Format) seal(key, value []byte) ([]byte, bool, error) {
+    if format.cipher == nil || len(value) == 0 {
+        return value, false, nil
+    }
+    sealed, err := format.cipher.seal(key, value)
+    if err != nil {
+        return nil, false, err
+    }
+    return sealed, true, nil
+}
+
+// 解密键值，encrypted表示键值是否已加密
+func (format *_Format) open(key, value []byte, encrypted bool) ([]byte, error) {
+    if !encrypted || len(value) == 0 {
+        return value, nil
+    }
+    if format.cipher == nil {
+        return nil, ErrNoKeyProvider
+    }
+    return format.cipher.open(key, value)
+}
+
+// 获取加密键值的密钥编号，未加密时返回-1
+func sealedKeyID(value []byte, encrypted bool) int64 {
+    if !encrypted || len(value) < gCIPHER_KEYID_SIZE {
+        return -1
+    }
+    return int64(binary.BigEndian.Uint32(value))
+}
+
+// 判断数据文件中的记录是否与当前的加密设置一致(未开启加密时记录未加密，开启加密时使用当前密钥加密)
+func (format *_Format) isCurrent(keyid int64) bool {
+    if format.cipher == nil {
+        return keyid < 0
+    }
+    return !format.cipher.stale(keyid)
+}
+
+// 开启加密时将被替换或者删除的旧数据记录清零(内部调用，调用方加锁)，
+// 避免未加密或者使用旧密钥加密的键值残留在数据文件的碎片中，清零失败不影响写入结果
+func (table *Table) wipeStaleData(record *_Record) {
+    if table.db.format.cipher == nil || record.data.end <= 0 || table.db.format.isCurrent(record.data.keyid) {
+        return
+    }
+    pf, err := table.getDataFilePointer()
+    if err == nil {
+        defer pf.Close()
+        _, err = pf.WriteAt(make([]byte, record.data.cap), record.data.start)
+    }
+    if err != nil {
+        table.db.logger().Warnf("wiping stale data of table %s error: %v", table.name, err)
+    }
+}
+
+// 在后台使用KeyProvider当前的密钥重新加密数据文件中的所有数据(包括开启加密之前写入的未加密数据)，
+// 重新加密通过原子操作写入(不会覆盖并发写入的数据)，完成后触发EventKeyRotated事件(Size为重新加密的记录数量)；
+// 重新加密完成之前旧的密钥需要保持可用，同一时间只能有一个重新加密任务
+func (db *DB) RotateKey() error {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    if db.closed.Val() {
+        return ErrClosed
+    }
+    if db.readonly {
+        return ErrReadOnly
+    }
+    if db.format.cipher == nil {
+        return ErrNoKeyProvider
+    }
+    if !atomic.CompareAndSwapInt32(&db.rotating, 0, 1) {
+        return errors.New("key rotation already in progress")
+    }
+    db.wg.Add(1)
+    go func() {
+        defer db.wg.Done()
+        defer atomic.StoreInt32(&db.rotating, 0)
+        count, err := db.rotate()
+        if err != nil {
+            db.logger().Errorf("key rotation error: %v", err)
+        } else {
+            db.logger().Infof("key rotation finished, %d records re-encrypted", count)
+        }
+        db.emit(Event{Type: EventKeyRotated, Size: count, Err: err})
+    }()
+    return nil
+}
+
+// 重新加密所有数据表中需要重新加密的记录，返回重新加密的记录数量，数据库关闭时停止
+func (db *DB) rotate() (int64, error) {
+    count := int64(0)
+    for _, name := range db.getTableNames() {
+        table, err := db.table(name)
+        if err != nil {
+            return count, err
+        }
+        // 按照索引分区分段遍历，遍历时持有数据表读锁，因此先收集需要重新加密的数据，释放读锁之后再写入
+        for start := 0; start < gDEFAULT_PART_SIZE; start += gROTATE_PARTITION_STEP {
+            if db.closed.Val() {
+                return count, ErrClosed
+            }
+            items := make(map[string][]byte)
+            err   := table.iterateRange(context.Background(), start, gROTATE_PARTITION_STEP, func(key, value []byte, keyid int64) bool {
+                if db.format.cipher.stale(keyid) {
+                    items[string(key)] = value
+                }
+                return true
+            })
+            if err != nil {
+                return count, err
+            }
+            for k, v := range items {
+                // 数据已被修改时新的数据已使用当前密钥加密，不需要重新写入
+                // 通过内部事务写入，索引表也需要重新加密
+                ok  := false
+                err := table.atomic(func(tx *Transaction) (err error) {
+                    tx.internal = true
+                    ok, err     = tx.CompareAndSwap([]byte(k), v, v)
+                    return
+                })
+                if err != nil {
+                    return count, err
+                }
+                if ok {
+                    count++
+                }
+            }
+        }
+    }
+    return count, nil
+}
@@ -0,0 +1,194 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 测试使用的密钥提供接口
+type testKeyProvider struct {
+    mu      sync.Mutex
+    current uint32
+    keys    map[uint32][]byte
+}
+
+func newTestKeyProvider(id uint32, key []byte) *testKeyProvider {
+    return &testKeyProvider{current : id, keys : map[uint32][]byte{id : key}}
+}
+
+func (p *testKeyProvider) CurrentKey() (uint32, []byte, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.current, p.keys[p.current], nil
+}
+
+func (p *testKeyProvider) Key(id uint32) ([]byte, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if key, ok := p.keys[id]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("key %d not found", id)
+}
+
+// 添加新的密钥并作为当前密钥，旧密钥保留用于解密
+func (p *testKeyProvider) rotate(id uint32, key []byte) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.keys[id] = key
+    p.current  = id
+}
+
+// 数据库目录下是否有文件包含指定的内容
+func filesContain(fs gvfs.FS, dir string, content []byte) bool {
+    infos, _ := fs.ReadDir(dir)
+    for _, info := range infos {
+        if buffer, _ := gvfs.ReadFile(fs, dir + "/" + info.Name()); bytes.Contains(buffer, content) {
+            return true
+        }
+    }
+    return false
+}
+
+func TestEncryption(t *testing.T) {
+    fs     := gvfs.NewMemFS()
+    secret := []byte("TOP-SECRET-VALUE")
+    keys   := newTestKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    db, err := New("/db", Options{FS : fs, KeyProvider : keys, TxSpillSize : 256})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("t")
+    // binlog、事务落盘文件及数据文件中的键值都是加密的
+    db.binlog.smu.Lock()
+    table.Set([]byte("enc"), secret)
+    inBinlog := filesContain(fs, "/db", secret)
+    db.binlog.smu.Unlock()
+    if inBinlog {
+        t.Fatal("plaintext value found in binlog")
+    }
+    tx := db.Begin("t")
+    for i := 0; i < 30; i++ {
+        tx.Set([]byte(fmt.Sprintf("s%d", i)), append(bytes.Repeat([]byte("y"), 20), secret...))
+    }
+    if tx.spill == nil {
+        t.Fatal("transaction was not spilled")
+    }
+    if filesContain(fs, "/db", secret) {
+        t.Fatal("plaintext value found in spill file")
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if v := table.Get([]byte("s29")); !bytes.HasSuffix(v, secret) {
+        t.Fatalf("got %q", v)
+    }
+    db.Close()
+    if filesContain(fs, "/db", secret) {
+        t.Fatal("plaintext value found in data files")
+    }
+
+    // 没有密钥或者密钥错误时读取失败
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ = db.Table("t")
+    if _, err := table.GetCtx(context.Background(), []byte("enc")); err != ErrNoKeyProvider {
+        t.Fatalf("read without key provider: %v", err)
+    }
+    db.Close()
+    db, err = New("/db", Options{FS : fs, KeyProvider : newTestKeyProvider(1, bytes.Repeat([]byte{9}, 32))})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ = db.Table("t")
+    if _, err := table.GetCtx(context.Background(), []byte("enc")); err != ErrDecrypt {
+        t.Fatalf("read with wrong key: %v", err)
+    }
+    db.Close()
+}
+
+func TestEncryptionRotateKey(t *testing.T) {
+    fs     := gvfs.NewMemFS()
+    secret := []byte("TOP-SECRET-VALUE")
+    // 开启加密之前写入的未加密数据
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("t")
+    table.Set([]byte("plain"), secret)
+    db.Close()
+    if !filesContain(fs, "/db", secret) {
+        t.Fatal("value should be written as plaintext without key provider")
+    }
+
+    keys    := newTestKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    events  := make(chan Event, 1)
+    options := Options {
+        FS          : fs,
+        KeyProvider : keys,
+        OnEvent     : func(event Event) {
+            if event.Type == EventKeyRotated {
+                events <- event
+            }
+        },
+    }
+    db, err = New("/db", options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ = db.Table("t")
+    if v := table.Get([]byte("plain")); !bytes.Equal(v, secret) {
+        t.Fatalf("plaintext value: got %q", v)
+    }
+    for i := 0; i < 20; i++ {
+        table.Set([]byte(fmt.Sprintf("k%d", i)), secret)
+    }
+    db.binlog.sync()
+    // 重新加密开启加密之前的数据以及使用旧密钥加密的数据
+    keys.rotate(2, bytes.Repeat([]byte{2}, 16))
+    if err := db.RotateKey(); err != nil {
+        t.Fatal(err)
+    }
+    select {
+        case event := <- events:
+            if event.Err != nil || event.Size != 21 {
+                t.Fatalf("key rotation: %d records, error %v", event.Size, event.Err)
+            }
+        case <- time.After(20*time.Second):
+            t.Fatal("key rotation timeout")
+    }
+    db.Close()
+    if filesContain(fs, "/db", secret) {
+        t.Fatal("plaintext value found after key rotation")
+    }
+
+    // 重新打开时旧密钥已不可用
+    keys.mu.Lock()
+    delete(keys.keys, 1)
+    keys.mu.Unlock()
+    db, err = New("/db", Options{FS : fs, KeyProvider : keys})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ = db.Table("t")
+    n  := 0
+    err = table.IterateCtx(context.Background(), func(key, value []byte) bool {
+        if !bytes.Equal(value, secret) {
+            t.Fatalf("%s: got %q", key, value)
+        }
+        n++
+        return true
+    })
+    if err != nil || n != 21 {
+        t.Fatalf("iterate after reopen: %d items, error %v", n, err)
+    }
+}
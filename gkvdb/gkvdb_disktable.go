@@ -2,14 +2,17 @@ package gkvdb
 
 import (
     "bytes"
+    "context"
     "errors"
     "github.com/gogf/gf/g/container/gtype"
     "github.com/gogf/gf/g/encoding/gbinary"
     "github.com/gogf/gf/g/os/gcache"
     "github.com/gogf/gf/g/os/gfile"
     "gitee.com/johng/gkvdb/gkvdb/gfilespace"
-    "os"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+    "strconv"
     "sync"
+    "sync/atomic"
 )
 
 // 数据表
@@ -23,6 +26,13 @@ type Table struct {
     memt   *MemTable         // MemTable
     cache  *gcache.Cache     // 缓存管理对象
     closed *gtype.Bool       // 数据库是否关闭，以便异步线程进行判断处理
+
+    compressor *_CompressorEntry // 键值压缩算法，为nil时不压缩
+    count      int64             // 数据文件中的键名数量(原子操作)，-1表示未知(需要重新统计)
+
+    closeOnce   sync.Once      // 保证关闭操作只执行一次
+    closeEvents chan struct{}  // 数据表关闭事件
+    wg          sync.WaitGroup // 后台线程等待组
 }
 
 // 索引项
@@ -50,7 +60,9 @@ type _Data struct {
     cap    int    // 数据允许存放的的最大长度（用以修改对比）
     size   int    // klen + vlen
     klen   int    // 键名大小
-    vlen   int    // 键值大小(byte)
+    vlen   int    // 键值大小(byte)，压缩或者加密时为数据文件中保存的大小
+    flags  int    // 记录标志位
+    keyid  int64  // 加密使用的密钥编号，未加密时为-1
 }
 
 // KV数据检索记录
@@ -65,10 +77,23 @@ type _Record struct {
 
 // 获取数据表对象，如果表名已存在，那么返回已存在的表对象
 func (db *DB) Table(name string) (*Table, error) {
+    if db.closed.Val() {
+        return nil, ErrClosed
+    }
+    return db.table(name)
+}
+
+// 获取数据表对象(内部调用)，binlog同步在数据库关闭过程中仍然需要获取数据表对象
+func (db *DB) table(name string) (*Table, error) {
+    if v := db.tables.Get(name); v != nil {
+        return v.(*Table), nil
+    }
+    // 防止并发创建同一个数据表
+    db.tmu.Lock()
+    defer db.tmu.Unlock()
     if v := db.tables.Get(name); v != nil {
         return v.(*Table), nil
     }
-
     if table, err := db.newTable(name); err == nil {
         return table, nil
     } else {
@@ -80,45 +105,127 @@ func (db *DB) Table(name string) (*Table, error) {
 func (db *DB) newTable(name string) (*Table, error) {
     // 初始化数据表信息
     table := &Table{
-        db     : db,
-        name   : name,
-        closed : gtype.NewBool(),
+        db          : db,
+        name        : name,
+        closed      : gtype.NewBool(),
+        closeEvents : make(chan struct{}),
     }
     table.memt = table.newMemTable()
 
+    // 键值压缩，压缩标志保存在数据记录的标志位中，因此需要格式版本2
+    if cname, ok := db.options.Compressors[name]; ok {
+        if db.format.version < gFORMAT_VERSION_2 {
+            return nil, errors.New("compression requires format version " + strconv.Itoa(gFORMAT_VERSION_2) + ", use Migrate to upgrade the database")
+        }
+        entry, err := getCompressor(cname)
+        if err != nil {
+            return nil, err
+        }
+        table.compressor = &entry
+    }
+
     // 索引/数据文件权限检测
     ixpath := table.getIndexFilePath()
     mtpath := table.getMetaFilePath()
     dbpath := table.getDataFilePath()
-    if gfile.Exists(ixpath) && (!gfile.IsWritable(ixpath) || !gfile.IsReadable(ixpath)){
+    if !db.isFileAccessible(ixpath) {
         return nil, errors.New("permission denied to index file: " + ixpath)
     }
-    if gfile.Exists(mtpath) && (!gfile.IsWritable(mtpath) || !gfile.IsReadable(mtpath)){
+    if !db.isFileAccessible(mtpath) {
         return nil, errors.New("permission denied to meta file: " + mtpath)
     }
-    if gfile.Exists(dbpath) && (!gfile.IsWritable(dbpath) || !gfile.IsReadable(dbpath)){
+    if !db.isFileAccessible(dbpath) {
         return nil, errors.New("permission denied to data file: " + dbpath)
     }
 
     // 数据表缓存对象
     table.cache = gcache.New()
 
-    // 初始化索引文件内容
-    if gfile.Size(ixpath) == 0 {
-        gfile.PutBinContents(ixpath, make([]byte, gINDEX_BUCKET_SIZE*gDEFAULT_PART_SIZE))
+    // 上次正常关闭时保存的键名数量，读写模式下打开后立即标记为非正常关闭
+    table.count = table.loadCount()
+    if !db.readonly {
+        if err := table.saveCount(table.count, false); err != nil {
+            return nil, err
+        }
+    }
+
+    // 只读模式下不修改任何文件，不开启后台线程，碎片信息同步计算(仅用于遍历时过滤碎片)
+    if db.readonly {
+        table.mtsp = gfilespace.New()
+        table.dbsp = gfilespace.New()
+        table.mu.Lock()
+        table.recountFileSpace()
+    } else {
+        // 初始化索引文件内容
+        if gvfs.Size(db.fs, ixpath) == 0 {
+            gvfs.WriteFile(db.fs, ixpath, make([]byte, gINDEX_BUCKET_SIZE*gDEFAULT_PART_SIZE), 0755)
+        }
+        // 初始化相关服务
+        table.initFileSpace()
+        table.wg.Add(1)
+        go table.startAutoCompactingLoop()
     }
-    // 初始化相关服务
-    table.initFileSpace()
-    go table.startAutoCompactingLoop()
 
+    // 只读模式下重新打开已关闭的数据表，继续使用原memtable中binlog未同步的数据
+    if m, ok := db.memts[name]; ok {
+        m.table    = table
+        table.memt = m
+        delete(db.memts, name)
+    }
     // 保存数据表对象指针到全局数据库对象中
     table.db.tables.Set(name, table)
     return table, nil
 }
 
-// 关闭数据库链接，释放资源
-func (table *Table) Close() {
-    table.closed.Set(true)
+// 关闭数据表，将binlog中未同步的数据同步到数据文件，并停止数据表的后台线程；
+// 关闭之后再次获取同名数据表将会重新打开该数据表，已关闭的数据表对象的所有操作都将返回ErrClosed；
+// 只读模式下不同步，binlog中未同步的数据只存在于数据表的memtable中，因此保留memtable，重新打开数据表时继续使用
+func (table *Table) Close() error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    var err error
+    if !table.db.readonly {
+        err = table.db.binlog.sync()
+    }
+    db := table.db
+    db.tmu.Lock()
+    removed := false
+    db.tables.LockFunc(func(m map[string]interface{}) {
+        if v, ok := m[table.name]; ok && v.(*Table) == table {
+            delete(m, table.name)
+            removed = true
+        }
+    })
+    if removed && db.readonly {
+        if db.memts == nil {
+            db.memts = make(map[string]*MemTable)
+        }
+        db.memts[table.name] = table.memt
+    }
+    db.tmu.Unlock()
+    table.close()
+    return err
+}
+
+// 关闭数据表(内部调用)，等待后台线程及正在执行的数据操作结束
+func (table *Table) close() {
+    table.closeOnce.Do(func() {
+        table.closed.Set(true)
+        close(table.closeEvents)
+        table.wg.Wait()
+        table.mu.Lock()
+        table.cache.Close()
+        // 数据表文件不再修改，保存键名数量并标记为正常关闭
+        if !table.db.readonly {
+            if count := atomic.LoadInt64(&table.count); count >= 0 {
+                if err := table.saveCount(count, true); err != nil {
+                    table.db.logger().Errorf("saving key count error: %v", err)
+                }
+            }
+        }
+        table.mu.Unlock()
+    })
 }
 
 // 索引文件
@@ -137,32 +244,80 @@ func (table *Table) getDataFilePath() string {
 }
 
 // 获得索引文件打开指针
-func (table *Table) getIndexFilePointer() (*os.File, error) {
-    return os.OpenFile(table.getIndexFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+func (table *Table) getIndexFilePointer() (gvfs.File, error) {
+    return table.db.openFile(table.getIndexFilePath())
 }
 
 // 获得元数据文件打开指针
-func (table *Table) getMetaFilePointer() (*os.File, error) {
-    return os.OpenFile(table.getMetaFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+func (table *Table) getMetaFilePointer() (gvfs.File, error) {
+    return table.db.openFile(table.getMetaFilePath())
 }
 
 // 获得索引文件打开指针
-func (table *Table) getDataFilePointer() (*os.File, error) {
-    return os.OpenFile(table.getDataFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+func (table *Table) getDataFilePointer() (gvfs.File, error) {
+    return table.db.openFile(table.getDataFilePath())
+}
+
+// 将索引、元数据及数据文件fsync到磁盘
+func (table *Table) fsync() error {
+    for _, open := range []func() (gvfs.File, error) {
+        table.getIndexFilePointer,
+        table.getMetaFilePointer,
+        table.getDataFilePointer,
+    } {
+        pf, err := open()
+        if err != nil {
+            return err
+        }
+        err = pf.Sync()
+        pf.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 查询最新提交的数据，先查询memtable再查询磁盘，存在未合并的合并操作数时进行合并
+func (table *Table) value(key []byte) []byte {
+    value, _ := table.valueCtx(context.Background(), key)
+    return value
+}
+
+// 查询最新提交的数据，等待数据表读锁时响应ctx的取消及超时
+func (table *Table) valueCtx(ctx context.Context, key []byte) ([]byte, error) {
+    if v, ok := table.memt.get(key); ok {
+        return v, nil
+    }
+    if _, _, operands := table.memt.operands(key); operands != nil {
+        return table.mergedCtx(ctx, key)
+    }
+    return table.getCtx(ctx, key)
 }
 
 // 磁盘查询
 func (table *Table) get(key []byte) []byte {
+    value, _ := table.getCtx(context.Background(), key)
+    return value
+}
+
+// 磁盘查询，等待数据表读锁时响应ctx的取消及超时
+func (table *Table) getCtx(ctx context.Context, key []byte) ([]byte, error) {
     ckey := "value_cache_" + string(key)
     if v := table.cache.Get(ckey); v != nil {
-        return v.([]byte)
+        return v.([]byte), nil
+    }
+    if err := lockContext(ctx, table.mu.RLock, table.mu.RUnlock); err != nil {
+        return nil, err
     }
-    table.mu.RLock()
     defer table.mu.RUnlock()
 
-    value, _ := table.getValueByKey(key)
+    value, err := table.getValueByKey(key)
+    if err != nil {
+        return nil, err
+    }
     table.cache.Set(ckey, value, gCACHE_DEFAULT_TIMEOUT)
-    return value
+    return value, nil
 }
 
 // 磁盘保存
@@ -171,23 +326,32 @@ func (table *Table) set(key []byte, value []byte) error {
 
     table.mu.Lock()
     defer table.mu.Unlock()
+    return table.setRecord(key, value)
+}
 
+// 磁盘保存(内部调用，调用方加锁)
+func (table *Table) setRecord(key []byte, value []byte) error {
     // 查询索引信息
     record, err := table.getRecordByKey(key)
     if err != nil {
         return err
     }
 
-    // 值未改变不用重写
-    if record.value != nil && bytes.Compare(value, record.value) == 0 {
+    // 值未改变并且加密设置未改变不用重写
+    if record.value != nil && bytes.Compare(value, record.value) == 0 && table.db.format.isCurrent(record.data.keyid) {
         return nil
     }
 
-    // 写入数据文件，并更新record信息
+    // 写入数据文件，并更新record信息，写入失败时键名数量未知
+    exists      := record.meta.match == 0
     record.value = value
     if err := table.insertDataByRecord(record); err != nil {
+        atomic.StoreInt64(&table.count, -1)
         return errors.New("inserting data error: " + err.Error())
     }
+    if !exists {
+        table.addCount(1)
+    }
     return nil
 }
 
@@ -198,7 +362,11 @@ func (table *Table) remove(key []byte) error {
 
     table.mu.Lock()
     defer table.mu.Unlock()
+    return table.removeRecord(key)
+}
 
+// 磁盘删除(内部调用，调用方加锁)
+func (table *Table) removeRecord(key []byte) error {
     // 查询索引信息
     record, err := table.getRecordByKey(key)
     if err != nil {
@@ -206,66 +374,200 @@ func (table *Table) remove(key []byte) error {
     }
     // 如果找到匹配才执行删除操作
     if record.meta.match == 0 {
-        return table.removeDataByRecord(record)
+        if err := table.removeDataByRecord(record); err != nil {
+            atomic.StoreInt64(&table.count, -1)
+            return err
+        }
+        table.addCount(-1)
     }
     return nil
 }
 
-// 遍历，注意该方法遍历只针对磁盘化后的数据，并且不包括中间binlog数据
+// 磁盘保存合并操作数的合并结果，并在数据表写锁内从memtable中移除已合并的count个合并操作数，
+// 保证读取时数据文件中的键值与memtable中的合并操作数一致
+func (table *Table) setMerged(key []byte, value []byte, count int) error {
+    table.mu.Lock()
+    defer table.mu.Unlock()
+    defer table.cache.Remove("value_cache_" + string(key))
+
+    var err error
+    if len(value) == 0 {
+        err = table.removeRecord(key)
+    } else {
+        err = table.setRecord(key, value)
+    }
+    if err == nil {
+        table.memt.shift(string(key), count)
+    }
+    return err
+}
+
+// 遍历数据表的最新数据(包括memtable中的数据)，f返回false时停止遍历，ctx取消或者超时时停止遍历并返回ctx的错误；
+// memtable中的键名优先，磁盘化后的数据中已存在于memtable的键名会被忽略，已删除的键名不会返回
+func (table *Table) scan(ctx context.Context, f func(key, value []byte) bool) error {
+    return table.scanPaused(ctx, f, nil)
+}
+
+// 遍历数据表的最新数据，与scan相同，pause不为nil时磁盘化后的数据按照第一层索引分区分段遍历，
+// 每遍历一条memtable中的数据以及每遍历一段磁盘化后的数据之后调用pause(此时不持有数据表的锁，可以写入数据表)，
+// pause返回错误时停止遍历并返回该错误；由于键名所在的分区固定，分段遍历不会重复返回同一个键名
+func (table *Table) scanPaused(ctx context.Context, f func(key, value []byte) bool, pause func() error) error {
+    datamap, mergeKeys := table.memt.snapshot()
+    for k, v := range datamap {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if v != nil && !f([]byte(k), v) {
+            return nil
+        }
+        if pause != nil {
+            if err := pause(); err != nil {
+                return err
+            }
+        }
+    }
+    // 存在未合并操作数的键名需要合并之后返回
+    merged := make(map[string]struct{}, len(mergeKeys))
+    for _, k := range mergeKeys {
+        merged[k] = struct{}{}
+        v, err := table.valueCtx(ctx, []byte(k))
+        if err != nil {
+            return err
+        }
+        if v != nil && !f([]byte(k), v) {
+            return nil
+        }
+        if pause != nil {
+            if err := pause(); err != nil {
+                return err
+            }
+        }
+    }
+    stopped := false
+    visit   := func(key, value []byte, keyid int64) bool {
+        if _, ok := datamap[string(key)]; ok {
+            return true
+        }
+        if _, ok := merged[string(key)]; ok {
+            return true
+        }
+        if !f(key, value) {
+            stopped = true
+        }
+        return !stopped
+    }
+    if pause == nil {
+        return table.iterateRange(ctx, 0, gDEFAULT_PART_SIZE, visit)
+    }
+    for start := 0; start < gDEFAULT_PART_SIZE && !stopped; start += gSCAN_PAUSE_PARTS {
+        if err := table.iterateRange(ctx, start, gSCAN_PAUSE_PARTS, visit); err != nil {
+            return err
+        }
+        if err := pause(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 遍历磁盘化后的数据，f返回false时停止遍历，ctx取消或者超时时停止遍历并返回ctx的错误
 // 该遍历会依次按照ix、mt、db文件进行遍历，并检测数据完整性，不完整的数据不会返回
-func (table *Table) items(max int, m map[string][]byte) map[string][]byte {
-    table.mu.RLock()
+func (table *Table) iterate(ctx context.Context, f func(key, value []byte) bool) error {
+    return table.iterateRange(ctx, 0, gDEFAULT_PART_SIZE, func(key, value []byte, keyid int64) bool {
+        return f(key, value)
+    })
+}
+
+// 遍历第一层索引中从start开始的count个分区对应的磁盘化数据，keyid为记录加密使用的密钥编号(未加密时为-1)
+func (table *Table) iterateRange(ctx context.Context, start int, count int, f func(key, value []byte, keyid int64) bool) error {
+    if err := lockContext(ctx, table.mu.RLock, table.mu.RUnlock); err != nil {
+        return err
+    }
     defer table.mu.RUnlock()
 
     mtpf, err := table.getMetaFilePointer()
     if err != nil {
-        return nil
+        return err
     }
     defer mtpf.Close()
 
     dbpf, err := table.getDataFilePointer()
     if err != nil {
-        return nil
+        return err
     }
     defer dbpf.Close()
 
-    ixbuffer := gfile.GetBinContents(table.getIndexFilePath())
-    for i := 0; i < len(ixbuffer); i += gINDEX_BUCKET_SIZE {
-        bits := gbinary.DecodeBytesToBits(ixbuffer[i: i+gINDEX_BUCKET_SIZE])
-        if gbinary.DecodeBits(bits[55: 56]) != 0 {
-            continue
-        }
-        mtindex := int(gbinary.DecodeBits(bits[ 0 : 36]))*gMETA_BUCKET_SIZE
-        mtsize  := int(gbinary.DecodeBits(bits[36 : 55]))*gMETA_ITEM_SIZE
-        // 如果不存在元数据，或者元数据包含在碎片中，那么忽略
-        if mtsize == 0 || table.mtsp.Contains(mtindex, mtsize) {
-            continue
+    format      := table.db.format
+    ixbuffer, _ := gvfs.ReadFile(table.db.fs, table.getIndexFilePath())
+    // 遍历元数据列表中的数据，返回false表示停止遍历
+    var ferr error
+    visit := func(mtindex int, mtsize int) bool {
+        // 如果元数据包含在碎片中，那么忽略
+        if table.mtsp.Contains(mtindex, mtsize) {
+            return true
         }
-        if mtbuffer := gfile.GetBinContentsByTwoOffsets(mtpf, int64(mtindex), int64(mtindex + mtsize)); len(mtbuffer) > 0 {
-            for i := 0; i < len(mtbuffer); i += gMETA_ITEM_SIZE {
-                if table.mtsp.Contains(int(mtindex) + i, gMETA_ITEM_SIZE) {
+        if mtbuffer := getBinContentsByTwoOffsets(mtpf, int64(mtindex), int64(mtindex + mtsize)); len(mtbuffer) > 0 {
+            for i := 0; i < len(mtbuffer); i += format.metaItemSize {
+                if table.mtsp.Contains(int(mtindex) + i, format.metaItemSize) {
                     continue
                 }
-                buffer := mtbuffer[i : i + gMETA_ITEM_SIZE]
-                bits   := gbinary.DecodeBytesToBits(buffer)
-                klen   := int(gbinary.DecodeBits(bits[64 : 72]))
-                vlen   := int(gbinary.DecodeBits(bits[72 : 96]))
+                _, klen, vlen, dbstart := format.decodeMeta(mtbuffer[i : i + format.metaItemSize])
                 if klen > 0 && vlen > 0 {
-                    dbstart := int64(gbinary.DecodeBits(bits[96 : 136]))*gDATA_BUCKET_SIZE
-                    dbend   := dbstart + int64(klen + vlen) + 1
-                    data    := gfile.GetBinContentsByTwoOffsets(dbpf, dbstart, dbend)
-                    keyb    := data[1 : 1 + klen]
-                    key     := string(keyb)
-                    m[key]   = data[1 + klen : ]
-                    if len(m) == max {
-                        return m
+                    dbend := dbstart + int64(format.dataHeadSize + klen + vlen)
+                    data  := getBinContentsByTwoOffsets(dbpf, dbstart, dbend)
+                    if data == nil {
+                        continue
+                    }
+                    flags, _ := format.decodeDataHead(data)
+                    key      := data[format.dataHeadSize : format.dataHeadSize + klen]
+                    value, keyid, err := table.decodeValue(key, data[format.dataHeadSize + klen : ], flags)
+                    if err != nil {
+                        ferr = err
+                        return false
+                    }
+                    if !f(key, value, keyid) {
+                        return false
                     }
                 }
             }
         }
+        return true
+    }
+    if start + count > gDEFAULT_PART_SIZE {
+        count = gDEFAULT_PART_SIZE - start
+    }
+    _, err = table.walkIndex(ixbuffer, start*gINDEX_BUCKET_SIZE, count, func(mtindex int, mtsize int) (bool, error) {
+        if err := ctx.Err(); err != nil {
+            return false, err
+        }
+        return visit(mtindex, mtsize), nil
+    })
+    if err != nil {
+        return err
     }
+    return ferr
+}
 
-    return m
+// 从索引文件内容ixbuffer的start位置开始按照重复分区深度遍历size个索引项，对每一个元数据列表调用f(元数据列表位置及大小)，
+// f返回false时停止遍历；只访问能够从第一层索引查找到的元数据列表，重新分区写入失败时遗留在索引文件末尾的子索引不会被访问
+func (table *Table) walkIndex(ixbuffer []byte, start int, size int, f func(mtindex int, mtsize int) (bool, error)) (bool, error) {
+    format := table.db.format
+    for i := start; i < start + size*gINDEX_BUCKET_SIZE && i + gINDEX_BUCKET_SIZE <= len(ixbuffer); i += gINDEX_BUCKET_SIZE {
+        bits  := gbinary.DecodeBytesToBits(ixbuffer[i : i + gINDEX_BUCKET_SIZE])
+        index := int(gbinary.DecodeBits(bits[ 0 : 36]))
+        count := int(gbinary.DecodeBits(bits[36 : 55]))
+        if count == 0 {
+            continue
+        }
+        if gbinary.DecodeBits(bits[55 : 56]) != 0 {
+            if ok, err := table.walkIndex(ixbuffer, index*gINDEX_BUCKET_SIZE, count, f); !ok {
+                return false, err
+            }
+        } else if ok, err := f(index*format.metaBucketSize, count*format.metaItemSize); !ok {
+            return false, err
+        }
+    }
+    return true, nil
 }
 
 // 获得索引信息，这里涉及到重复分区时索引的深度查找
@@ -279,20 +581,20 @@ func (table *Table) getIndexInfoByRecord(record *_Record) error {
     record.index.start = int64(record.hash64%gDEFAULT_PART_SIZE)*gINDEX_BUCKET_SIZE
     record.index.end   = record.index.start + gINDEX_BUCKET_SIZE
     for {
-        if buffer := gfile.GetBinContentsByTwoOffsets(pf, record.index.start, record.index.end); buffer != nil {
+        if buffer := getBinContentsByTwoOffsets(pf, record.index.start, record.index.end); buffer != nil {
             bits     := gbinary.DecodeBytesToBits(buffer)
             start    := int64(gbinary.DecodeBits(bits[0 : 36]))
             rehashed := uint(gbinary.DecodeBits(bits[55 : 56]))
             if rehashed == 0 {
-                record.meta.start = start*gMETA_BUCKET_SIZE
-                record.meta.size  = int(gbinary.DecodeBits(bits[36 : 55]))*gMETA_ITEM_SIZE
-                record.meta.cap   = getMetaCapBySize(record.meta.size)
+                record.meta.start = start*int64(table.db.format.metaBucketSize)
+                record.meta.size  = int(gbinary.DecodeBits(bits[36 : 55]))*table.db.format.metaItemSize
+                record.meta.cap   = table.db.format.getMetaCapBySize(record.meta.size)
                 record.meta.end   = record.meta.start + int64(record.meta.size)
                 break
             } else {
-                partition          := record.index.size
+                // 子哈希表的分区数与重新分区时计算分区使用的模数一致
                 record.index.size   = int(gbinary.DecodeBits(bits[36 : 55]))
-                record.index.start  = start*gINDEX_BUCKET_SIZE + int64(record.hash64%uint(partition))*gINDEX_BUCKET_SIZE
+                record.index.start  = start*gINDEX_BUCKET_SIZE + int64(record.hash64%uint(record.index.size))*gINDEX_BUCKET_SIZE
                 record.index.end    = record.index.start + gINDEX_BUCKET_SIZE
             }
         } else {
@@ -305,16 +607,22 @@ func (table *Table) getIndexInfoByRecord(record *_Record) error {
 
 // 获得元数据信息，对比hash64和关键字长度
 func (table *Table) getDataInfoByRecord(record *_Record) error {
+    return table.searchDataByRecord(record, true)
+}
+
+// 在元数据列表中二分查找键名，loadValue为false时只读取数据记录头及键名进行对比，不读取键值
+func (table *Table) searchDataByRecord(record *_Record, loadValue bool) error {
     pf, err := table.getMetaFilePointer()
     if err != nil {
         return err
     }
     defer pf.Close()
 
-    if record.meta.buffer = gfile.GetBinContentsByTwoOffsets(pf, record.meta.start, record.meta.end); record.meta.buffer != nil {
+    format := table.db.format
+    if record.meta.buffer = getBinContentsByTwoOffsets(pf, record.meta.start, record.meta.end); record.meta.buffer != nil {
         // 二分查找
         min := 0
-        max := len(record.meta.buffer)/gMETA_ITEM_SIZE - 1
+        max := len(record.meta.buffer)/format.metaItemSize - 1
         mid := 0
         cmp := -2
         for {
@@ -324,9 +632,8 @@ func (table *Table) getDataInfoByRecord(record *_Record) error {
             for {
                 // 首先对比哈希值
                 mid     = int((min + max) / 2)
-                buffer := record.meta.buffer[mid*gMETA_ITEM_SIZE : mid*gMETA_ITEM_SIZE + gMETA_ITEM_SIZE]
-                bits   := gbinary.DecodeBytesToBits(buffer)
-                hash64 := gbinary.DecodeBitsToUint(bits[0 : 64])
+                buffer := record.meta.buffer[mid*format.metaItemSize : mid*format.metaItemSize + format.metaItemSize]
+                hash64, klen, vlen, dbstart := format.decodeMeta(buffer)
                 if record.hash64 < hash64 {
                     max = mid - 1
                     cmp = -1
@@ -335,7 +642,6 @@ func (table *Table) getDataInfoByRecord(record *_Record) error {
                     cmp = 1
                 } else {
                     // 其次对比键名长度
-                    klen := int(gbinary.DecodeBits(bits[64 : 72]))
                     if len(record.key) < klen {
                         max = mid - 1
                         cmp = -1
@@ -344,15 +650,26 @@ func (table *Table) getDataInfoByRecord(record *_Record) error {
                         cmp = 1
                     } else {
                         // 最后对比完整键名
-                        vlen    := int(gbinary.DecodeBits(bits[72 : 96]))
-                        dbstart := int64(gbinary.DecodeBits(bits[96 : 136]))*gDATA_BUCKET_SIZE
-                        dbsize  := klen + vlen + 1
-                        dbend   := dbstart + int64(dbsize)
-                        if data := table.getDataByOffset(dbstart, dbend); data != nil {
+                        dbsize := format.dataHeadSize + klen + vlen
+                        dbend  := dbstart + int64(dbsize)
+                        rdend  := dbend
+                        if !loadValue {
+                            rdend = dbstart + int64(format.dataHeadSize + klen)
+                        }
+                        if data := table.getDataByOffset(dbstart, rdend); data != nil {
                             //fmt.Println(hash64, record.hash64)
-                            //fmt.Println(string(record.key), string(data[1 : 1 + klen]))
-                            if cmp = bytes.Compare(record.key, data[1 : 1 + klen]); cmp == 0 {
-                                record.value       = data[1 + klen:]
+                            //fmt.Println(string(record.key), string(data[format.dataHeadSize : format.dataHeadSize + klen]))
+                            if cmp = bytes.Compare(record.key, data[format.dataHeadSize : format.dataHeadSize + klen]); cmp == 0 {
+                                flags, _ := format.decodeDataHead(data)
+                                if loadValue {
+                                    value, keyid, err := table.decodeValue(record.key, data[format.dataHeadSize + klen:], flags)
+                                    if err != nil {
+                                        return err
+                                    }
+                                    record.value      = value
+                                    record.data.keyid = keyid
+                                }
+                                record.data.flags  = flags
                                 record.data.klen   = klen
                                 record.data.vlen   = vlen
                                 record.data.size   = dbsize
@@ -371,7 +688,7 @@ func (table *Table) getDataInfoByRecord(record *_Record) error {
                 }
             }
         }
-        record.meta.index = mid*gMETA_ITEM_SIZE
+        record.meta.index = mid*format.metaItemSize
         record.meta.match = cmp
     }
     return nil
@@ -379,11 +696,17 @@ func (table *Table) getDataInfoByRecord(record *_Record) error {
 
 // 查询检索信息
 func (table *Table) getRecordByKey(key []byte) (*_Record, error) {
+    return table.searchRecordByKey(key, true)
+}
+
+// 查询键名的检索记录，loadValue为false时不读取键值(record.value为nil)
+func (table *Table) searchRecordByKey(key []byte, loadValue bool) (*_Record, error) {
     record := &_Record {
-        hash64  : uint(getHash64(key)),
+        hash64  : uint(table.db.getHash64(key)),
         key     : key,
     }
     record.meta.match = -2
+    record.data.keyid = -1
 
     // 查询索引信息
     if err := table.getIndexInfoByRecord(record); err != nil {
@@ -392,7 +715,7 @@ func (table *Table) getRecordByKey(key []byte) (*_Record, error) {
 
     // 查询数据信息
     if record.meta.end > 0 {
-        if err := table.getDataInfoByRecord(record); err != nil {
+        if err := table.searchDataByRecord(record, loadValue); err != nil {
             return record, err
         }
     }
@@ -407,7 +730,7 @@ func (table *Table) getDataByOffset(start, end int64) []byte {
             return nil
         }
         defer pf.Close()
-        buffer := gfile.GetBinContentsByTwoOffsets(pf, start, end)
+        buffer := getBinContentsByTwoOffsets(pf, start, end)
         if buffer != nil {
             return buffer
         }
@@ -443,6 +766,7 @@ func (table *Table) removeDataByRecord(record *_Record) error {
         return err
     }
     // 数据删除操作执行成功之后，才将旧数据添加进入碎片管理器
+    table.wipeStaleData(&orecord)
     table.addMtFileSpace(int(orecord.meta.start), orecord.meta.cap)
     table.addDbFileSpace(int(orecord.data.start), orecord.data.cap)
     return nil
@@ -463,9 +787,16 @@ func (table *Table) removeDataFromIx(record *_Record) error {
 
 // 写入一条KV数据
 func (table *Table) insertDataByRecord(record *_Record) error {
+    // 数据文件中保存压缩及加密后的键值
+    value, flags, err := table.encodeValue(record.key, record.value)
+    if err != nil {
+        return err
+    }
+    record.value      = value
+    record.data.flags = flags
     record.data.klen = len(record.key)
     record.data.vlen = len(record.value)
-    record.data.size = record.data.klen + record.data.vlen + 1
+    record.data.size = table.db.format.dataHeadSize + record.data.klen + record.data.vlen
 
     // 保存查询记录对象，以便处理碎片
     orecord := *record
@@ -486,6 +817,7 @@ func (table *Table) insertDataByRecord(record *_Record) error {
     }
 
     // 数据写入操作执行成功之后，才将旧数据添加进入碎片管理器
+    table.wipeStaleData(&orecord)
     table.addMtFileSpace(int(orecord.meta.start), orecord.meta.cap)
     table.addDbFileSpace(int(orecord.data.start), orecord.data.cap)
 
@@ -504,7 +836,7 @@ func (table *Table) saveMeta(slice []byte, buffer []byte, index int, cmp int) []
         // 添加到前面
     } else {
         // 添加到后面
-        pos = index + gMETA_ITEM_SIZE
+        pos = index + table.db.format.metaItemSize
         if pos >= len(slice) {
             pos = len(slice)
         }
@@ -518,7 +850,7 @@ func (table *Table) saveMeta(slice []byte, buffer []byte, index int, cmp int) []
 
 // 删除一项
 func (table *Table) removeMeta(slice []byte, index int) []byte {
-    return append(slice[ : index], slice[index + gMETA_ITEM_SIZE : ]...)
+    return append(slice[ : index], slice[index + table.db.format.metaItemSize : ]...)
 }
 
 // 将数据写入到数据文件中，并更新信息到record
@@ -535,7 +867,7 @@ func (table *Table) saveDataByRecord(record *_Record) error {
 
     // vlen不够vcap的对末尾进行补0占位(便于文件末尾分配空间)
     buffer := make([]byte, 0)
-    buffer  = append(buffer, byte(len(record.key)))
+    buffer  = append(buffer, table.db.format.encodeDataHead(record.data.flags, len(record.key))...)
     buffer  = append(buffer, record.key...)
     buffer  = append(buffer, record.value...)
     for i := 0; i < int(record.data.cap - record.data.size); i++ {
@@ -560,19 +892,15 @@ func (table *Table) saveMetaByRecord(record *_Record) error {
     // 当record.value==nil时表示删除，否则表示写入
     if record.value != nil {
         // 二进制打包
-        bits := make([]gbinary.Bit, 0)
-        bits  = gbinary.EncodeBitsWithUint(bits, record.hash64,                    64)
-        bits  = gbinary.EncodeBits(bits, record.data.klen,                          8)
-        bits  = gbinary.EncodeBits(bits, record.data.vlen,                         24)
-        bits  = gbinary.EncodeBits(bits, int(record.data.start/gDATA_BUCKET_SIZE), 40)
+        buffer := table.db.format.encodeMeta(record.hash64, record.data.klen, record.data.vlen, record.data.start)
         // 数据列表打包(判断位置进行覆盖或者插入)
-        record.meta.buffer = table.saveMeta(record.meta.buffer, gbinary.EncodeBitsToBytes(bits), record.meta.index, record.meta.match)
+        record.meta.buffer = table.saveMeta(record.meta.buffer, buffer, record.meta.index, record.meta.match)
         record.meta.size   = len(record.meta.buffer)
     }
 
     if record.meta.size > 0 {
         // 为保证高可用，每一次都是额外分配键值存储空间，重新计算cap
-        record.meta.cap    = getMetaCapBySize(record.meta.size)
+        record.meta.cap    = table.db.format.getMetaCapBySize(record.meta.size)
         record.meta.start  = table.getMtFileSpace(record.meta.cap)
         record.meta.end    = record.meta.start + int64(record.meta.size)
     }
@@ -602,8 +930,8 @@ func (table *Table) saveIndexByRecord(record *_Record) error {
     if record.meta.size > 0 {
         // 添加/修改/部分删除
         bits  := make([]gbinary.Bit, 0)
-        bits   = gbinary.EncodeBits(bits, int(record.meta.start/gMETA_BUCKET_SIZE),   36)
-        bits   = gbinary.EncodeBits(bits, record.meta.size/gMETA_ITEM_SIZE,           19)
+        bits   = gbinary.EncodeBits(bits, int(record.meta.start)/table.db.format.metaBucketSize, 36)
+        bits   = gbinary.EncodeBits(bits, record.meta.size/table.db.format.metaItemSize,         19)
         bits   = gbinary.EncodeBits(bits, 0,                                           1)
         buffer = gbinary.EncodeBitsToBytes(bits)
     } else {
@@ -619,7 +947,8 @@ func (table *Table) saveIndexByRecord(record *_Record) error {
 
 // 对数据库对应元数据列表进行重复分区
 func (table *Table) checkDeepRehash(record *_Record) error {
-    if record.meta.size < gMAX_META_LIST_SIZE {
+    format := table.db.format
+    if record.meta.size < format.maxMetaListSize {
         return nil
     }
     // 计算新创建的子哈希表的分区数，保证数据散列(分区后在同一请求处理中不再进行二次分区)
@@ -627,16 +956,15 @@ func (table *Table) checkDeepRehash(record *_Record) error {
     pmap := make(map[int][]byte)
     done := true
     for {
-        for i := 0; i < record.meta.size; i += gMETA_ITEM_SIZE {
-            buffer := record.meta.buffer[i : i + gMETA_ITEM_SIZE]
-            bits   := gbinary.DecodeBytesToBits(buffer)
-            hash64 := gbinary.DecodeBitsToUint(bits[0 : 64])
-            part   := int(hash64%uint(size))
+        for i := 0; i < record.meta.size; i += format.metaItemSize {
+            buffer          := record.meta.buffer[i : i + format.metaItemSize]
+            hash64, _, _, _ := format.decodeMeta(buffer)
+            part            := int(hash64%uint(size))
             if _, ok := pmap[part]; !ok {
                 pmap[part] = make([]byte, 0)
             }
             pmap[part] = append(pmap[part], buffer...)
-            if len(pmap[part]) == gMAX_META_LIST_SIZE {
+            if len(pmap[part]) == format.maxMetaListSize {
                 done = false
                 pmap = make(map[int][]byte)
                 size++
@@ -653,7 +981,7 @@ func (table *Table) checkDeepRehash(record *_Record) error {
     // 计算元数据大小以便分配空间
     mtsize := 0
     for _, v := range pmap {
-        mtsize += getMetaCapBySize(len(v))
+        mtsize += format.getMetaCapBySize(len(v))
     }
     // 生成写入的索引数据及元数据
     mtstart  := table.getMtFileSpace(mtsize)
@@ -664,10 +992,10 @@ func (table *Table) checkDeepRehash(record *_Record) error {
         part := i
         if v, ok := pmap[part]; ok {
             bits     := make([]gbinary.Bit, 0)
-            bits      = gbinary.EncodeBits(bits, int(tmpstart)/gMETA_BUCKET_SIZE,   36)
-            bits      = gbinary.EncodeBits(bits, len(v)/gMETA_ITEM_SIZE,            19)
-            bits      = gbinary.EncodeBits(bits, 0,                                  1)
-            mtcap    := getMetaCapBySize(len(v))
+            bits      = gbinary.EncodeBits(bits, int(tmpstart)/format.metaBucketSize,   36)
+            bits      = gbinary.EncodeBits(bits, len(v)/format.metaItemSize,            19)
+            bits      = gbinary.EncodeBits(bits, 0,                                      1)
+            mtcap    := format.getMetaCapBySize(len(v))
             tmpstart += int64(mtcap)
             ixbuffer  = append(ixbuffer, gbinary.EncodeBitsToBytes(bits)...)
             mtbuffer  = append(mtbuffer, v...)
@@ -699,7 +1027,9 @@ func (table *Table) checkDeepRehash(record *_Record) error {
     if err != nil {
         return err
     }
-    ixpf.WriteAt(ixbuffer, ixstart)
+    if _, err = ixpf.WriteAt(ixbuffer, ixstart); err != nil {
+        return err
+    }
 
     // 修改老的索引信息
     bits := make([]gbinary.Bit, 0)
@@ -713,5 +1043,6 @@ func (table *Table) checkDeepRehash(record *_Record) error {
     // 操作成功之后才会将旧空间添加进碎片管理
     table.addMtFileSpace(int(record.meta.start), record.meta.cap)
 
+    table.db.emit(Event{Type: EventRehash, Table: table.name, File: "ix", Offset: ixstart, Size: int64(size)})
     return nil
 }
\ No newline at end of file
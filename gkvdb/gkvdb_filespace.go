@@ -3,9 +3,9 @@ package gkvdb
 import (
     "fmt"
     "sync"
-    "github.com/gogf/gf/g/os/gfile"
     "github.com/gogf/gf/g/encoding/gbinary"
     "gitee.com/johng/gkvdb/gkvdb/gfilespace"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
 )
 
 // 初始化碎片管理器
@@ -24,15 +24,23 @@ func (table *Table) initFileSpace() {
 func (table *Table) recountFileSpace() {
     defer table.mu.Unlock()
 
-    mtpf, _ := table.getMetaFilePointer()
+    // 只读模式下数据表文件可能不存在，此时没有任何碎片
+    mtpf, err := table.getMetaFilePointer()
+    if err != nil {
+        return
+    }
     defer mtpf.Close()
 
-    dbpf, _ := table.getDataFilePointer()
+    dbpf, err := table.getDataFilePointer()
+    if err != nil {
+        return
+    }
     defer dbpf.Close()
 
+    format   := table.db.format
     usedmtsp := gfilespace.New()
     useddbsp := gfilespace.New()
-    ixbuffer := gfile.GetBinContents(table.getIndexFilePath())
+    ixbuffer, _ := gvfs.ReadFile(table.db.fs, table.getIndexFilePath())
 
     // 并发计算ix,mt,db文件的使用情况
     var wg sync.WaitGroup
@@ -57,19 +65,15 @@ func (table *Table) recountFileSpace() {
                 if gbinary.DecodeBits(bits[55 : 56]) != 0 {
                     continue
                 }
-                mtindex := int64(gbinary.DecodeBits(bits[0 : 36]))*gMETA_BUCKET_SIZE
-                mtsize  := int(gbinary.DecodeBits(bits[36 : 55]))*gMETA_ITEM_SIZE
+                mtindex := int64(gbinary.DecodeBits(bits[0 : 36]))*int64(format.metaBucketSize)
+                mtsize  := int(gbinary.DecodeBits(bits[36 : 55]))*format.metaItemSize
                 if mtsize > 0 {
-                    mtsp.AddBlock(int(mtindex), getMetaCapBySize(mtsize))
+                    mtsp.AddBlock(int(mtindex), format.getMetaCapBySize(mtsize))
                     // 获取数据列表
-                    if mtbuffer := gfile.GetBinContentsByTwoOffsets(mtpf, mtindex, mtindex + int64(mtsize)); mtbuffer != nil {
-                        for i := 0; i < len(mtbuffer); i += gMETA_ITEM_SIZE {
-                            buffer  := mtbuffer[i : i + gMETA_ITEM_SIZE]
-                            bits    := gbinary.DecodeBytesToBits(buffer)
-                            klen    := int(gbinary.DecodeBits(bits[64 : 72]))
-                            vlen    := int(gbinary.DecodeBits(bits[72 : 96]))
-                            dbcap   := getDataCapBySize(klen + vlen + 1)
-                            dbindex := int64(gbinary.DecodeBits(bits[96 : 136]))*gDATA_BUCKET_SIZE
+                    if mtbuffer := getBinContentsByTwoOffsets(mtpf, mtindex, mtindex + int64(mtsize)); mtbuffer != nil {
+                        for i := 0; i < len(mtbuffer); i += format.metaItemSize {
+                            _, klen, vlen, dbindex := format.decodeMeta(mtbuffer[i : i + format.metaItemSize])
+                            dbcap := getDataCapBySize(format.dataHeadSize + klen + vlen)
                             if dbcap > 0 {
                                 dbsp.AddBlock(int(dbindex), dbcap)
                             }
@@ -115,6 +119,8 @@ func (table *Table) recountFileSpace() {
     if start < int(end) {
         table.dbsp.AddBlock(start, int(end) - start)
     }
+    // 上次没有正常关闭时重新统计键名数量(依赖元数据碎片信息过滤无效的元数据列表)
+    table.diskCount()
 
     //fmt.Println("used mtsp:", usedmtsp.GetAllBlocks())
     //fmt.Println("used dbsp:", useddbsp.GetAllBlocks())
@@ -0,0 +1,134 @@
+package gkvdb
+
+import (
+    "errors"
+    "strconv"
+    "github.com/gogf/gf/g/encoding/gbinary"
+)
+
+const (
+    gFORMAT_VERSION_1  = 1                  // 初始格式，键名长度8bit(255B)
+    gFORMAT_VERSION_2  = 2                  // 变长键名格式，键名长度16bit(64KB)，数据记录及binlog数据项增加标志位
+    gFORMAT_VERSION    = gFORMAT_VERSION_2  // 新建数据库使用的格式版本
+)
+
+const (
+    gBINLOG_FLAG_MERGE     = 0x01           // binlog数据项标志位：键值为合并操作数(格式版本2)
+    gBINLOG_FLAG_ENCRYPTED = 0x02           // binlog数据项标志位：键值已加密(格式版本2)
+    gBINLOG_TX_RESOLVED = 2                 // binlog事务头标志：合并结果(事务编号字段为对应事务在binlog中的开始位置)
+)
+
+// 数据库文件格式，不同的版本对应不同的元数据、数据及binlog数据项结构
+type _Format struct {
+    version         int // 格式版本
+    keyBits         int // 键名长度位数
+    maxKeySize      int // 键名最大长度(byte)
+    metaItemSize    int // 元数据单项大小(byte)
+    metaBucketSize  int // 元数据数据分块大小(byte)
+    maxMetaListSize int // 元数据列表最大大小(byte)
+    dataHeadSize    int // 数据文件记录头大小(byte)
+    binlogHeadSize  int // binlog数据项头大小(byte)
+    maxValueSize    int // 键值最大长度(byte)，开启加密时需要减去加密增加的大小
+
+    cipher *_Cipher // 键值加密器，为nil时不加密
+}
+
+// 根据格式版本获取格式对象
+func getFormat(version int) (*_Format, error) {
+    format := &_Format{ version : version }
+    switch version {
+        case gFORMAT_VERSION_1:
+            format.keyBits        = 8
+            format.dataHeadSize   = 1
+            format.binlogHeadSize = 5
+        case gFORMAT_VERSION_2:
+            format.keyBits        = 16
+            format.dataHeadSize   = 3
+            format.binlogHeadSize = 7
+        default:
+            return nil, errors.New("unsupported format version: " + strconv.Itoa(version))
+    }
+    format.maxKeySize      = 1 << uint(format.keyBits) - 1
+    format.metaItemSize    = (64 + format.keyBits + 24 + 40)/8
+    format.metaBucketSize  = 5*format.metaItemSize
+    format.maxMetaListSize = 65535*format.metaItemSize
+    format.maxValueSize    = gMAX_VALUE_SIZE
+    return format, nil
+}
+
+// 根据元数据的size计算cap
+func (format *_Format) getMetaCapBySize(size int) int {
+    if size > 0 && size%format.metaBucketSize != 0 {
+        return size + format.metaBucketSize - size%format.metaBucketSize
+    }
+    return size
+}
+
+// 元数据项打包
+func (format *_Format) encodeMeta(hash64 uint, klen int, vlen int, dbstart int64) []byte {
+    bits := make([]gbinary.Bit, 0)
+    bits  = gbinary.EncodeBitsWithUint(bits, hash64,                    64)
+    bits  = gbinary.EncodeBits(bits, klen,                  format.keyBits)
+    bits  = gbinary.EncodeBits(bits, vlen,                              24)
+    bits  = gbinary.EncodeBits(bits, int(dbstart/gDATA_BUCKET_SIZE),    40)
+    return gbinary.EncodeBitsToBytes(bits)
+}
+
+// 元数据项解包，返回键名哈希、键名长度、键值长度及数据文件偏移量
+func (format *_Format) decodeMeta(buffer []byte) (hash64 uint, klen int, vlen int, dbstart int64) {
+    bits   := gbinary.DecodeBytesToBits(buffer)
+    offset := 64 + format.keyBits
+    hash64  = gbinary.DecodeBitsToUint(bits[0 : 64])
+    klen    = int(gbinary.DecodeBits(bits[64 : offset]))
+    vlen    = int(gbinary.DecodeBits(bits[offset : offset + 24]))
+    dbstart = int64(gbinary.DecodeBits(bits[offset + 24 : offset + 64]))*gDATA_BUCKET_SIZE
+    return
+}
+
+// 数据记录头打包，格式版本1没有标志位，flags被忽略
+func (format *_Format) encodeDataHead(flags int, klen int) []byte {
+    bits := make([]gbinary.Bit, 0)
+    if format.version >= gFORMAT_VERSION_2 {
+        bits = gbinary.EncodeBits(bits, flags, 8)
+    }
+    bits = gbinary.EncodeBits(bits, klen, format.keyBits)
+    return gbinary.EncodeBitsToBytes(bits)
+}
+
+// 数据记录头解包，返回标志位及键名长度
+func (format *_Format) decodeDataHead(buffer []byte) (flags int, klen int) {
+    bits := gbinary.DecodeBytesToBits(buffer[0 : format.dataHeadSize])
+    if format.version >= gFORMAT_VERSION_2 {
+        flags = int(gbinary.DecodeBits(bits[0 : 8]))
+    }
+    klen = int(gbinary.DecodeBits(bits[format.dataHeadSize*8 - format.keyBits : ]))
+    return
+}
+
+// binlog数据项头打包，直接追加到buffer末尾，字段均为按字节对齐的大端序，因此不需要按位进行编码；
+// 格式版本1没有标志位，flags被忽略
+func (format *_Format) appendBinLogHead(buffer []byte, flags int, nlen int, klen int, vlen int) []byte {
+    if format.version >= gFORMAT_VERSION_2 {
+        buffer = append(buffer, byte(flags))
+    }
+    buffer = append(buffer, byte(nlen))
+    if format.keyBits > 8 {
+        buffer = append(buffer, byte(klen >> 8))
+    }
+    buffer = append(buffer, byte(klen), byte(vlen >> 16), byte(vlen >> 8), byte(vlen))
+    return buffer
+}
+
+// binlog数据项头解包，返回标志位、表名长度、键名长度及键值长度
+func (format *_Format) decodeBinLogHead(buffer []byte) (flags int, nlen int, klen int, vlen int) {
+    bits   := gbinary.DecodeBytesToBits(buffer[0 : format.binlogHeadSize])
+    offset := 0
+    if format.version >= gFORMAT_VERSION_2 {
+        offset = 8
+        flags  = int(buffer[0])
+    }
+    nlen = int(gbinary.DecodeBits(bits[offset : offset + 8]))
+    klen = int(gbinary.DecodeBits(bits[offset + 8 : offset + 8 + format.keyBits]))
+    vlen = int(gbinary.DecodeBits(bits[offset + 8 + format.keyBits : offset + 8 + format.keyBits + 24]))
+    return
+}
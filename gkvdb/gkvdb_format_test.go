@@ -0,0 +1,169 @@
+package gkvdb
+
+import (
+    "bytes"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+func TestFormatSizes(t *testing.T) {
+    cases := []struct {
+        version, keyBits, maxKeySize, metaItemSize, dataHeadSize, binlogHeadSize int
+    } {
+        {gFORMAT_VERSION_1,  8,   255, 17, 1, 5},
+        {gFORMAT_VERSION_2, 16, 65535, 18, 3, 7},
+    }
+    for _, c := range cases {
+        format, err := getFormat(c.version)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got  := []int{format.keyBits, format.maxKeySize, format.metaItemSize, format.dataHeadSize, format.binlogHeadSize}
+        want := []int{c.keyBits, c.maxKeySize, c.metaItemSize, c.dataHeadSize, c.binlogHeadSize}
+        for i := range got {
+            if got[i] != want[i] {
+                t.Fatalf("version %d: got %v, want %v", c.version, got, want)
+            }
+        }
+        if format.metaBucketSize != 5*c.metaItemSize || format.maxMetaListSize != 65535*c.metaItemSize {
+            t.Fatalf("version %d: unexpected meta sizes %d %d", c.version, format.metaBucketSize, format.maxMetaListSize)
+        }
+    }
+    if _, err := getFormat(3); err == nil {
+        t.Fatal("unsupported format version should fail")
+    }
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+    for _, version := range []int{gFORMAT_VERSION_1, gFORMAT_VERSION_2} {
+        format, _ := getFormat(version)
+        // 元数据项使用各字段的最大值
+        hash    := ^uint(0)
+        dbstart := int64(gMAX_DATA_FILE_SIZE/gDATA_BUCKET_SIZE)*gDATA_BUCKET_SIZE
+        meta    := format.encodeMeta(hash, format.maxKeySize, gMAX_VALUE_SIZE, dbstart)
+        if len(meta) != format.metaItemSize {
+            t.Fatalf("version %d: meta size got %d, want %d", version, len(meta), format.metaItemSize)
+        }
+        h, klen, vlen, start := format.decodeMeta(meta)
+        if h != hash || klen != format.maxKeySize || vlen != gMAX_VALUE_SIZE || start != dbstart {
+            t.Fatalf("version %d: meta got %x %d %d %d", version, h, klen, vlen, start)
+        }
+
+        // 数据记录头，格式版本1没有标志位
+        head := format.encodeDataHead(gDATA_FLAG_COMPRESSED, format.maxKeySize)
+        if len(head) != format.dataHeadSize {
+            t.Fatalf("version %d: data head size got %d, want %d", version, len(head), format.dataHeadSize)
+        }
+        flags, klen := format.decodeDataHead(head)
+        wantFlags   := gDATA_FLAG_COMPRESSED
+        if version == gFORMAT_VERSION_1 {
+            wantFlags = 0
+        }
+        if flags != wantFlags || klen != format.maxKeySize {
+            t.Fatalf("version %d: data head got %d %d", version, flags, klen)
+        }
+
+        // binlog数据项头
+        buffer := format.appendBinLogHead([]byte{0xFF}, gBINLOG_FLAG_MERGE, gMAX_TABLE_SIZE, format.maxKeySize, gMAX_VALUE_SIZE)
+        if len(buffer) != 1 + format.binlogHeadSize || buffer[0] != 0xFF {
+            t.Fatalf("version %d: binlog head size got %d, want %d", version, len(buffer) - 1, format.binlogHeadSize)
+        }
+        flags, nlen, klen, vlen := format.decodeBinLogHead(buffer[1 : ])
+        wantFlags = gBINLOG_FLAG_MERGE
+        if version == gFORMAT_VERSION_1 {
+            wantFlags = 0
+        }
+        if flags != wantFlags || nlen != gMAX_TABLE_SIZE || klen != format.maxKeySize || vlen != gMAX_VALUE_SIZE {
+            t.Fatalf("version %d: binlog head got %d %d %d %d", version, flags, nlen, klen, vlen)
+        }
+    }
+}
+
+func TestLongKeys(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    sizes := []int{255, 256, 1000, 4096, 65535}
+    key   := func(size int) []byte {
+        return bytes.Repeat([]byte{byte('a' + size%26)}, size)
+    }
+    for _, size := range sizes {
+        if err := db.Set(key(size), []byte("v")); err != nil {
+            t.Fatalf("key size %d: %v", size, err)
+        }
+    }
+    if err := db.Set(key(65536), []byte("v")); err == nil {
+        t.Fatal("key over 64KB should fail")
+    }
+    // memtable、数据文件以及重新打开之后都可以读取
+    check := func(stage string) {
+        for _, size := range sizes {
+            if v := db.Get(key(size)); string(v) != "v" {
+                t.Fatalf("%s: key size %d: got %q", stage, size, v)
+            }
+        }
+        if n := len(db.Keys(-1)); n != len(sizes) {
+            t.Fatalf("%s: got %d keys, want %d", stage, n, len(sizes))
+        }
+    }
+    check("memtable")
+    if err := db.binlog.sync(); err != nil {
+        t.Fatal(err)
+    }
+    check("synced")
+    db.Close()
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    check("reopen")
+}
+
+func TestLegacyFormatFile(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    fs.MkdirAll("/db", 0755)
+    gvfs.WriteFile(fs, "/db/" + gFORMAT_FILE_NAME, []byte("1\n"), 0644)
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if db.format.version != gFORMAT_VERSION_1 {
+        t.Fatalf("format version: got %d, want %d", db.format.version, gFORMAT_VERSION_1)
+    }
+    // 早期的格式版本文件被manifest替换
+    if gvfs.Exists(fs, "/db/" + gFORMAT_FILE_NAME) || !gvfs.Exists(fs, "/db/" + gMANIFEST_FILE_NAME) {
+        t.Fatal("format file should be replaced by manifest")
+    }
+    long := bytes.Repeat([]byte("k"), 255)
+    if err := db.Set(long, []byte("v1")); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.Set(append(long, 'k'), []byte("v")); err == nil {
+        t.Fatal("key over 255 bytes should fail in format version 1")
+    }
+    db.Set([]byte("k"), []byte("v"))
+    db.binlog.sync()
+    // 未同步的写入只保存在binlog中，复制文件模拟进程异常退出，重新打开时按照格式版本1重放binlog
+    db.binlog.smu.Lock()
+    db.Set([]byte("unsynced"), []byte("v"))
+    crashed := copyMemFS(fs)
+    db.binlog.smu.Unlock()
+    db.Close()
+
+    db, err = New("/db", Options{FS : crashed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if db.format.version != gFORMAT_VERSION_1 {
+        t.Fatalf("format version after reopen: got %d, want %d", db.format.version, gFORMAT_VERSION_1)
+    }
+    for k, want := range map[string]string{string(long) : "v1", "k" : "v", "unsynced" : "v"} {
+        if v := db.Get([]byte(k)); string(v) != want {
+            t.Fatalf("got %q, want %q", v, want)
+        }
+    }
+}
@@ -0,0 +1,86 @@
+package gkvdb
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "strconv"
+    "sync"
+    "github.com/gogf/gf/g/encoding/ghash"
+    "gitee.com/johng/gkvdb/gkvdb/ghash64"
+)
+
+// 键名哈希函数
+type HashFunc func(key []byte) uint64
+
+// 哈希函数注册项
+type _HashEntry struct {
+    seedSize int                          // 种子大小(byte)，为0表示不需要种子
+    create   func(seed []byte) HashFunc   // 根据种子创建哈希函数
+}
+
+var (
+    hashMu      sync.RWMutex
+    hashEntries = map[string]_HashEntry {
+        "bkdr64"   : { 0, func(seed []byte) HashFunc {
+            return ghash.BKDRHash64
+        }},
+        "xxhash64" : { 8, func(seed []byte) HashFunc {
+            s := binary.LittleEndian.Uint64(seed)
+            return func(key []byte) uint64 {
+                return ghash64.XXHash64(key, s)
+            }
+        }},
+        "siphash"  : {16, func(seed []byte) HashFunc {
+            k0 := binary.LittleEndian.Uint64(seed[0 : 8])
+            k1 := binary.LittleEndian.Uint64(seed[8 : 16])
+            return func(key []byte) uint64 {
+                return ghash64.SipHash(key, k0, k1)
+            }
+        }},
+    }
+)
+
+// 注册自定义的键名哈希函数，seedSize为种子大小(byte)，不需要种子时为0；
+// 哈希函数名称会记录到数据库的manifest中，打开该数据库前必须注册同名的哈希函数；
+// 同一名称的哈希函数只能注册一次(包括内置的bkdr64、xxhash64、siphash)，重复注册时panic
+func RegisterHash(name string, seedSize int, create func(seed []byte) HashFunc) {
+    hashMu.Lock()
+    defer hashMu.Unlock()
+    if _, ok := hashEntries[name]; ok {
+        panic("gkvdb: hash function " + name + " already registered")
+    }
+    hashEntries[name] = _HashEntry{seedSize, create}
+}
+
+// 根据哈希函数名称及种子创建哈希函数
+func newHashFunc(name string, seed []byte) (HashFunc, error) {
+    hashMu.RLock()
+    entry, ok := hashEntries[name]
+    hashMu.RUnlock()
+    if !ok {
+        return nil, errors.New("unsupported hash function: " + name)
+    }
+    if len(seed) != entry.seedSize {
+        return nil, errors.New("invalid seed size for hash function " + name + ", should be " + strconv.Itoa(entry.seedSize) + " bytes")
+    }
+    return entry.create(seed), nil
+}
+
+// 为哈希函数生成随机种子，不需要种子的哈希函数返回nil
+func newHashSeed(name string) ([]byte, error) {
+    hashMu.RLock()
+    entry, ok := hashEntries[name]
+    hashMu.RUnlock()
+    if !ok {
+        return nil, errors.New("unsupported hash function: " + name)
+    }
+    if entry.seedSize == 0 {
+        return nil, nil
+    }
+    seed := make([]byte, entry.seedSize)
+    if _, err := rand.Read(seed); err != nil {
+        return nil, err
+    }
+    return seed, nil
+}
@@ -0,0 +1,95 @@
+package gkvdb
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/ghash64"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 调用f并返回panic的信息，没有panic时返回空字符串
+func recoverPanic(f func()) (message string) {
+    defer func() {
+        if r := recover(); r != nil {
+            message = fmt.Sprint(r)
+        }
+    }()
+    f()
+    return
+}
+
+func TestRegisterHashDuplicate(t *testing.T) {
+    create := func(seed []byte) HashFunc {
+        return func(key []byte) uint64 { return 0 }
+    }
+    // 内置的哈希函数不能被替换
+    for _, name := range []string{"bkdr64", "xxhash64", "siphash"} {
+        if msg := recoverPanic(func() { RegisterHash(name, 0, create) }); !strings.Contains(msg, "already registered") {
+            t.Fatalf("registering builtin %s: got panic %q", name, msg)
+        }
+    }
+    RegisterHash("test_hash_dup", 0, create)
+    if msg := recoverPanic(func() { RegisterHash("test_hash_dup", 0, create) }); !strings.Contains(msg, "already registered") {
+        t.Fatalf("registering duplicate name: got panic %q", msg)
+    }
+}
+
+func TestHashOptions(t *testing.T) {
+    fs   := gvfs.NewMemFS()
+    seed := []byte("0123456789abcdef")
+    // 种子大小不正确、哈希函数不存在时创建失败
+    if _, err := New("/bad", Options{FS : fs, Hash : "siphash", HashSeed : seed[0 : 8]}); err == nil {
+        t.Fatal("invalid seed size should fail")
+    }
+    if _, err := New("/bad", Options{FS : fs, Hash : "no_such_hash"}); err == nil {
+        t.Fatal("unknown hash function should fail")
+    }
+
+    db, err := New("/db", Options{FS : fs, Hash : "siphash", HashSeed : seed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if db.manifest.hash != "siphash" || !bytes.Equal(db.manifest.hashSeed, seed) {
+        t.Fatalf("manifest: got %s %x, want siphash %x", db.manifest.hash, db.manifest.hashSeed, seed)
+    }
+    key  := []byte("key")
+    want := ghash64.SipHash(key, 0x3736353433323130, 0x6665646362613938)
+    if h := db.getHash64(key); h != want {
+        t.Fatalf("hash: got %x, want %x", h, want)
+    }
+    for i := 0; i < 100; i++ {
+        db.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+    }
+    db.Close()
+
+    // 重新打开时使用manifest中记录的哈希函数及种子，不需要再指定
+    for _, options := range []Options{{FS : fs}, {FS : fs, Hash : "siphash"}} {
+        db, err = New("/db", options)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(db.manifest.hashSeed, seed) {
+            t.Fatalf("seed after reopen: got %x, want %x", db.manifest.hashSeed, seed)
+        }
+        if v := db.Get([]byte("k42")); string(v) != "v42" {
+            t.Fatalf("got %q, want %q", v, "v42")
+        }
+        db.Close()
+    }
+    // 指定不同的哈希函数时返回错误
+    if _, err := New("/db", Options{FS : fs, Hash : "xxhash64"}); err == nil || !strings.Contains(err.Error(), "mismatch") {
+        t.Fatalf("reopen with another hash function: got %v", err)
+    }
+
+    // 需要种子的哈希函数自动生成随机种子
+    db, err = New("/db2", Options{FS : fs, Hash : "xxhash64"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if len(db.manifest.hashSeed) != 8 || bytes.Equal(db.manifest.hashSeed, make([]byte, 8)) {
+        t.Fatalf("generated seed: got %x", db.manifest.hashSeed)
+    }
+}
@@ -0,0 +1,534 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "sort"
+    "strings"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gINDEX_TABLE_SEPARATOR = "#"        // 索引表名称中数据表名与索引名称的分隔符
+    gINDEX_META_TABLE      = "#indexes" // 记录索引定义，键名为索引表名称，键值为[索引状态(8bit) 索引名称]
+    gINDEX_BACKFILL_BATCH  = 1000       // 回填索引时每个事务处理的键名数量
+    gINDEX_STATE_BUILDING  = 0          // 索引状态：正在回填
+    gINDEX_STATE_READY     = 1          // 索引状态：回填完成
+)
+
+var (
+    // 事务提交时索引读取的数据已被其他事务修改，需要重新计算索引(内部错误，不会返回给调用方)
+    errIndexConflict = errors.New("secondary index conflict")
+)
+
+// 索引字段提取函数，根据键名及键值返回索引值列表(可以为多个)，返回nil表示该数据不被索引；
+// 提取函数必须是确定性的，同样的输入必须返回同样的结果
+type IndexFunc func(key, value []byte) [][]byte
+
+// 索引表中每一个(索引值, 主键)对应一条数据，键名为[索引值长度(uvarint) 索引值 主键]，键值固定为该标识；
+// 数据表的键值写入时只修改对应主键的数据，不同主键的写入互不影响
+var gINDEX_ENTRY_VALUE = []byte{1}
+
+// 二级索引，索引表的键名由索引值及主键组成(见encodeIndexKey)；索引对象创建之后不再修改，状态改变时替换为新的对象
+type _SecondaryIndex struct {
+    name    string    // 索引名称
+    table   string    // 索引表名称
+    extract IndexFunc // 索引字段提取函数，为nil表示重新打开数据库之后还没有重新注册
+    ready   bool      // 是否已回填完成
+}
+
+// 创建二级索引，索引保存在名称为"表名#索引名"的索引表中，创建时回填已有的数据，之后在事务提交时与数据在同一个binlog事务中更新；
+// 索引定义持久化保存，每一次打开数据库之后需要重新调用CreateIndex注册索引字段提取函数(已回填完成的索引不再回填)，
+// 重新注册之前创建了索引的数据表拒绝写入(返回ErrIndexNotRegistered)，保证索引不会遗漏数据的修改；
+// 索引表只能通过索引更新，不能直接写入；索引值保存在索引表的键名中，开启加密时同样不加密
+func (table *Table) CreateIndex(name string, f IndexFunc) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
+    if len(name) == 0 || f == nil {
+        return errors.New("invalid index name or extract function")
+    }
+    if table.db.isIndexTable(table.name) {
+        return errors.New("cannot create index on index table: " + table.name)
+    }
+    index := &_SecondaryIndex {
+        name    : name,
+        table   : table.name + gINDEX_TABLE_SEPARATOR + name,
+        extract : f,
+    }
+    if err := checkTableValid(index.table); err != nil {
+        return err
+    }
+    // 重新打开数据库之后注册持久化保存的索引，否则添加新的索引
+    db := table.db
+    db.imu.Lock()
+    old := db.findIndex(table.name, name)
+    if old != nil && old.extract != nil {
+        db.imu.Unlock()
+        return errors.New("index already exists: " + name)
+    }
+    if old != nil {
+        index.ready = old.ready
+    }
+    db.setIndex(table.name, old, index)
+    db.imu.Unlock()
+
+    // 新的索引先保存索引定义，保存失败时取消注册
+    if old == nil {
+        if err := db.saveIndexState(index, gINDEX_STATE_BUILDING); err != nil {
+            db.imu.Lock()
+            db.setIndex(table.name, index, nil)
+            db.imu.Unlock()
+            return err
+        }
+    }
+    if index.ready {
+        return nil
+    }
+    // 索引注册之后的写入都会更新索引，因此回填与并发的写入可以同时进行；
+    // 回填失败时索引定义保留，需要重新调用CreateIndex继续回填，在此之前数据表拒绝写入
+    if err := table.backfillIndex(index); err != nil {
+        db.imu.Lock()
+        db.setIndex(table.name, index, &_SecondaryIndex{name : index.name, table : index.table})
+        db.imu.Unlock()
+        return err
+    }
+    db.imu.Lock()
+    db.setIndex(table.name, index, &_SecondaryIndex{name : index.name, table : index.table, extract : f, ready : true})
+    db.imu.Unlock()
+    return nil
+}
+
+// 根据索引值查询主键列表(按照主键排序)；查询需要遍历整个索引表(按照前缀匹配)，开销与索引表的大小成正比
+func (table *Table) IndexLookup(name string, value []byte) ([][]byte, error) {
+    return table.IndexLookupCtx(context.Background(), name, value)
+}
+
+// 根据索引值查询主键列表，等待锁时响应ctx的取消及超时
+func (table *Table) IndexLookupCtx(ctx context.Context, name string, value []byte) ([][]byte, error) {
+    // 未重新注册的索引在回填完成之后数据表拒绝写入，因此可以直接查询
+    index := table.db.getIndex(table.name, name)
+    if index == nil {
+        return nil, errors.New("index not found: " + name)
+    }
+    if index.extract == nil && !index.ready {
+        return nil, ErrIndexNotRegistered
+    }
+    if len(value) == 0 {
+        return nil, nil
+    }
+    itable, err := table.db.Table(index.table)
+    if err != nil {
+        return nil, err
+    }
+    // 修改索引表的大事务同步期间等待同步完成，保证大事务整体可见
+    gate := table.db.binlog.readGate(index.table)
+    if err := lockContext(ctx, gate.RLock, gate.RUnlock); err != nil {
+        return nil, err
+    }
+    defer gate.RUnlock()
+    prefix := encodeIndexKey(value, nil)
+    keys   := make([][]byte, 0)
+    err     = itable.scan(ctx, func(key, v []byte) bool {
+        if bytes.HasPrefix(key, prefix) {
+            keys = append(keys, append([]byte(nil), key[len(prefix) : ]...))
+        }
+        return true
+    })
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return bytes.Compare(keys[i], keys[j]) < 0
+    })
+    return keys, nil
+}
+
+// 回填已有数据的索引，回填完成之后保存索引状态
+func (table *Table) backfillIndex(index *_SecondaryIndex) error {
+    db := table.db
+    // 遍历时持有数据表的锁，因此先获取所有键名，再分批写入
+    keys := make([][]byte, 0)
+    err  := table.IterateCtx(context.Background(), func(key, value []byte) bool {
+        keys = append(keys, append([]byte(nil), key...))
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    for start := 0; start < len(keys); start += gINDEX_BACKFILL_BATCH {
+        end := start + gINDEX_BACKFILL_BATCH
+        if end > len(keys) {
+            end = len(keys)
+        }
+        // 读取的主键数据被修改时重试，索引数据已存在时重复写入，因此可以与并发的写入同时进行
+        for {
+            tx := db.Begin(table.name)
+            tx.internal = true
+            if err := tx.backfill(table, index, keys[start : end]); err != nil {
+                return err
+            }
+            if err := tx.Commit(); err != ErrConflict {
+                if err != nil {
+                    return err
+                }
+                break
+            }
+        }
+    }
+    return db.saveIndexState(index, gINDEX_STATE_READY)
+}
+
+// 保存索引定义及状态
+func (db *DB) saveIndexState(index *_SecondaryIndex, state byte) error {
+    tx := db.Begin(gINDEX_META_TABLE)
+    tx.internal = true
+    if err := tx.Set([]byte(index.table), append([]byte{state}, index.name...)); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// 打开数据库时加载持久化保存的索引定义，索引字段提取函数需要通过CreateIndex重新注册
+func (db *DB) loadIndexes() error {
+    if !db.tables.Contains(gINDEX_META_TABLE) && !gvfs.Exists(db.fs, db.path + gfile.Separator + gINDEX_META_TABLE + ".ix") {
+        return nil
+    }
+    table, err := db.table(gINDEX_META_TABLE)
+    if err != nil {
+        return err
+    }
+    indexes := make(map[string][]*_SecondaryIndex)
+    err = table.scan(context.Background(), func(key, value []byte) bool {
+        if len(value) < 2 || !strings.HasSuffix(string(key), gINDEX_TABLE_SEPARATOR + string(value[1 : ])) {
+            db.logger().Errorf("invalid secondary index definition: %s", key)
+            return true
+        }
+        name := string(key[0 : len(key) - len(value)])
+        indexes[name] = append(indexes[name], &_SecondaryIndex {
+            name  : string(value[1 : ]),
+            table : string(key),
+            ready : value[0] == gINDEX_STATE_READY,
+        })
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    db.imu.Lock()
+    db.indexes = indexes
+    db.igen++
+    db.imu.Unlock()
+    return nil
+}
+
+// 将keys对应的数据添加到索引中(内部调用)
+func (tx *Transaction) backfill(table *Table, index *_SecondaryIndex, keys [][]byte) error {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    changes := make(map[string]bool)
+    for _, key := range keys {
+        value, err := tx.read(key, table.name)
+        if err != nil {
+            return err
+        }
+        if value == nil {
+            continue
+        }
+        if err := tx.diffIndex(changes, index, key, nil, value); err != nil {
+            return err
+        }
+    }
+    for k, _ := range changes {
+        if err := tx.set([]byte(k), gINDEX_ENTRY_VALUE, index.table); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 计算事务写入的数据对应的索引修改，并写入事务中(内部调用，调用方加锁)；
+// 读取的已提交数据及索引版本记录到ireads及igen中，提交时检查是否被其他事务修改或者索引是否已被修改，被修改时重新计算
+func (tx *Transaction) updateIndexes() error {
+    tables, gen := tx.db.getIndexedTables()
+    tx.igen = gen
+    if len(tables) == 0 && len(tx.iwrites) == 0 {
+        return nil
+    }
+    // 删除上一次计算的索引修改
+    for name, keys := range tx.iwrites {
+        for _, k := range keys {
+            delete(tx.tables[name], k)
+        }
+    }
+    tx.ireads   = make(map[string]map[string][]byte)
+    tx.iwrites  = make(map[string][]string)
+    changes   := make(map[string]map[string]bool)
+    for name, indexes := range tables {
+        // 内部事务(重新加密等)不修改数据表的键值，不需要计算未注册的索引
+        registered := make([]*_SecondaryIndex, 0, len(indexes))
+        for _, index := range indexes {
+            if index.extract != nil {
+                registered = append(registered, index)
+            }
+        }
+        if len(registered) < len(indexes) && !tx.internal && tx.writes(name) {
+            return ErrIndexNotRegistered
+        }
+        indexes = registered
+        keys := make(map[string]struct{})
+        for k, _ := range tx.tables[name] {
+            keys[k] = struct{}{}
+        }
+        for k, _ := range tx.merges[name] {
+            keys[k] = struct{}{}
+        }
+        if tx.spill != nil {
+            for k, _ := range tx.spill.index[name] {
+                keys[k] = struct{}{}
+            }
+        }
+        if len(keys) == 0 {
+            continue
+        }
+        table, err := tx.db.table(name)
+        if err != nil {
+            return err
+        }
+        for k, _ := range keys {
+            old := table.value([]byte(k))
+            tx.iread(name, k, old)
+            value, ok, err := tx.pending([]byte(k), name)
+            if err != nil {
+                return err
+            }
+            if !ok {
+                if value, err = table.fold([]byte(k), old, tx.merges[name][k]); err != nil {
+                    return err
+                }
+            }
+            for _, index := range indexes {
+                if _, ok := changes[index.table]; !ok {
+                    changes[index.table] = make(map[string]bool)
+                }
+                if err := tx.diffIndex(changes[index.table], index, []byte(k), old, value); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    // 索引数据只与主键相关，不需要读取索引表中已有的数据
+    for name, m := range changes {
+        for k, add := range m {
+            if add {
+                tx.put([]byte(k), gINDEX_ENTRY_VALUE, name)
+            } else {
+                tx.put([]byte(k), nil, name)
+            }
+            tx.iwrites[name] = append(tx.iwrites[name], k)
+        }
+    }
+    return nil
+}
+
+// 计算键名从old修改为value时的索引修改，changes的键名为索引表的键名，键值为是否添加(false表示删除)
+func (tx *Transaction) diffIndex(changes map[string]bool, index *_SecondaryIndex, key, old, value []byte) error {
+    olds := make(map[string]struct{})
+    news := make(map[string]struct{})
+    if old != nil {
+        for _, v := range index.extract(key, old) {
+            olds[string(v)] = struct{}{}
+        }
+    }
+    if value != nil {
+        for _, v := range index.extract(key, value) {
+            news[string(v)] = struct{}{}
+        }
+    }
+    for v, _ := range olds {
+        if _, ok := news[v]; !ok && len(v) > 0 {
+            changes[string(encodeIndexKey([]byte(v), key))] = false
+        }
+    }
+    for v, _ := range news {
+        if _, ok := olds[v]; !ok && len(v) > 0 {
+            k := encodeIndexKey([]byte(v), key)
+            if err := checkKeyValid(k, tx.db.format.maxKeySize); err != nil {
+                return errors.New("invalid value of index " + index.name + ": " + err.Error())
+            }
+            changes[string(k)] = true
+        }
+    }
+    return nil
+}
+
+// 记录计算索引时读取的已提交数据(内部调用，调用方加锁)
+func (tx *Transaction) iread(name, key string, value []byte) {
+    if _, ok := tx.ireads[name]; !ok {
+        tx.ireads[name] = make(map[string][]byte)
+    }
+    tx.ireads[name][key] = value
+}
+
+// 检查计算索引时读取的数据是否已被其他事务修改，以及索引是否已被修改，在binlog写锁内执行；
+// 计算索引之后注册的索引在回填时可能读取不到本事务写入的数据，因此需要按照新的索引重新计算
+func (tx *Transaction) checkIndexReads() error {
+    if tx.igen != tx.db.getIndexGeneration() {
+        return errIndexConflict
+    }
+    for name, m := range tx.ireads {
+        table, err := tx.db.table(name)
+        if err != nil {
+            return err
+        }
+        for k, v := range m {
+            if !bytes.Equal(table.value([]byte(k)), v) {
+                return errIndexConflict
+            }
+        }
+    }
+    return nil
+}
+
+// 获取数据表的指定索引
+func (db *DB) getIndex(table, name string) *_SecondaryIndex {
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    return db.findIndex(table, name)
+}
+
+// 查找数据表的指定索引(内部调用，调用方加锁)
+func (db *DB) findIndex(table, name string) *_SecondaryIndex {
+    for _, index := range db.indexes[table] {
+        if index.name == name {
+            return index
+        }
+    }
+    return nil
+}
+
+// 将数据表的索引old替换为index(内部调用，调用方加写锁)，old为nil时添加，index为nil时删除；
+// 索引列表在修改时复制，已获取的索引列表不受影响，同时递增索引版本
+func (db *DB) setIndex(table string, old *_SecondaryIndex, index *_SecondaryIndex) {
+    db.igen++
+    indexes := make([]*_SecondaryIndex, 0, len(db.indexes[table]) + 1)
+    for _, v := range db.indexes[table] {
+        if v != old {
+            indexes = append(indexes, v)
+        } else if index != nil {
+            indexes = append(indexes, index)
+        }
+    }
+    if old == nil && index != nil {
+        indexes = append(indexes, index)
+    }
+    if db.indexes == nil {
+        db.indexes = make(map[string][]*_SecondaryIndex)
+    }
+    if len(indexes) == 0 {
+        delete(db.indexes, table)
+    } else {
+        db.indexes[table] = indexes
+    }
+}
+
+// 判断数据表是否存在未重新注册的索引
+func (db *DB) hasUnregisteredIndex(name string) bool {
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    for _, index := range db.indexes[name] {
+        if index.extract == nil {
+            return true
+        }
+    }
+    return false
+}
+
+// 获取所有创建了索引的数据表及其索引，以及当前的索引版本
+func (db *DB) getIndexedTables() (map[string][]*_SecondaryIndex, int64) {
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    if len(db.indexes) == 0 {
+        return nil, db.igen
+    }
+    tables := make(map[string][]*_SecondaryIndex, len(db.indexes))
+    for name, indexes := range db.indexes {
+        tables[name] = indexes
+    }
+    return tables, db.igen
+}
+
+// 获取当前的索引版本
+func (db *DB) getIndexGeneration() int64 {
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    return db.igen
+}
+
+// 判断数据表是否为索引表(包括记录索引的数据表)
+func (db *DB) isIndexTable(name string) bool {
+    if name == gINDEX_META_TABLE {
+        return true
+    }
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    for _, indexes := range db.indexes {
+        for _, index := range indexes {
+            if index.table == name {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// 判断数据表是否创建了索引
+func (db *DB) isIndexedTable(name string) bool {
+    db.imu.RLock()
+    defer db.imu.RUnlock()
+    return len(db.indexes[name]) > 0
+}
+
+// 检查数据表是否允许直接写入(索引表只能通过索引更新，存在未重新注册的索引的数据表不能写入)
+func (tx *Transaction) checkWritable(name string) error {
+    if tx.internal {
+        return nil
+    }
+    if tx.db.isIndexTable(name) {
+        return errors.New("cannot write to index table: " + name)
+    }
+    if tx.db.hasUnregisteredIndex(name) {
+        return ErrIndexNotRegistered
+    }
+    return nil
+}
+
+// 判断事务是否写入了数据表(内部调用，调用方加锁)
+func (tx *Transaction) writes(name string) bool {
+    if len(tx.tables[name]) > 0 || len(tx.merges[name]) > 0 {
+        return true
+    }
+    return tx.spill != nil && len(tx.spill.index[name]) > 0
+}
+
+// 索引表键名编码：[索引值长度(uvarint) 索引值 主键]，pk为nil时返回索引值对应的键名前缀
+func encodeIndexKey(value, pk []byte) []byte {
+    buffer := make([]byte, 0, binary.MaxVarintLen32 + len(value) + len(pk))
+    buffer  = appendUvarint(buffer, uint64(len(value)))
+    buffer  = append(buffer, value...)
+    return append(buffer, pk...)
+}
+
+// 将uvarint编码追加到buffer末尾
+func appendUvarint(buffer []byte, v uint64) []byte {
+    var b [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(b[ : ], v)
+    return append(buffer, b[ : n]...)
+}
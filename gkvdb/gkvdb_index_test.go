@@ -0,0 +1,323 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 测试使用的索引字段提取函数，键值格式为"城市:名称"
+func indexCity(key, value []byte) [][]byte {
+    return [][]byte{bytes.SplitN(value, []byte(":"), 2)[0]}
+}
+
+// 查询索引值对应的主键列表，排序后以逗号连接
+func lookupKeys(t *testing.T, table *Table, name, value string) string {
+    keys, err := table.IndexLookup(name, []byte(value))
+    if err != nil {
+        t.Fatalf("lookup %s=%s: %v", name, value, err)
+    }
+    list := make([]string, 0, len(keys))
+    for _, k := range keys {
+        list = append(list, string(k))
+    }
+    sort.Strings(list)
+    return strings.Join(list, ",")
+}
+
+// 检查索引与数据表的数据一致：每一条数据都能通过索引查询到，索引中没有多余的主键
+func checkIndexConsistent(t *testing.T, table *Table, name string) {
+    expected := make(map[string][]string)
+    total    := 0
+    table.Iterate(func(key, value []byte) bool {
+        city := string(indexCity(key, value)[0])
+        expected[city] = append(expected[city], string(key))
+        total++
+        return true
+    })
+    itable, _ := table.db.Table(table.name + gINDEX_TABLE_SEPARATOR + name)
+    indexed   := 0
+    itable.Iterate(func(key, value []byte) bool {
+        indexed++
+        return true
+    })
+    if indexed != total {
+        t.Fatalf("index %s has %d keys, table has %d", name, indexed, total)
+    }
+    for city, keys := range expected {
+        sort.Strings(keys)
+        if got := lookupKeys(t, table, name, city); got != strings.Join(keys, ",") {
+            t.Fatalf("index %s=%s: got %s, want %s", name, city, got, strings.Join(keys, ","))
+        }
+    }
+}
+
+func TestIndexLookupAfterUpdateAndDelete(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    users, _ := db.Table("users")
+    for i := 0; i < 6; i++ {
+        users.Set([]byte(fmt.Sprintf("u%d", i)), []byte(fmt.Sprintf("c%d:n%d", i%2, i)))
+    }
+    if err := users.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    if got := lookupKeys(t, users, "city", "c0"); got != "u0,u2,u4" {
+        t.Fatalf("backfill: got %s", got)
+    }
+    // 修改索引字段、删除数据以及写入新的数据
+    users.Set([]byte("u0"), []byte("c1:n0"))
+    users.Remove([]byte("u2"))
+    users.Set([]byte("u6"), []byte("c2:n6"))
+    if got := lookupKeys(t, users, "city", "c0"); got != "u4" {
+        t.Fatalf("c0: got %s", got)
+    }
+    if got := lookupKeys(t, users, "city", "c1"); got != "u0,u1,u3,u5" {
+        t.Fatalf("c1: got %s", got)
+    }
+    if got := lookupKeys(t, users, "city", "c2"); got != "u6" {
+        t.Fatalf("c2: got %s", got)
+    }
+    // 最后一个主键删除之后索引值被删除
+    users.Remove([]byte("u4"))
+    if got := lookupKeys(t, users, "city", "c0"); got != "" {
+        t.Fatalf("c0 after delete: got %s", got)
+    }
+    // 索引表只能通过索引更新
+    itable, _ := db.Table("users#city")
+    if err := itable.Set([]byte("c9"), []byte("x")); err == nil {
+        t.Fatal("write to index table should fail")
+    }
+    if err := db.NewWriteBatch("users").Put([]byte("u9"), []byte("c9:n9")); err == nil {
+        t.Fatal("write batch to indexed table should fail")
+    }
+    checkIndexConsistent(t, users, "city")
+}
+
+func TestIndexReopenBeforeCreateIndex(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    users, _ := db.Table("users")
+    for i := 0; i < 10; i++ {
+        users.Set([]byte(fmt.Sprintf("u%d", i)), []byte(fmt.Sprintf("c%d:n%d", i%2, i)))
+    }
+    if err := users.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+
+    // 重新打开之后，重新注册索引之前拒绝写入，已回填完成的索引可以查询
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    users, _ = db.Table("users")
+    if err := users.Set([]byte("u0"), []byte("c1:n0")); err != ErrIndexNotRegistered {
+        t.Fatalf("write before CreateIndex: %v", err)
+    }
+    if err := users.Remove([]byte("u1")); err != ErrIndexNotRegistered {
+        t.Fatalf("remove before CreateIndex: %v", err)
+    }
+    if _, err := users.Incr([]byte("u1"), 1); err == nil {
+        t.Fatal("atomic write before CreateIndex should fail")
+    }
+    itable, _ := db.Table("users#city")
+    if err := itable.Set([]byte("c9"), []byte("x")); err == nil {
+        t.Fatal("write to index table before CreateIndex should fail")
+    }
+    if got := lookupKeys(t, users, "city", "c0"); got != "u0,u2,u4,u6,u8" {
+        t.Fatalf("lookup before CreateIndex: got %s", got)
+    }
+    if err := users.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    if err := users.CreateIndex("city", indexCity); err == nil {
+        t.Fatal("duplicate CreateIndex should fail")
+    }
+    if err := users.Set([]byte("u0"), []byte("c1:n0")); err != nil {
+        t.Fatal(err)
+    }
+    if got := lookupKeys(t, users, "city", "c0"); got != "u2,u4,u6,u8" {
+        t.Fatalf("lookup after CreateIndex: got %s", got)
+    }
+    checkIndexConsistent(t, users, "city")
+
+    // 回填没有完成的索引在重新注册时继续回填，在此之前不能查询
+    index := &_SecondaryIndex{name : "name", table : "users#name"}
+    if err := db.saveIndexState(index, gINDEX_STATE_BUILDING); err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+    db, _ = New("/db", Options{FS : fs})
+    defer db.Close()
+    users, _ = db.Table("users")
+    if _, err := users.IndexLookup("name", []byte("n1")); err != ErrIndexNotRegistered {
+        t.Fatalf("lookup of unfinished index: %v", err)
+    }
+    users.CreateIndex("city", indexCity)
+    if err := users.Set([]byte("u1"), []byte("c0:n1")); err != ErrIndexNotRegistered {
+        t.Fatalf("write with unregistered index: %v", err)
+    }
+    name := func(key, value []byte) [][]byte {
+        return [][]byte{bytes.SplitN(value, []byte(":"), 2)[1]}
+    }
+    if err := users.CreateIndex("name", name); err != nil {
+        t.Fatal(err)
+    }
+    if got := lookupKeys(t, users, "name", "n3"); got != "u3" {
+        t.Fatalf("resumed backfill: got %s", got)
+    }
+}
+
+func TestIndexConcurrentBackfill(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    users, _ := db.Table("users")
+    rows := 3*gINDEX_BACKFILL_BATCH
+    for i := 0; i < rows; i++ {
+        users.Set([]byte(fmt.Sprintf("u%d", i)), []byte(fmt.Sprintf("c%d:n%d", i%7, i)))
+    }
+    // 回填期间并发修改、删除及写入数据
+    var wg sync.WaitGroup
+    stop := make(chan struct{})
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := w; ; i += 4 {
+                select {
+                    case <- stop:
+                        return
+                    default:
+                }
+                key := []byte(fmt.Sprintf("u%d", (i*31)%(rows + 500)))
+                if i%5 == 0 {
+                    users.Remove(key)
+                } else {
+                    users.Set(key, []byte(fmt.Sprintf("c%d:w%d", i%11, w)))
+                }
+            }
+        }(w)
+    }
+    err = users.CreateIndex("city", indexCity)
+    close(stop)
+    wg.Wait()
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkIndexConsistent(t, users, "city")
+}
+
+func TestIndexCreateDuringCommit(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    users, _ := db.Table("users")
+    users.Set([]byte("u0"), []byte("c0:n0"))
+    // 事务在创建索引之前计算索引修改，在回填完成之后写入binlog，写入时需要按照新的索引重新计算
+    tx := db.Begin("users")
+    tx.Set([]byte("u0"), []byte("c1:n0"))
+    tx.Set([]byte("u1"), []byte("c1:n1"))
+    if err := tx.updateIndexes(); err != nil {
+        t.Fatal(err)
+    }
+    if err := users.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.binlog.writeByTx(context.Background(), tx); err != errIndexConflict {
+        t.Fatalf("write with stale indexes: got %v, want errIndexConflict", err)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if got := lookupKeys(t, users, "city", "c0"); got != "" {
+        t.Fatalf("c0: got %s", got)
+    }
+    if got := lookupKeys(t, users, "city", "c1"); got != "u0,u1" {
+        t.Fatalf("c1: got %s", got)
+    }
+
+    // 批量写入在创建索引之后不能提交
+    wb := db.NewWriteBatch("orders")
+    wb.Put([]byte("o1"), []byte("c2:n1"))
+    orders, _ := db.Table("orders")
+    if err := orders.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    if err := wb.Commit(); err == nil {
+        t.Fatal("write batch to table indexed after Put should fail")
+    }
+    if orders.Get([]byte("o1")) != nil {
+        t.Fatal("rejected write batch was written")
+    }
+}
+
+func TestIndexConcurrentCreate(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    users, _ := db.Table("users")
+    // 创建索引期间并发写入新的数据，每一次写入都在索引注册前后之间
+    for round := 0; round < 20; round++ {
+        var wg sync.WaitGroup
+        name := fmt.Sprintf("city%d", round)
+        for w := 0; w < 4; w++ {
+            wg.Add(1)
+            go func(w int) {
+                defer wg.Done()
+                for i := 0; i < 50; i++ {
+                    users.Set([]byte(fmt.Sprintf("r%d_w%d_%d", round, w, i)), []byte(fmt.Sprintf("c%d:n%d", i%3, i)))
+                }
+            }(w)
+        }
+        if err := users.CreateIndex(name, indexCity); err != nil {
+            t.Fatal(err)
+        }
+        wg.Wait()
+        checkIndexConsistent(t, users, name)
+    }
+}
+
+func TestIndexManyKeysForOneValue(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    users, _ := db.Table("users")
+    if err := users.CreateIndex("city", indexCity); err != nil {
+        t.Fatal(err)
+    }
+    // 同一个索引值的每一个主键是独立的索引数据，写入时不需要重写主键列表
+    for i := 0; i < 2000; i++ {
+        users.Set([]byte(fmt.Sprintf("u%04d", i)), []byte("same:n"))
+    }
+    users.Set([]byte("u0000"), []byte("other:n"))
+    keys, err := users.IndexLookup("city", []byte("same"))
+    if err != nil || len(keys) != 1999 || string(keys[0]) != "u0001" {
+        t.Fatalf("lookup: %d keys, error %v", len(keys), err)
+    }
+    // 索引值是另一个索引值的前缀时不会匹配
+    if got := lookupKeys(t, users, "city", "sam"); got != "" {
+        t.Fatalf("prefix value: got %s", got)
+    }
+    checkIndexConsistent(t, users, "city")
+}
@@ -0,0 +1,63 @@
+package gkvdb
+
+import (
+    "os"
+    "strconv"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gLOCK_FILE_NAME = "LOCK" // 数据库目录锁文件名称
+)
+
+// 数据库目录锁，防止多个进程同时打开同一个数据库导致数据文件损坏
+type _Lock struct {
+    file *os.File // 锁文件指针，进程持有期间保持打开(非操作系统文件系统为nil)
+}
+
+// 获取锁文件绝对路径
+func (db *DB) getLockFilePath() string {
+    return db.path + gfile.Separator + gLOCK_FILE_NAME
+}
+
+// 对数据库目录加锁，exclusive为true时加独占锁，并将当前进程的PID写入锁文件，以便查看数据库被哪个进程打开；
+// exclusive为false时加共享锁(只读模式)，多个只读进程可以同时打开数据库，锁文件不存在时创建空的锁文件(不写入内容)，
+// 数据库目录不可写导致无法创建锁文件时不加锁并输出警告日志，此时无法阻止其他进程以读写模式打开数据库；
+// 已被其他进程加锁(独占锁与共享锁互斥)时返回ErrLocked；非操作系统文件系统无法跨进程共享，不进行加锁
+func (db *DB) acquireLock(exclusive bool) (*_Lock, error) {
+    if db.fs != gvfs.OS {
+        return &_Lock{}, nil
+    }
+    flag := os.O_RDWR|os.O_CREATE
+    // 共享锁只需要读取权限，不修改锁文件
+    if !exclusive {
+        flag = os.O_RDONLY|os.O_CREATE
+    }
+    file, err := os.OpenFile(db.getLockFilePath(), flag, 0644)
+    if err != nil {
+        if !exclusive && os.IsPermission(err) && !gfile.Exists(db.getLockFilePath()) {
+            db.logger().Warnf("cannot create lock file in read-only mode, database opened without lock: %v", err)
+            return &_Lock{}, nil
+        }
+        return nil, err
+    }
+    if err := flock(file, exclusive); err != nil {
+        file.Close()
+        return nil, err
+    }
+    if exclusive {
+        file.Truncate(0)
+        file.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+    }
+    return &_Lock{file}, nil
+}
+
+// 释放数据库目录锁
+func (lock *_Lock) release() error {
+    if lock.file == nil {
+        return nil
+    }
+    funlock(lock.file)
+    return lock.file.Close()
+}
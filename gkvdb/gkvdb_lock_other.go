@@ -0,0 +1,15 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gkvdb
+
+import "os"
+
+// 当前平台不支持flock，不进行加锁，仅记录打开数据库的进程PID
+func flock(file *os.File, exclusive bool) error {
+    return nil
+}
+
+// 当前平台不支持flock，无需释放
+func funlock(file *os.File) error {
+    return nil
+}
@@ -0,0 +1,178 @@
+package gkvdb
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 数据库目录锁只对操作系统文件系统有效，测试使用临时目录
+func lockTestDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "gkvdb_lock")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dir
+}
+
+func TestLockExclusive(t *testing.T) {
+    dir := lockTestDir(t)
+    defer os.RemoveAll(dir)
+    db, err := New(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := New(dir); err != ErrLocked {
+        t.Fatalf("second open: %v", err)
+    }
+    content, _ := ioutil.ReadFile(dir + "/" + gLOCK_FILE_NAME)
+    if strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+        t.Fatalf("lock file content: %q", content)
+    }
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+    // 关闭之后释放锁，可以重新打开
+    db, err = New(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+}
+
+func TestReadOnly(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 100; i++ {
+        db.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+    }
+    db.binlog.sync()
+    // 未同步到数据文件的数据只保存在binlog中，复制文件模拟进程异常退出
+    db.binlog.smu.Lock()
+    db.Set([]byte("pending"), []byte("yes"))
+    crashed := copyMemFS(fs)
+    db.binlog.smu.Unlock()
+    db.Close()
+    binlog := mustReadFile(t, crashed, "/db/binlog")
+
+    r1, err := OpenReadOnly("/db", Options{FS : crashed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    r2, err := OpenReadOnly("/db", Options{FS : crashed})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v := r1.Get([]byte("pending")); string(v) != "yes" {
+        t.Fatalf("unsynced value: %q", v)
+    }
+    if v := r2.Get([]byte("k5")); string(v) != "v5" {
+        t.Fatalf("synced value: %q", v)
+    }
+    if n := len(r1.Items(-1)); n != 101 {
+        t.Fatalf("items: got %d, want 101", n)
+    }
+    table, _ := r1.Table("t")
+    if err := r1.Set([]byte("a"), []byte("b")); err != ErrReadOnly {
+        t.Fatalf("set: %v", err)
+    }
+    if err := table.Set([]byte("a"), []byte("b")); err != ErrReadOnly {
+        t.Fatalf("table set: %v", err)
+    }
+    if err := r1.Begin().Commit(); err != ErrReadOnly {
+        t.Fatalf("commit: %v", err)
+    }
+    // 只读模式下关闭数据表之后重新打开，binlog中未同步的数据仍然可见
+    def, _ := r1.Table(gDEFAULT_TABLE_NAME)
+    if err := def.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if def.Get([]byte("pending")) != nil || def.Close() != ErrClosed {
+        t.Fatal("closed table still readable in read-only mode")
+    }
+    if def2, _ := r1.Table(gDEFAULT_TABLE_NAME); def2 == def || string(def2.Get([]byte("pending"))) != "yes" {
+        t.Fatal("unsynced value lost after reopening table in read-only mode")
+    }
+    r1.Close()
+    r2.Close()
+    // 只读模式不修改binlog，也不创建数据表文件
+    if !bytes.Equal(mustReadFile(t, crashed, "/db/binlog"), binlog) {
+        t.Fatal("binlog modified in read-only mode")
+    }
+    if _, err := crashed.Stat("/db/t.ix"); err == nil {
+        t.Fatal("table files created in read-only mode")
+    }
+}
+
+func TestReadOnlyLock(t *testing.T) {
+    dir := lockTestDir(t)
+    defer os.RemoveAll(dir)
+    db, err := New(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+    os.Remove(dir + "/" + gLOCK_FILE_NAME)
+    // 锁文件不存在时只读模式创建空的锁文件并加共享锁
+    r, err := OpenReadOnly(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(dir + "/" + gLOCK_FILE_NAME); err != nil || info.Size() != 0 {
+        t.Fatalf("lock file in read-only mode: %v", err)
+    }
+    if _, err := New(dir); err != ErrLocked {
+        t.Fatalf("open while read-only opened without lock file: %v", err)
+    }
+    r.Close()
+
+    // 数据库目录不可写时不加锁打开
+    os.Remove(dir + "/" + gLOCK_FILE_NAME)
+    if os.Geteuid() != 0 {
+        os.Chmod(dir, 0555)
+        r, err = OpenReadOnly(dir)
+        os.Chmod(dir, 0755)
+        if err != nil {
+            t.Fatalf("read-only open of unwritable directory: %v", err)
+        }
+        r.Close()
+    }
+
+    db, _ = New(dir)
+    db.Close()
+    r1, err := OpenReadOnly(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r2, err := OpenReadOnly(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 共享锁与独占锁互斥
+    if _, err := New(dir); err != ErrLocked {
+        t.Fatalf("open while read-only opened: %v", err)
+    }
+    r1.Close()
+    r2.Close()
+    db, err = New(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+}
+
+func mustReadFile(t *testing.T, fs gvfs.FS, path string) []byte {
+    content, err := gvfs.ReadFile(fs, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return content
+}
@@ -0,0 +1,28 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package gkvdb
+
+import (
+    "os"
+    "syscall"
+)
+
+// 对文件加advisory锁(非阻塞)
+func flock(file *os.File, exclusive bool) error {
+    how := syscall.LOCK_SH
+    if exclusive {
+        how = syscall.LOCK_EX
+    }
+    if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+        if err == syscall.EWOULDBLOCK {
+            return ErrLocked
+        }
+        return err
+    }
+    return nil
+}
+
+// 释放文件advisory锁
+func funlock(file *os.File) error {
+    return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,149 @@
+package gkvdb
+
+import (
+    "sync"
+    "time"
+    "github.com/gogf/gf/g/os/glog"
+)
+
+// 日志接口，通过Options.Logger指定数据库的日志输出，默认输出到glog；
+// 需要屏蔽数据库的日志输出时可以使用空实现的Logger
+type Logger interface {
+    Infof(format string, v...interface{})
+    Warnf(format string, v...interface{})
+    Errorf(format string, v...interface{})
+}
+
+// 事件类型
+type EventType int
+
+const (
+    EventCorruption      EventType = iota + 1 // binlog数据损坏，损坏的数据已被忽略(Offset/Size为损坏数据在binlog文件中的位置及大小)
+    EventSyncRetry                            // binlog数据同步到数据文件失败，稍后重试(Err为失败原因)
+    EventFsyncError                           // binlog文件fsync失败(Err为失败原因)
+    EventWriteStall                           // 写入因binlog队列达到上限而阻塞(Duration为阻塞时间)
+    EventRehash                               // 元数据列表达到上限，重新分区(Table为数据表名称，Size为分区数)
+    EventCompactionMoved                      // 数据整理迁移了数据文件或者元数据文件中的数据(Offset/Size为迁移后的位置及释放的空间大小)
+    EventCompactionError                      // 数据整理失败(Err为失败原因)
+    EventKeyRotated                           // 重新加密完成(Size为重新加密的记录数量，Err不为nil表示重新加密失败)
+)
+
+// 数据库事件，通过Options.OnEvent回调通知
+type Event struct {
+    Type     EventType     // 事件类型
+    Table    string        // 相关的数据表名称
+    File     string        // 相关的文件名称(binlog/ix/mt/db)
+    Offset   int64         // 相关的文件位置
+    Size     int64         // 相关的数据大小(byte)
+    Duration time.Duration // 持续时间
+    Err      error         // 相关的错误
+}
+
+// 默认日志输出
+type _GLogger struct {}
+
+func (l _GLogger) Infof(format string, v...interface{}) {
+    glog.Infofln(format, v...)
+}
+
+func (l _GLogger) Warnf(format string, v...interface{}) {
+    glog.Warningfln(format, v...)
+}
+
+func (l _GLogger) Errorf(format string, v...interface{}) {
+    glog.Errorfln(format, v...)
+}
+
+// 事件类型名称
+func (t EventType) String() string {
+    switch t {
+        case EventCorruption:      return "corruption"
+        case EventSyncRetry:       return "sync retry"
+        case EventFsyncError:      return "fsync error"
+        case EventWriteStall:      return "write stall"
+        case EventRehash:          return "rehash"
+        case EventCompactionMoved: return "compaction moved"
+        case EventCompactionError: return "compaction error"
+        case EventKeyRotated:      return "key rotated"
+    }
+    return "unknown"
+}
+
+// 获取数据库的日志输出
+func (db *DB) logger() Logger {
+    if db.options.Logger != nil {
+        return db.options.Logger
+    }
+    return _GLogger{}
+}
+
+// 事件队列，事件在独立的线程中按照触发顺序回调；触发事件时可能持有数据表或者binlog的锁，
+// 因此不在触发事件的线程中回调，避免回调中调用数据库的方法时死锁
+type _EventQueue struct {
+    mu     sync.Mutex
+    cond   *sync.Cond
+    events []Event        // 等待回调的事件
+    closed bool           // 是否已停止回调线程，停止之后的事件在触发事件的线程中回调
+    done   chan struct{}  // 回调线程退出通知
+}
+
+// 通知数据库事件，第一次通知时启动回调线程
+func (db *DB) emit(event Event) {
+    if db.options.OnEvent == nil {
+        return
+    }
+    db.emu.Lock()
+    if db.events == nil {
+        db.events = &_EventQueue{done : make(chan struct{})}
+        db.events.cond = sync.NewCond(&db.events.mu)
+        go db.startEventLoop(db.events)
+    }
+    queue := db.events
+    db.emu.Unlock()
+
+    queue.mu.Lock()
+    if queue.closed {
+        queue.mu.Unlock()
+        db.options.OnEvent(event)
+        return
+    }
+    queue.events = append(queue.events, event)
+    queue.cond.Signal()
+    queue.mu.Unlock()
+}
+
+// 事件回调线程，停止时回调完队列中所有的事件之后退出
+func (db *DB) startEventLoop(queue *_EventQueue) {
+    defer close(queue.done)
+    for {
+        queue.mu.Lock()
+        for len(queue.events) == 0 && !queue.closed {
+            queue.cond.Wait()
+        }
+        events := queue.events
+        queue.events = nil
+        closed := queue.closed
+        queue.mu.Unlock()
+        for _, event := range events {
+            db.options.OnEvent(event)
+        }
+        if closed && len(events) == 0 {
+            return
+        }
+    }
+}
+
+// 停止事件回调线程，等待已触发的事件回调完成
+func (db *DB) stopEvents() {
+    db.emu.Lock()
+    queue := db.events
+    db.emu.Unlock()
+    if queue == nil {
+        return
+    }
+    queue.mu.Lock()
+    queue.closed = true
+    queue.cond.Signal()
+    queue.mu.Unlock()
+    <- queue.done
+}
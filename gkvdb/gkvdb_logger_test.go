@@ -0,0 +1,147 @@
+package gkvdb
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 记录日志输出的Logger
+type recordLogger struct {
+    mu     sync.Mutex
+    warns  []string
+    errors []string
+}
+
+func (l *recordLogger) Infof(format string, v...interface{}) {}
+
+func (l *recordLogger) Warnf(format string, v...interface{}) {
+    l.mu.Lock()
+    l.warns = append(l.warns, fmt.Sprintf(format, v...))
+    l.mu.Unlock()
+}
+
+func (l *recordLogger) Errorf(format string, v...interface{}) {
+    l.mu.Lock()
+    l.errors = append(l.errors, fmt.Sprintf(format, v...))
+    l.mu.Unlock()
+}
+
+// 重新分区时持有数据表的写锁，事件回调中调用数据库的方法不能死锁
+func TestEventCallbackCallsDB(t *testing.T) {
+    var db *DB
+    ready  := make(chan struct{})
+    events := make(chan int, 1000)
+    options := Options {
+        FS      : gvfs.NewMemFS(),
+        Hash    : crashHashName,
+        Logger  : crashLogger{},
+        OnEvent : func(event Event) {
+            if event.Type != EventRehash {
+                return
+            }
+            <- ready
+            // 关闭数据库时触发的事件在数据表关闭之后回调
+            table, err := db.Table(event.Table)
+            if err != nil {
+                return
+            }
+            db.Get([]byte("k0"))
+            events <- table.Len()
+        },
+    }
+    db, err := New("/db", options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    close(ready)
+    // 缩小元数据列表的上限以便触发重新分区
+    db.format.maxMetaListSize = crashMetaItems*db.format.metaItemSize
+    for i := 0; i < 100; i++ {
+        if err := db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    done := make(chan error, 1)
+    go func() { done <- db.binlog.sync() }()
+    select {
+        case err := <- done:
+            if err != nil {
+                t.Fatal(err)
+            }
+        case <- time.After(10*time.Second):
+            t.Fatal("sync blocked by the event callback")
+    }
+    select {
+        case <- events:
+        case <- time.After(10*time.Second):
+            t.Fatal("rehash event not delivered")
+    }
+    // 关闭时等待已触发的事件回调完成
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+    close(events)
+    for n := range events {
+        if n < 0 || n > 100 {
+            t.Fatalf("table len in event callback: got %d", n)
+        }
+    }
+}
+
+// binlog损坏时输出错误日志并按照顺序触发EventCorruption事件
+func TestEventCorruption(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Set([]byte("k"), []byte("v"))
+    path := db.getBinLogFilePath()
+    db.Close()
+
+    // 在binlog文件末尾追加无法解析的数据
+    buffer, err := gvfs.ReadFile(fs, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    start  := int64(len(buffer))
+    buffer  = append(buffer, []byte(strings.Repeat("x", 64))...)
+    if err := gvfs.WriteFile(fs, path, buffer, 0755); err != nil {
+        t.Fatal(err)
+    }
+    var mu sync.Mutex
+    var events []Event
+    logger := &recordLogger{}
+    db, err = New("/db", Options {
+        FS      : fs,
+        Logger  : logger,
+        OnEvent : func(event Event) {
+            mu.Lock()
+            events = append(events, event)
+            mu.Unlock()
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v := db.Get([]byte("k")); string(v) != "v" {
+        t.Fatalf("got %q, want %q", v, "v")
+    }
+    db.Close()
+
+    mu.Lock()
+    defer mu.Unlock()
+    if len(events) != 1 {
+        t.Fatalf("corruption events: got %d, want 1", len(events))
+    }
+    if e := events[0]; e.Type != EventCorruption || e.File != "binlog" || e.Offset != start || e.Size != 64 {
+        t.Fatalf("unexpected event: %+v", e)
+    }
+    if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], "corrupt") {
+        t.Fatalf("unexpected error logs: %v", logger.errors)
+    }
+}
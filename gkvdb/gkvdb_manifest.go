@@ -0,0 +1,244 @@
+package gkvdb
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gMANIFEST_MAGIC     = "GKVDB MANIFEST"  // manifest文件魔数(首行)
+    gMANIFEST_FILE_NAME = "manifest"        // manifest文件名称
+    gFORMAT_FILE_NAME   = "format"          // 早期的格式版本文件名称(仅记录格式版本)
+    gDEFAULT_HASH_NAME  = "bkdr64"          // 默认的键名哈希函数
+)
+
+// 数据库manifest信息，记录数据库文件格式版本、哈希函数及分区/分块参数，
+// 打开数据库时据此判断当前程序是否能够正确读写该数据库
+type _Manifest struct {
+    format          int    // 格式版本
+    hash            string // 键名哈希函数
+    hashSeed        []byte // 哈希函数种子
+    partSize        int    // 哈希表分区大小
+    indexBucketSize int    // 索引文件数据块大小(byte)
+    metaBucketSize  int    // 元数据数据分块大小(byte)
+    dataBucketSize  int    // 数据分块大小(byte)
+}
+
+// 按照指定格式版本及选项创建当前程序使用的manifest
+func newManifest(version int, options Options) (*_Manifest, error) {
+    format, err := getFormat(version)
+    if err != nil {
+        return nil, err
+    }
+    manifest := &_Manifest {
+        format          : version,
+        hash            : options.Hash,
+        hashSeed        : options.HashSeed,
+        partSize        : gDEFAULT_PART_SIZE,
+        indexBucketSize : gINDEX_BUCKET_SIZE,
+        metaBucketSize  : format.metaBucketSize,
+        dataBucketSize  : gDATA_BUCKET_SIZE,
+    }
+    if manifest.hash == "" {
+        manifest.hash = gDEFAULT_HASH_NAME
+    }
+    if len(manifest.hashSeed) == 0 {
+        if manifest.hashSeed, err = newHashSeed(manifest.hash); err != nil {
+            return nil, err
+        }
+    }
+    if _, err := newHashFunc(manifest.hash, manifest.hashSeed); err != nil {
+        return nil, err
+    }
+    return manifest, nil
+}
+
+// manifest文件绝对路径
+func (db *DB) getManifestFilePath() string {
+    return db.path + gfile.Separator + gMANIFEST_FILE_NAME
+}
+
+// 初始化数据库manifest，新建的数据库使用最新的格式版本；
+// 已存在但没有manifest文件的数据库按照早期文件判断格式版本，并补充写入manifest文件(只读模式下不写入)
+func (db *DB) initManifest() (*_Manifest, error) {
+    path := db.getManifestFilePath()
+    if gvfs.Exists(db.fs, path) {
+        content, _    := gvfs.ReadFile(db.fs, path)
+        manifest, err := parseManifest(content)
+        if err != nil {
+            return nil, errors.New("invalid manifest file " + path + ": " + err.Error())
+        }
+        if err := manifest.checkCompatible(); err != nil {
+            return nil, err
+        }
+        if db.options.Hash != "" && db.options.Hash != manifest.hash {
+            return nil, errors.New("hash function mismatch: database uses " + manifest.hash + ", use Migrate to convert it to " + db.options.Hash)
+        }
+        return manifest, nil
+    }
+    version    := gFORMAT_VERSION
+    options    := db.options
+    formatPath := db.path + gfile.Separator + gFORMAT_FILE_NAME
+    existing   := gvfs.Exists(db.fs, formatPath) || db.hasLegacyFiles()
+    if gvfs.Exists(db.fs, formatPath) {
+        content, _ := gvfs.ReadFile(db.fs, formatPath)
+        v, err     := strconv.Atoi(strings.TrimSpace(string(content)))
+        if err != nil {
+            return nil, errors.New("invalid format file: " + formatPath)
+        }
+        version = v
+    } else if existing {
+        version = gFORMAT_VERSION_1
+    }
+    // 没有manifest的已有数据库使用的都是默认的哈希函数
+    if existing {
+        if options.Hash != "" && options.Hash != gDEFAULT_HASH_NAME {
+            return nil, errors.New("hash function mismatch: database uses " + gDEFAULT_HASH_NAME + ", use Migrate to convert it to " + options.Hash)
+        }
+        options.Hash, options.HashSeed = gDEFAULT_HASH_NAME, nil
+    }
+    manifest, err := newManifest(version, options)
+    if err != nil {
+        return nil, err
+    }
+    if db.readonly {
+        return manifest, nil
+    }
+    if err := db.saveManifest(manifest); err != nil {
+        return nil, err
+    }
+    if gvfs.Exists(db.fs, formatPath) {
+        db.fs.Remove(formatPath)
+    }
+    return manifest, nil
+}
+
+// 判断数据库目录下是否存在(无manifest文件的)旧有数据文件
+func (db *DB) hasLegacyFiles() bool {
+    if gvfs.Exists(db.fs, db.getBinLogFilePath()) {
+        return true
+    }
+    return len(db.getTableNames()) > 0
+}
+
+// 获取数据库目录下已存在的所有数据表名称
+func (db *DB) getTableNames() []string {
+    names    := make([]string, 0)
+    files, _ := db.fs.ReadDir(db.path)
+    for _, file := range files {
+        if !file.IsDir() && filepath.Ext(file.Name()) == ".ix" {
+            names = append(names, strings.TrimSuffix(file.Name(), ".ix"))
+        }
+    }
+    return names
+}
+
+// 写入manifest文件，先写临时文件并fsync到磁盘再重命名，保证断电之后manifest文件的完整性
+func (db *DB) saveManifest(manifest *_Manifest) error {
+    path := db.getManifestFilePath()
+    pf, err := db.fs.OpenFile(path + ".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err = pf.Write(manifest.encode()); err == nil {
+        err = pf.Sync()
+    }
+    if e := pf.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        return err
+    }
+    return db.fs.Rename(path + ".tmp", path)
+}
+
+// 检查manifest是否与当前程序兼容
+func (manifest *_Manifest) checkCompatible() error {
+    format, err := getFormat(manifest.format)
+    if err != nil {
+        return errors.New("incompatible database: " + err.Error())
+    }
+    if _, err := newHashFunc(manifest.hash, manifest.hashSeed); err != nil {
+        return errors.New("incompatible database: " + err.Error())
+    }
+    if manifest.partSize        != gDEFAULT_PART_SIZE ||
+       manifest.indexBucketSize != gINDEX_BUCKET_SIZE ||
+       manifest.metaBucketSize  != format.metaBucketSize ||
+       manifest.dataBucketSize  != gDATA_BUCKET_SIZE {
+        return errors.New(fmt.Sprintf(
+            "incompatible database: bucket parameters mismatch, part_size:%d index_bucket_size:%d meta_bucket_size:%d data_bucket_size:%d",
+            manifest.partSize, manifest.indexBucketSize, manifest.metaBucketSize, manifest.dataBucketSize,
+        ))
+    }
+    return nil
+}
+
+// manifest打包，文件内容为魔数及"名称=值"的文本行
+func (manifest *_Manifest) encode() []byte {
+    buffer := bytes.NewBuffer(nil)
+    buffer.WriteString(gMANIFEST_MAGIC + "\n")
+    buffer.WriteString("format=" + strconv.Itoa(manifest.format) + "\n")
+    buffer.WriteString("hash=" + manifest.hash + "\n")
+    if len(manifest.hashSeed) > 0 {
+        buffer.WriteString("hash_seed=" + hex.EncodeToString(manifest.hashSeed) + "\n")
+    }
+    buffer.WriteString("part_size=" + strconv.Itoa(manifest.partSize) + "\n")
+    buffer.WriteString("index_bucket_size=" + strconv.Itoa(manifest.indexBucketSize) + "\n")
+    buffer.WriteString("meta_bucket_size=" + strconv.Itoa(manifest.metaBucketSize) + "\n")
+    buffer.WriteString("data_bucket_size=" + strconv.Itoa(manifest.dataBucketSize) + "\n")
+    return buffer.Bytes()
+}
+
+// manifest解包，无法识别的字段表示该数据库由更新的程序创建，按照不兼容处理
+func parseManifest(content []byte) (*_Manifest, error) {
+    lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+    if len(lines) == 0 || strings.TrimSpace(lines[0]) != gMANIFEST_MAGIC {
+        return nil, errors.New("bad magic number")
+    }
+    manifest := &_Manifest{}
+    for _, line := range lines[1:] {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        array := strings.SplitN(line, "=", 2)
+        if len(array) != 2 {
+            return nil, errors.New("bad line: " + line)
+        }
+        name, value := array[0], array[1]
+        switch name {
+            case "hash":
+                manifest.hash = value
+                continue
+            case "hash_seed":
+                seed, err := hex.DecodeString(value)
+                if err != nil {
+                    return nil, errors.New("bad value: " + line)
+                }
+                manifest.hashSeed = seed
+                continue
+        }
+        number, err := strconv.Atoi(value)
+        if err != nil {
+            return nil, errors.New("bad value: " + line)
+        }
+        switch name {
+            case "format":            manifest.format          = number
+            case "part_size":         manifest.partSize        = number
+            case "index_bucket_size": manifest.indexBucketSize = number
+            case "meta_bucket_size":  manifest.metaBucketSize  = number
+            case "data_bucket_size":  manifest.dataBucketSize  = number
+            default:
+                return nil, errors.New("incompatible database: unknown manifest field: " + name)
+        }
+    }
+    return manifest, nil
+}
@@ -9,6 +9,14 @@ type MemTable struct {
     mu      sync.RWMutex            // 并发互斥锁
     table   *Table                  // 所属数据表
     datamap map[string][]byte       // 键名与事务对象指针的映射，便于通过键名直接查找事务对象，最新的操作会对老的键名进行覆盖
+    merges  map[string]*_MemMerge   // 未合并的合并操作数，同一键名不会同时存在于datamap及merges中
+}
+
+// 内存表中未合并的合并操作数
+type _MemMerge struct {
+    base     []byte   // 合并的基础键值(hasBase为true时有效)
+    hasBase  bool     // 基础键值是否在内存表中，为false时基础键值为数据文件中的键值
+    operands [][]byte // 按照写入顺序排列的合并操作数
 }
 
 // 创建一个MemTable
@@ -16,6 +24,7 @@ func (table *Table) newMemTable() *MemTable {
     return &MemTable {
         table   : table,
         datamap : make(map[string][]byte),
+        merges  : make(map[string]*_MemMerge),
     }
 }
 
@@ -26,6 +35,27 @@ func (mtable *MemTable) set(datamap map[string][]byte) {
 
     for k, v := range datamap {
         mtable.datamap[k] = v
+        delete(mtable.merges, k)
+    }
+}
+
+// 保存事务中的合并操作数，键名在内存表中已有键值时以该键值作为合并的基础键值
+func (mtable *MemTable) merge(merges map[string][][]byte) {
+    mtable.mu.Lock()
+    defer mtable.mu.Unlock()
+
+    for k, operands := range merges {
+        item, ok := mtable.merges[k]
+        if !ok {
+            item = &_MemMerge{}
+            if v, ok := mtable.datamap[k]; ok {
+                item.base    = v
+                item.hasBase = true
+                delete(mtable.datamap, k)
+            }
+            mtable.merges[k] = item
+        }
+        item.operands = append(item.operands, operands...)
     }
 }
 
@@ -44,24 +74,66 @@ func (mtable *MemTable) get(key []byte) ([]byte, bool) {
     return nil, false
 }
 
-// 返回指定大小的键值对列表
-func (mtable *MemTable) items(max int) map[string][]byte {
+// 查询键名未合并的合并操作数，返回基础键值、基础键值是否在内存表中及合并操作数，没有合并操作数时返回nil
+func (mtable *MemTable) operands(key []byte) ([]byte, bool, [][]byte) {
     mtable.mu.RLock()
     defer mtable.mu.RUnlock()
 
-    m := make(map[string][]byte)
-    for k, v := range mtable.datamap {
-        if v != nil {
-            m[k] = v
-            if len(m) == max {
-                break
-            }
+    if item, ok := mtable.merges[string(key)]; ok {
+        operands := make([][]byte, len(item.operands))
+        copy(operands, item.operands)
+        return item.base, item.hasBase, operands
+    }
+    return nil, false, nil
+}
+
+// 数据同步将最早的count个合并操作数合并到数据文件之后，从内存表中移除这些合并操作数；
+// 基础键值在内存表中时，这些合并操作数之后已有新的写入，因此不需要移除
+func (mtable *MemTable) shift(key string, count int) {
+    mtable.mu.Lock()
+    defer mtable.mu.Unlock()
+
+    if item, ok := mtable.merges[key]; ok && !item.hasBase {
+        if count >= len(item.operands) {
+            delete(mtable.merges, key)
+        } else {
+            item.operands = item.operands[count : ]
         }
     }
-    return m
+}
+
+// 返回存在未合并操作数的键名列表
+func (mtable *MemTable) mergeKeys() []string {
+    mtable.mu.RLock()
+    defer mtable.mu.RUnlock()
+
+    keys := make([]string, 0, len(mtable.merges))
+    for k, _ := range mtable.merges {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+// 返回内存表数据的副本(键值为nil表示删除)及存在未合并操作数的键名列表
+func (mtable *MemTable) snapshot() (map[string][]byte, []string) {
+    mtable.mu.RLock()
+    defer mtable.mu.RUnlock()
+
+    m := make(map[string][]byte, len(mtable.datamap))
+    for k, v := range mtable.datamap {
+        m[k] = v
+    }
+    keys := make([]string, 0, len(mtable.merges))
+    for k, _ := range mtable.merges {
+        keys = append(keys, k)
+    }
+    return m, keys
 }
 
 // 同步缓存的binlog数据到底层数据库文件
 func (mtable *MemTable) clear() {
+    mtable.mu.Lock()
     mtable.datamap = make(map[string][]byte)
-}
\ No newline at end of file
+    mtable.merges  = make(map[string]*_MemMerge)
+    mtable.mu.Unlock()
+}
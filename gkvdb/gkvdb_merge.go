@@ -0,0 +1,214 @@
+package gkvdb
+
+import (
+    "context"
+    "errors"
+    "strconv"
+    "sync"
+)
+
+// 合并函数，value为当前键值(键名不存在时为nil)，operands为按照写入顺序排列的合并操作数，返回合并后的键值(nil表示删除)；
+// 合并函数必须是确定性的，同样的输入必须返回同样的结果
+type MergeFunc func(key []byte, value []byte, operands [][]byte) ([]byte, error)
+
+var (
+    mergeMu      sync.RWMutex
+    mergeEntries = map[string]MergeFunc {
+        // 列表追加，将操作数依次追加到键值末尾
+        "append" : func(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+            size := len(value)
+            for _, operand := range operands {
+                size += len(operand)
+            }
+            buffer := make([]byte, 0, size)
+            buffer  = append(buffer, value...)
+            for _, operand := range operands {
+                buffer = append(buffer, operand...)
+            }
+            return buffer, nil
+        },
+        // 计数器累加，键值及操作数均为10进制整数
+        "add"    : func(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+            number := int64(0)
+            if len(value) > 0 {
+                n, err := strconv.ParseInt(string(value), 10, 64)
+                if err != nil {
+                    return nil, errors.New("value is not an integer")
+                }
+                number = n
+            }
+            for _, operand := range operands {
+                n, err := strconv.ParseInt(string(operand), 10, 64)
+                if err != nil {
+                    return nil, errors.New("merge operand is not an integer")
+                }
+                number += n
+            }
+            return []byte(strconv.FormatInt(number, 10)), nil
+        },
+    }
+)
+
+// 注册自定义的合并函数，内置的合并函数有append(列表追加)及add(计数器累加)；
+// 数据表通过Options.MergeOperators指定使用的合并函数名称，打开数据库前必须注册同名的合并函数；
+// 同一名称的合并函数只能注册一次(包括内置的合并函数)，重复注册时panic
+func RegisterMergeOperator(name string, f MergeFunc) {
+    mergeMu.Lock()
+    defer mergeMu.Unlock()
+    if _, ok := mergeEntries[name]; ok {
+        panic("gkvdb: merge operator " + name + " already registered")
+    }
+    mergeEntries[name] = f
+}
+
+// 根据合并函数名称获取合并函数
+func getMergeFunc(name string) (MergeFunc, error) {
+    mergeMu.RLock()
+    f, ok := mergeEntries[name]
+    mergeMu.RUnlock()
+    if !ok {
+        return nil, errors.New("unsupported merge operator: " + name)
+    }
+    return f, nil
+}
+
+// 获取数据表的合并函数
+func (table *Table) getMergeFunc() (MergeFunc, error) {
+    name, ok := table.db.options.MergeOperators[table.name]
+    if !ok {
+        return nil, errors.New("no merge operator for table: " + table.name)
+    }
+    return getMergeFunc(name)
+}
+
+// 使用数据表的合并函数将合并操作数合并到键值中
+func (table *Table) fold(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+    f, err := table.getMergeFunc()
+    if err != nil {
+        return nil, err
+    }
+    result, err := f(key, value, operands)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkValueValid(result, table.db.format.maxValueSize); err != nil {
+        return nil, err
+    }
+    // 合并结果为空时表示删除
+    if len(result) == 0 {
+        return nil, nil
+    }
+    return result, nil
+}
+
+// 查询存在未合并操作数的键名的键值，数据文件中的基础键值与内存表中的合并操作数在数据表读锁内一起读取，
+// 防止数据同步在两次读取之间将合并操作数合并到数据文件导致重复合并
+func (table *Table) mergedCtx(ctx context.Context, key []byte) ([]byte, error) {
+    if err := lockContext(ctx, table.mu.RLock, table.mu.RUnlock); err != nil {
+        return nil, err
+    }
+    defer table.mu.RUnlock()
+
+    if v, ok := table.memt.get(key); ok {
+        return v, nil
+    }
+    base, hasBase, operands := table.memt.operands(key)
+    if !hasBase {
+        base, _ = table.getValueByKey(key)
+    }
+    if operands == nil {
+        return base, nil
+    }
+    value, err := table.fold(key, base, operands)
+    if err != nil {
+        table.db.logger().Errorf("merge error: %v", err)
+        return nil, nil
+    }
+    return value, nil
+}
+
+// 写入合并操作数，操作数在读取或者数据同步时才与当前键值合并，写入时不需要读取当前键值
+func (table *Table) Merge(key, operand []byte) error {
+    if table.closed.Val() {
+        return ErrClosed
+    }
+    if table.db.readonly {
+        return ErrReadOnly
+    }
+    tx := table.db.Begin(table.name)
+    if err := tx.MergeTo(key, operand, table.name); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// 写入合并操作数
+func (tx *Transaction) Merge(key, operand []byte) error {
+    return tx.MergeTo(key, operand, tx.table)
+}
+
+// 写入合并操作数(针对数据表)，键名在事务中已写入时直接与事务中的键值合并
+func (tx *Transaction) MergeTo(key, operand []byte, name string) error {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+    return tx.merge(key, operand, name)
+}
+
+// 写入合并操作数(内部调用，调用方加锁)
+func (tx *Transaction) merge(key, operand []byte, name string) error {
+    if tx.db.readonly {
+        return ErrReadOnly
+    }
+    if tx.db.format.version < gFORMAT_VERSION_2 {
+        return errors.New("merge is not supported by database format version " + strconv.Itoa(tx.db.format.version) + ", use Migrate to upgrade")
+    }
+    if err := checkTableValid(name); err != nil {
+        return err
+    }
+    if err := tx.checkWritable(name); err != nil {
+        return err
+    }
+    if err := checkKeyValid(key, tx.db.format.maxKeySize); err != nil {
+        return err
+    }
+    if err := checkValueValid(operand, tx.db.format.maxValueSize); err != nil {
+        return err
+    }
+    table, err := tx.db.Table(name)
+    if err != nil {
+        return err
+    }
+    if _, err := table.getMergeFunc(); err != nil {
+        return err
+    }
+    // 已落盘的大事务不再保存合并操作数，直接与已提交的键值合并(提交时检查已提交的键值是否被修改)
+    v, ok, err := tx.pending(key, name)
+    if err != nil {
+        return err
+    }
+    if !ok && tx.spill != nil {
+        if v, err = tx.read(key, name); err != nil {
+            return err
+        }
+        ok = true
+    }
+    if ok {
+        value, err := table.fold(key, v, [][]byte{operand})
+        if err != nil {
+            return err
+        }
+        return tx.set(key, value, name)
+    }
+    tx.logUndo(name, string(key))
+    if _, ok := tx.merges[name]; !ok {
+        tx.merges[name] = make(map[string][][]byte)
+    }
+    buffer := make([]byte, len(operand))
+    copy(buffer, operand)
+    tx.merges[name][string(key)] = append(tx.merges[name][string(key)], buffer)
+    tx.bytes += int64(tx.db.format.binlogHeadSize + len(name) + len(key) + len(operand))
+    if tx.bytes >= tx.db.getTxSpillSize() {
+        return tx.spillOut()
+    }
+    return nil
+}
@@ -0,0 +1,141 @@
+package gkvdb
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+func init() {
+    // 测试使用的自定义合并函数，保留最大的键值
+    RegisterMergeOperator("test_max", func(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+        for _, operand := range operands {
+            if bytes.Compare(operand, value) > 0 {
+                value = operand
+            }
+        }
+        return value, nil
+    })
+}
+
+var mergeTestOptions = Options {
+    MergeOperators : map[string]string {
+        "cnt" : "add",
+        "log" : "append",
+        "max" : "test_max",
+    },
+}
+
+func TestMergeAcrossSync(t *testing.T) {
+    options   := mergeTestOptions
+    options.FS = gvfs.NewMemFS()
+    db, err   := New("/db", options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cnt, _ := db.Table("cnt")
+    log, _ := db.Table("log")
+    max, _ := db.Table("max")
+    if err := db.Begin().Merge([]byte("x"), []byte("1")); err == nil {
+        t.Fatal("merge to table without merge operator should fail")
+    }
+    // 一部分操作数同步到数据文件，一部分保留在memtable中，读取时需要与数据文件中的键值合并
+    for i := 0; i < 100; i++ {
+        if i == 50 {
+            db.binlog.sync()
+            if v := cnt.Get([]byte("n")); string(v) != "100" {
+                t.Fatalf("after sync: got %q, want 100", v)
+            }
+            db.binlog.smu.Lock()
+        }
+        if err := cnt.Merge([]byte("n"), []byte("2")); err != nil {
+            t.Fatal(err)
+        }
+        log.Merge([]byte("l"), []byte("a"))
+        max.Merge([]byte("m"), []byte(fmt.Sprintf("%02d", (i*37)%100)))
+    }
+    n, l, m := cnt.Get([]byte("n")), log.Get([]byte("l")), max.Get([]byte("m"))
+    db.binlog.smu.Unlock()
+    if string(n) != "200" || len(l) != 100 || string(m) != "99" {
+        t.Fatalf("unsynced operands: got %q %d %q", n, len(l), m)
+    }
+    db.binlog.sync()
+    if v := cnt.Get([]byte("n")); string(v) != "200" {
+        t.Fatalf("after folding: got %q, want 200", v)
+    }
+
+    // 合并操作数写入已有的键值，以及事务中合并之后读取
+    cnt.Set([]byte("s"), []byte("10"))
+    cnt.Merge([]byte("s"), []byte("1"))
+    tx := db.Begin("cnt")
+    tx.Merge([]byte("n"), []byte("5"))
+    if v, _ := tx.Incr([]byte("n"), 1); v != 206 {
+        t.Fatalf("incr after merge in transaction: got %d, want 206", v)
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if v := cnt.Get([]byte("s")); string(v) != "11" {
+        t.Fatalf("merge on set value: got %q, want 11", v)
+    }
+    if n := len(cnt.Items(-1)); n != 2 {
+        t.Fatalf("items: got %d, want 2", n)
+    }
+
+    // 未同步的合并操作数在重新打开时从binlog恢复
+    db.binlog.smu.Lock()
+    cnt.Merge([]byte("n"), []byte("4"))
+    crashed := copyMemFS(options.FS)
+    db.binlog.smu.Unlock()
+    db.Close()
+    options.FS = crashed
+    db, err    = New("/db", options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    cnt, _ = db.Table("cnt")
+    if v := cnt.Get([]byte("n")); string(v) != "210" {
+        t.Fatalf("after replay: got %q, want 210", v)
+    }
+    db.binlog.sync()
+    if v := cnt.Get([]byte("n")); string(v) != "210" {
+        t.Fatalf("after replay and sync: got %q, want 210", v)
+    }
+}
+
+func TestRegisterMergeOperatorDuplicate(t *testing.T) {
+    f := func(key []byte, value []byte, operands [][]byte) ([]byte, error) {
+        return value, nil
+    }
+    // 内置及已注册的合并函数不能被替换
+    for _, name := range []string{"append", "add", "test_max"} {
+        if msg := recoverPanic(func() { RegisterMergeOperator(name, f) }); !strings.Contains(msg, "already registered") {
+            t.Fatalf("registering duplicate %s: got panic %q", name, msg)
+        }
+    }
+    if _, err := getMergeFunc("test_max"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSyncWithoutMerges(t *testing.T) {
+    fs := newCountingFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    for i := 0; i < 10; i++ {
+        db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    // 没有合并操作数的事务同步时不写入合并结果，也不fsync binlog
+    if err := db.binlog.sync(); err != nil {
+        t.Fatal(err)
+    }
+    if n := fs.count(); n != 0 {
+        t.Fatalf("binlog fsyncs: got %d, want 0", n)
+    }
+}
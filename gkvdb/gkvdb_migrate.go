@@ -0,0 +1,192 @@
+package gkvdb
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gMIGRATE_BATCH_SIZE    = 10000        // 数据迁移时单个事务写入的数据条数
+    gMIGRATE_TARGET_SUFFIX = ".migrating" // 原地升级时迁移的临时目录后缀
+    gMIGRATE_BACKUP_SUFFIX = ".backup"    // 原地升级时原有数据库目录的备份目录后缀
+)
+
+// 将src目录下的数据库迁移为当前程序使用的最新格式，dst为迁移后的数据库存放目录(必须为空目录或者不存在)；
+// 当dst为空或者与src相同时执行原地升级：先迁移到临时目录(src.migrating)，迁移完成后将原有数据库目录重命名为src.backup，
+// 再将临时目录重命名为src，替换过程中进程异常退出时，下一次通过New打开src时自动完成替换或者恢复原有数据库；
+// options[0]为迁移后数据库的选项，可用于将数据库转换为使用其他的哈希函数(离线rehash)；
+// options[1]为打开源数据库的选项(KeyProvider、MergeOperators等)，不指定时使用options[0]中的KeyProvider、MergeOperators及Logger；
+// 迁移需要对数据库目录进行替换，只支持操作系统文件系统
+func Migrate(src string, dst string, options...Options) error {
+    for _, option := range options {
+        if option.FS != nil && option.FS != gvfs.OS {
+            return errors.New("migrate only supports the os filesystem")
+        }
+    }
+    inplace := dst == "" || filepath.Clean(dst) == filepath.Clean(src)
+    target  := dst
+    if inplace {
+        target = filepath.Clean(src) + gMIGRATE_TARGET_SUFFIX
+        if err := os.RemoveAll(target); err != nil {
+            return err
+        }
+    } else if files, _ := ioutil.ReadDir(dst); len(files) > 0 {
+        return errors.New("migrate destination is not empty: " + dst)
+    }
+    if !gfile.Exists(src) {
+        return errors.New("migrate source does not exist: " + src)
+    }
+
+    source := Options{}
+    if len(options) > 1 {
+        source = options[1]
+    } else if len(options) > 0 {
+        source = Options {
+            KeyProvider    : options[0].KeyProvider,
+            MergeOperators : options[0].MergeOperators,
+            Logger         : options[0].Logger,
+        }
+    }
+    sdb, err := New(src, source)
+    if err != nil {
+        return err
+    }
+    if inplace && sdb.format.version == gFORMAT_VERSION && !sdb.manifest.needRehash(options...) {
+        return sdb.Close()
+    }
+    // 将binlog中未同步的数据同步到数据文件，以便直接遍历数据文件
+    if err := sdb.binlog.sync(); err != nil {
+        sdb.Close()
+        return err
+    }
+
+    var ddb *DB
+    if len(options) > 0 {
+        ddb, err = New(target, options[0])
+    } else {
+        ddb, err = New(target)
+    }
+    if err != nil {
+        sdb.Close()
+        return err
+    }
+    // 关闭目标数据库时会将binlog同步到数据文件
+    err = migrateTables(sdb, ddb)
+    if cerr := ddb.Close(); err == nil {
+        err = cerr
+    }
+    if cerr := sdb.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        if inplace {
+            os.RemoveAll(target)
+        }
+        return err
+    }
+
+    if inplace {
+        // 目录重命名之后同步父目录，保证备份目录存在时迁移后的数据库已完整写入
+        backup := filepath.Clean(src) + gMIGRATE_BACKUP_SUFFIX
+        if err := os.Rename(src, backup); err != nil {
+            return err
+        }
+        if err := syncParentDir(src); err != nil {
+            return err
+        }
+        if err := os.Rename(target, src); err != nil {
+            return err
+        }
+        if err := syncParentDir(src); err != nil {
+            return err
+        }
+        return os.RemoveAll(backup)
+    }
+    return nil
+}
+
+// 恢复原地升级中断的数据库目录(只支持操作系统文件系统)：
+// 原有目录已重命名为备份目录时，迁移后的数据库已完整写入，将临时目录重命名为数据库目录，没有临时目录时恢复备份目录；
+// 数据库目录已替换时删除遗留的备份目录
+func recoverMigration(path string) error {
+    path   = filepath.Clean(path)
+    backup := path + gMIGRATE_BACKUP_SUFFIX
+    target := path + gMIGRATE_TARGET_SUFFIX
+    if !gfile.Exists(backup) {
+        return nil
+    }
+    if gfile.Exists(path) {
+        return os.RemoveAll(backup)
+    }
+    if gfile.Exists(target) {
+        if err := os.Rename(target, path); err != nil {
+            return err
+        }
+    } else if err := os.Rename(backup, path); err != nil {
+        return err
+    }
+    if err := syncParentDir(path); err != nil {
+        return err
+    }
+    return os.RemoveAll(backup)
+}
+
+// 同步path所在的父目录，保证目录项的修改(重命名)落盘
+func syncParentDir(path string) error {
+    dir, err := os.Open(filepath.Dir(path))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return dir.Sync()
+}
+
+// 将sdb数据库中所有数据表的数据写入到ddb数据库中
+func migrateTables(sdb *DB, ddb *DB) error {
+    for _, name := range sdb.getTableNames() {
+        table, err := sdb.Table(name)
+        if err != nil {
+            return err
+        }
+        var reterr error = nil
+        tx    := ddb.Begin(name)
+        count := 0
+        err = table.iterate(context.Background(), func(key, value []byte) bool {
+            if reterr = tx.Set(key, value); reterr != nil {
+                return false
+            }
+            if count++; count % gMIGRATE_BATCH_SIZE == 0 {
+                reterr = tx.Commit()
+            }
+            return reterr == nil
+        })
+        // 遍历失败(如解密失败)时不能继续迁移，否则迁移后的数据库缺少数据
+        if err != nil {
+            return err
+        }
+        if reterr != nil {
+            return reterr
+        }
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 判断数据库是否需要按照选项转换哈希函数
+func (manifest *_Manifest) needRehash(options...Options) bool {
+    if len(options) == 0 || options[0].Hash == "" {
+        return false
+    }
+    if options[0].Hash != manifest.hash {
+        return true
+    }
+    return len(options[0].HashSeed) > 0 && !bytes.Equal(options[0].HashSeed, manifest.hashSeed)
+}
@@ -0,0 +1,166 @@
+package gkvdb
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+// 创建数据库并写入数据，legacy为true时使用格式版本1，迁移测试使用临时目录
+func migrateTestDB(t *testing.T, legacy bool, options...Options) string {
+    dir, err := ioutil.TempDir("", "gkvdb_migrate")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if legacy {
+        ioutil.WriteFile(dir + "/" + gFORMAT_FILE_NAME, []byte("1"), 0644)
+    }
+    db, err := New(dir, options...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if legacy && db.format.version != gFORMAT_VERSION_1 {
+        t.Fatalf("format version: got %d, want %d", db.format.version, gFORMAT_VERSION_1)
+    }
+    for i := 0; i < 300; i++ {
+        db.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+        db.SetTo([]byte(fmt.Sprintf("u%d", i)), []byte(fmt.Sprintf("w%d", i)), "user")
+    }
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return dir
+}
+
+// 检查迁移后的数据库为最新格式，并且数据完整
+func checkMigrated(t *testing.T, dir string, options...Options) {
+    db, err := New(dir, options...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if db.format.version != gFORMAT_VERSION {
+        t.Fatalf("format version: got %d, want %d", db.format.version, gFORMAT_VERSION)
+    }
+    if v := db.Get([]byte("k299")); string(v) != "v299" {
+        t.Fatalf("got %q, want v299", v)
+    }
+    if v := db.GetFrom([]byte("u5"), "user"); string(v) != "w5" {
+        t.Fatalf("got %q, want w5", v)
+    }
+    if n := len(db.Items(-1)); n != 300 {
+        t.Fatalf("items: got %d, want 300", n)
+    }
+    // 新格式支持超过255字节的键名
+    if err := db.Set(bytes.Repeat([]byte("x"), 1000), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    db.Remove(bytes.Repeat([]byte("x"), 1000))
+}
+
+func TestMigrateToNewDir(t *testing.T) {
+    src := migrateTestDB(t, true)
+    defer os.RemoveAll(src)
+    dst := src + "-new"
+    defer os.RemoveAll(dst)
+    if err := Migrate(src, dst); err != nil {
+        t.Fatal(err)
+    }
+    checkMigrated(t, dst)
+    // 源数据库保持不变
+    db, err := New(src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if db.format.version != gFORMAT_VERSION_1 || string(db.Get([]byte("k1"))) != "v1" {
+        t.Fatal("source database modified")
+    }
+    db.Close()
+    // 目标目录不为空时不能迁移
+    if err := Migrate(src, dst); err == nil {
+        t.Fatal("migrate to non-empty directory should fail")
+    }
+}
+
+func TestMigrateInPlace(t *testing.T) {
+    src := migrateTestDB(t, true)
+    defer os.RemoveAll(src)
+    if err := Migrate(src, ""); err != nil {
+        t.Fatal(err)
+    }
+    for _, suffix := range []string{gMIGRATE_TARGET_SUFFIX, gMIGRATE_BACKUP_SUFFIX} {
+        if _, err := os.Stat(src + suffix); err == nil {
+            t.Fatalf("%s directory left after migration", suffix)
+        }
+    }
+    checkMigrated(t, src)
+    // 已是最新格式时不再迁移
+    if err := Migrate(src, src); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMigrateSourceOptions(t *testing.T) {
+    keys := newTestKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    src  := migrateTestDB(t, false, Options{KeyProvider : keys})
+    defer os.RemoveAll(src)
+    // 源数据库加密时需要通过选项指定KeyProvider
+    if err := Migrate(src, "", Options{Hash : "xxhash64"}, Options{}); err == nil {
+        t.Fatal("migrate encrypted database without key provider should fail")
+    }
+    if err := Migrate(src, "", Options{Hash : "xxhash64"}, Options{KeyProvider : keys}); err != nil {
+        t.Fatal(err)
+    }
+    checkMigrated(t, src)
+    // 不指定源数据库选项时使用迁移后数据库选项中的KeyProvider
+    if err := Migrate(src, "", Options{Hash : "siphash", KeyProvider : keys}); err != nil {
+        t.Fatal(err)
+    }
+    checkMigrated(t, src, Options{KeyProvider : keys})
+    db, _ := New(src, Options{KeyProvider : keys})
+    if db.manifest.hash != "siphash" {
+        t.Fatalf("hash: got %s, want siphash", db.manifest.hash)
+    }
+    db.Close()
+}
+
+func TestMigrateRecovery(t *testing.T) {
+    // 原有目录已重命名为备份目录，迁移后的数据库还没有重命名
+    src := migrateTestDB(t, true)
+    defer os.RemoveAll(src)
+    dst := src + gMIGRATE_TARGET_SUFFIX
+    if err := Migrate(src, dst); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Rename(src, src + gMIGRATE_BACKUP_SUFFIX); err != nil {
+        t.Fatal(err)
+    }
+    checkMigrated(t, src)
+    if _, err := os.Stat(src + gMIGRATE_BACKUP_SUFFIX); err == nil {
+        t.Fatal("backup directory left after recovery")
+    }
+
+    // 迁移后的数据库已重命名，备份目录还没有删除
+    os.Mkdir(src + gMIGRATE_BACKUP_SUFFIX, 0755)
+    checkMigrated(t, src)
+    if _, err := os.Stat(src + gMIGRATE_BACKUP_SUFFIX); err == nil {
+        t.Fatal("backup directory left after recovery")
+    }
+
+    // 只有备份目录时恢复原有数据库
+    old := migrateTestDB(t, true)
+    defer os.RemoveAll(old)
+    if err := os.Rename(old, old + gMIGRATE_BACKUP_SUFFIX); err != nil {
+        t.Fatal(err)
+    }
+    db, err := New(old)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if db.format.version != gFORMAT_VERSION_1 || string(db.Get([]byte("k7"))) != "v7" {
+        t.Fatal("backup was not restored")
+    }
+}
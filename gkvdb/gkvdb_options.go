@@ -0,0 +1,70 @@
+package gkvdb
+
+import (
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 数据持久化策略
+type SyncMode int
+
+const (
+    SyncNone     SyncMode = iota // 提交时不执行fsync，由操作系统决定何时将binlog写入磁盘(默认)
+    SyncAlways                   // 每一次提交都执行fsync，并发的提交通过组提交共用fsync
+    SyncPeriodic                 // 按照时间间隔或者未fsync的数据大小定期执行fsync
+)
+
+// binlog队列达到上限时的写入背压策略
+type BackpressureMode int
+
+const (
+    BackpressureBlock    BackpressureMode = iota // 阻塞写入直到队列同步完成(默认)
+    BackpressureFail                             // 直接返回ErrBusy，由调用方决定重试或者降级
+    BackpressureThrottle                         // 队列超过上限的一半之后按照队列大小逐步延迟写入，达到上限时阻塞写入
+)
+
+const (
+    gDEFAULT_SYNC_INTERVAL = time.Second // SyncPeriodic策略下默认的fsync时间间隔
+)
+
+// 数据库选项，通过New的可选参数传递
+type Options struct {
+    // 键名哈希函数名称，仅在新建数据库时有效，默认为bkdr64，
+    // 内置可选xxhash64、siphash，也可以使用RegisterHash注册的哈希函数；
+    // 已存在的数据库使用manifest中记录的哈希函数，指定不同的哈希函数时返回错误，需要使用Migrate进行转换
+    Hash           string
+    // 哈希函数种子，仅在新建数据库时有效，为空时对于需要种子的哈希函数自动生成随机种子
+    HashSeed       []byte
+    // 数据持久化策略，事务提交时可以通过Commit(true/false)单独指定是否fsync
+    Sync           SyncMode
+    // SyncPeriodic策略下fsync的时间间隔，为0且SyncBytes也为0时默认为1秒
+    SyncInterval   time.Duration
+    // SyncPeriodic策略下未fsync的binlog数据大小(byte)达到该值时在提交时执行fsync，为0时不限制
+    SyncBytes      int
+    // 数据表使用的合并函数，键名为表名，键值为合并函数名称(内置append、add，或者RegisterMergeOperator注册的名称)，
+    // 只有指定了合并函数的数据表才能使用Merge写入合并操作数
+    MergeOperators map[string]string
+    // 事务内存中的数据大小(byte)达到该值时写入数据库目录下的临时文件(事务落盘)，为0时默认为5MB；
+    // 落盘的大事务提交时流式写入binlog并直接同步到数据文件，不占用binlog队列，同步完成之前阻塞所有数据表的写入，
+    // 以及大事务修改的数据表的查询(Get、Exists、Len、IndexLookup)，其他数据表的查询不受影响；
+    // 写入大量数据且不需要整体可见时可以调大该值，或者使用WriteBatch分批写入
+    TxSpillSize    int
+    // binlog队列(未同步到数据文件的数据)达到上限时的写入背压策略，通过DB.Stats()可以获取写入阻塞的次数及时间
+    Backpressure   BackpressureMode
+    // 日志输出，为nil时输出到glog
+    Logger         Logger
+    // 事件回调(数据损坏、同步重试、重新分区、数据整理等)，回调在独立的事件线程中按照触发顺序执行，不持有数据库的锁，
+    // 因此回调中可以调用数据库的查询及写入方法，但是不能调用DB.Close(关闭数据库时等待已触发的事件回调完成)；
+    // 关闭过程中触发的事件在数据表关闭之后回调，此时调用数据库的方法返回ErrClosed；回调阻塞时之后的事件在内存中排队
+    OnEvent        func(Event)
+    // 文件系统，数据库的所有文件读写都通过该接口进行，为nil时使用操作系统文件系统(gvfs.OS)；
+    // 非操作系统文件系统不对数据库目录加锁，由调用方保证同一时间只有一个数据库对象打开同一目录
+    FS             gvfs.FS
+    // 键值加密的密钥提供接口，不为nil时数据文件、binlog及事务落盘文件中的键值使用AES-GCM加密，
+    // 键名(包括二级索引表中的索引值)不加密，以明文保存，详见KeyProvider的说明；
+    // 通过DB.RotateKey()可以在后台使用新的密钥重新加密已有的数据
+    KeyProvider    KeyProvider
+    // 数据表使用的键值压缩算法，键名为表名，键值为压缩算法名称(内置flate，或者RegisterCompressor注册的名称)，
+    // 键值写入数据文件时压缩(binlog中不压缩)，读取时自动解压，修改压缩算法不影响已写入的数据
+    Compressors    map[string]string
+}
@@ -0,0 +1,203 @@
+package gkvdb
+
+import (
+    "errors"
+)
+
+// 事务保存点，记录创建保存点时的撤销日志位置、事务内存中的数据大小及落盘文件大小
+type _Savepoint struct {
+    name    string // 保存点名称
+    undo    int    // 撤销日志位置，回滚时逆序撤销该位置之后的日志
+    bytes   int64  // 事务内存中的数据大小
+    spilled int64  // 落盘文件大小，回滚时截断落盘文件
+}
+
+// 撤销日志项，记录键名在保存点之后第一次修改之前的数据项及合并操作数
+type _Undo struct {
+    name     string   // 表名
+    key      string   // 键名
+    value    []byte   // 修改前的数据项
+    exists   bool     // 修改前数据项是否存在
+    operands [][]byte // 修改前的合并操作数，为nil表示不存在
+}
+
+// =================================================================================
+// 事务保存点
+// 回滚到保存点时只撤销保存点之后的写入，原子操作读取的数据仍然在提交时进行检查；
+// 存在保存点时事务记录撤销日志，创建保存点不需要复制事务数据
+// =================================================================================
+
+// 创建保存点，同名的保存点已存在时覆盖之前的保存点
+func (tx *Transaction) Savepoint(name string) {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    if i := tx.savepoint(name); i != -1 {
+        tx.savepoints = append(tx.savepoints[0 : i], tx.savepoints[i + 1 : ]...)
+    }
+    sp := &_Savepoint {
+        name  : name,
+        undo  : len(tx.undo),
+        bytes : tx.bytes,
+    }
+    tx.logged = nil
+    if tx.spill != nil {
+        sp.spilled = tx.spill.size
+    }
+    tx.savepoints = append(tx.savepoints, sp)
+}
+
+// 回滚到保存点，撤销保存点之后的写入并删除之后创建的保存点，保存点本身保留以便再次回滚
+func (tx *Transaction) RollbackTo(name string) error {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    i := tx.savepoint(name)
+    if i == -1 {
+        return errors.New("savepoint not found: " + name)
+    }
+    sp := tx.savepoints[i]
+    // 保存点之后落盘的数据需要从落盘文件中截断
+    if tx.spill != nil && tx.spill.size > sp.spilled {
+        if sp.spilled == 0 {
+            tx.spill.close()
+            tx.spill = nil
+        } else if err := tx.spill.truncate(sp.spilled, tx.db.format); err != nil {
+            return err
+        }
+    }
+    // 逆序撤销保存点之后的修改
+    for j := len(tx.undo) - 1; j >= sp.undo; j-- {
+        tx.undo[j].restore(tx)
+    }
+    tx.undo       = tx.undo[0 : sp.undo]
+    tx.logged     = nil
+    tx.bytes      = sp.bytes
+    tx.savepoints = tx.savepoints[0 : i + 1]
+    return nil
+}
+
+// 释放保存点及之后创建的保存点，保存点之后的写入保留在事务中
+func (tx *Transaction) Release(name string) error {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    i := tx.savepoint(name)
+    if i == -1 {
+        return errors.New("savepoint not found: " + name)
+    }
+    tx.savepoints = tx.savepoints[0 : i]
+    if len(tx.savepoints) == 0 {
+        tx.undo   = nil
+        tx.logged = nil
+    }
+    return nil
+}
+
+// 查找保存点，不存在时返回-1(内部调用，调用方加锁)
+func (tx *Transaction) savepoint(name string) int {
+    for i, sp := range tx.savepoints {
+        if sp.name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+// 修改键名的数据项或者合并操作数之前记录撤销日志(内部调用，调用方加锁)，没有保存点时不记录；
+// 同一个键名在最近的保存点之后只记录第一次修改之前的数据
+func (tx *Transaction) logUndo(name, key string) {
+    if len(tx.savepoints) == 0 {
+        return
+    }
+    if _, ok := tx.logged[name][key]; ok {
+        return
+    }
+    if tx.logged == nil {
+        tx.logged = make(map[string]map[string]struct{})
+    }
+    if _, ok := tx.logged[name]; !ok {
+        tx.logged[name] = make(map[string]struct{})
+    }
+    tx.logged[name][key] = struct{}{}
+    undo := _Undo {
+        name : name,
+        key  : key,
+    }
+    // 键值在写入时已经复制，可以直接引用；操作数列表需要复制，防止之后的追加写入共享的底层数组
+    undo.value, undo.exists = tx.tables[name][key]
+    if operands, ok := tx.merges[name][key]; ok {
+        undo.operands = append([][]byte{}, operands...)
+    }
+    tx.undo = append(tx.undo, undo)
+}
+
+// 撤销修改，恢复键名修改之前的数据项及合并操作数
+func (undo *_Undo) restore(tx *Transaction) {
+    if undo.exists {
+        if _, ok := tx.tables[undo.name]; !ok {
+            tx.tables[undo.name] = make(map[string][]byte)
+        }
+        tx.tables[undo.name][undo.key] = undo.value
+    } else {
+        delete(tx.tables[undo.name], undo.key)
+    }
+    if undo.operands != nil {
+        if _, ok := tx.merges[undo.name]; !ok {
+            tx.merges[undo.name] = make(map[string][][]byte)
+        }
+        tx.merges[undo.name][undo.key] = undo.operands
+    } else {
+        delete(tx.merges[undo.name], undo.key)
+    }
+}
+
+// =================================================================================
+// 嵌套事务
+// 子事务读取时优先查询子事务中的数据，其次查询父事务中的数据及已提交的数据；
+// 子事务提交时将写入的数据合并到父事务中，只有父事务提交时才写入binlog，子事务回滚不影响父事务
+// =================================================================================
+
+// 创建子事务，可选参数指定默认数据表(默认与父事务相同)
+func (tx *Transaction) Begin(table...string) *Transaction {
+    child       := tx.db.newTransaction()
+    child.parent = tx
+    child.table  = tx.table
+    if len(table) > 0 {
+        child.table = table[0]
+    }
+    return child
+}
+
+// 将子事务的写入合并到事务中
+func (tx *Transaction) absorb(child *Transaction) error {
+    tx.mu.Lock()
+    defer tx.mu.Unlock()
+
+    // 子事务落盘的数据按照写入顺序合并
+    if child.spill != nil {
+        err := child.spill.iterate(tx.db.format, func(name, key string, value []byte) error {
+            return tx.set([]byte(key), value, name)
+        })
+        if err != nil {
+            return err
+        }
+    }
+    for name, m := range child.tables {
+        for k, v := range m {
+            if err := tx.set([]byte(k), v, name); err != nil {
+                return err
+            }
+        }
+    }
+    for name, m := range child.merges {
+        for k, operands := range m {
+            for _, operand := range operands {
+                if err := tx.merge([]byte(k), operand, name); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,158 @@
+package gkvdb
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func TestSavepointRollback(t *testing.T) {
+    db, err := NewInMemory(Options{MergeOperators : map[string]string{"c" : "add"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    table.Set([]byte("d"), []byte("disk"))
+
+    tx := db.Begin("c")
+    tx.Set([]byte("a"), []byte("1"))
+    tx.Savepoint("s1")
+    tx.Set([]byte("a"), []byte("2"))
+    tx.Set([]byte("b"), []byte("2"))
+    tx.Remove([]byte("d"))
+    tx.Merge([]byte("n"), []byte("3"))
+    tx.Savepoint("s2")
+    tx.Merge([]byte("n"), []byte("4"))
+    tx.Set([]byte("b"), []byte("3"))
+    if v := tx.Get([]byte("n")); string(v) != "7" {
+        t.Fatalf("merge before rollback: got %q, want 7", v)
+    }
+    if err := tx.RollbackTo("s2"); err != nil {
+        t.Fatal(err)
+    }
+    if v := tx.Get([]byte("n")); string(v) != "3" {
+        t.Fatalf("rollback to s2: n = %q, want 3", v)
+    }
+    if v := tx.Get([]byte("b")); string(v) != "2" {
+        t.Fatalf("rollback to s2: b = %q, want 2", v)
+    }
+    if err := tx.RollbackTo("s1"); err != nil {
+        t.Fatal(err)
+    }
+    if tx.Exists([]byte("b")) || tx.Exists([]byte("n")) || string(tx.Get([]byte("a"))) != "1" || string(tx.Get([]byte("d"))) != "disk" {
+        t.Fatal("rollback to s1 did not restore the transaction")
+    }
+    // 回滚到s1之后s2被删除，s1保留直到释放
+    if tx.RollbackTo("s2") == nil {
+        t.Fatal("rollback to removed savepoint should fail")
+    }
+    if err := tx.Release("s1"); err != nil {
+        t.Fatal(err)
+    }
+    if tx.Release("s1") == nil {
+        t.Fatal("release of removed savepoint should fail")
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if string(table.Get([]byte("a"))) != "1" || table.Get([]byte("b")) != nil || string(table.Get([]byte("d"))) != "disk" {
+        t.Fatal("unexpected committed data")
+    }
+}
+
+func TestSavepointNested(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+
+    tx := db.Begin("c")
+    tx.Set([]byte("a"), []byte("1"))
+    child := tx.Begin()
+    child.Set([]byte("x"), []byte("9"))
+    child.Incr([]byte("a"), 5)
+    if string(child.Get([]byte("a"))) != "6" || tx.Exists([]byte("x")) || len(child.Items(-1)) != 2 {
+        t.Fatal("unexpected child transaction view")
+    }
+    if err := child.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    // 回滚的子事务不影响父事务
+    child = tx.Begin()
+    child.Set([]byte("y"), []byte("1"))
+    child.Rollback()
+    if string(tx.Get([]byte("a"))) != "6" || string(tx.Get([]byte("x"))) != "9" || tx.Exists([]byte("y")) {
+        t.Fatal("unexpected parent transaction view")
+    }
+    if table.Get([]byte("x")) != nil {
+        t.Fatal("child commit should not write to the database")
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if string(table.Get([]byte("x"))) != "9" || string(table.Get([]byte("a"))) != "6" {
+        t.Fatal("unexpected committed data")
+    }
+
+    // 子事务中原子操作的冲突由父事务检查
+    tx    = db.Begin("c")
+    child = tx.Begin()
+    child.Incr([]byte("a"), 1)
+    child.Commit()
+    table.Set([]byte("a"), []byte("100"))
+    if err := tx.Commit(); err != ErrConflict {
+        t.Fatalf("commit: got %v, want ErrConflict", err)
+    }
+}
+
+func TestSavepointSpilled(t *testing.T) {
+    db, err := NewInMemory(Options{TxSpillSize : 4096})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    table.Set([]byte("old"), []byte("x"))
+
+    value := strings.Repeat("v", 100)
+    tx    := db.Begin("c")
+    for i := 0; i < 500; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(value))
+    }
+    if tx.spill == nil || tx.spill.size == 0 {
+        t.Fatal("transaction was not spilled")
+    }
+    tx.Savepoint("sp")
+    // 保存点之后继续落盘，并修改已落盘的键名
+    for i := 500; i < 1000; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(value))
+    }
+    tx.Set([]byte("k1"), []byte("changed"))
+    tx.Remove([]byte("k2"))
+    tx.Remove([]byte("old"))
+    if err := tx.RollbackTo("sp"); err != nil {
+        t.Fatal(err)
+    }
+    if tx.Exists([]byte("k600")) || string(tx.Get([]byte("k1"))) != value || !tx.Exists([]byte("k2")) || !tx.Exists([]byte("old")) {
+        t.Fatal("rollback across spill did not restore the transaction")
+    }
+    if n := len(tx.Items(-1)); n != 501 {
+        t.Fatalf("items after rollback: got %d, want 501", n)
+    }
+    tx.Set([]byte("k3"), []byte("three"))
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if string(table.Get([]byte("k499"))) != value || string(table.Get([]byte("k1"))) != value || string(table.Get([]byte("k3"))) != "three" {
+        t.Fatal("unexpected committed data")
+    }
+    if table.Get([]byte("k600")) != nil {
+        t.Fatal("rolled back data was committed")
+    }
+    if n := len(table.Items(-1)); n != 501 {
+        t.Fatalf("items: got %d, want 501", n)
+    }
+}
@@ -0,0 +1,427 @@
+package gkvdb
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "errors"
+    "io"
+    "math"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "github.com/gogf/gf/g/os/gfile"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+const (
+    gDEFAULT_TX_SPILL_SIZE = gBINLOG_MAX_SIZE/4   // 事务数据默认的落盘大小(byte)，小于binlog队列上限，大事务不会占用binlog队列
+    gTX_SPILL_FILE_PATTERN = "tx-*.spill"         // 事务落盘文件名称
+    gSTREAM_BUFFER_SIZE    = 1024*1024            // 大事务流式读写的缓冲区大小(byte)
+)
+
+// 事务落盘文件，事务数据超过落盘大小时以binlog数据项的格式追加写入临时文件，内存中只保留键名索引；
+// 同一键名可能多次写入，索引指向最后一次写入的位置
+type _TxSpill struct {
+    fs    gvfs.FS                           // 临时文件所在的文件系统
+    file  gvfs.File                         // 临时文件
+    size  int64                             // 已写入的数据大小(byte)
+    index map[string]map[string]_TxSpillRef // 键名索引，键名为表名，键值为对应表的键名与键值位置
+}
+
+// 落盘数据的键值位置
+type _TxSpillRef struct {
+    offset    int64 // 键值在落盘文件中的位置
+    vlen      int   // 键值长度(加密后)，为0表示删除
+    encrypted bool  // 键值是否已加密
+}
+
+// 获取事务数据的落盘大小
+func (db *DB) getTxSpillSize() int64 {
+    if db.options.TxSpillSize > 0 {
+        return int64(db.options.TxSpillSize)
+    }
+    return gDEFAULT_TX_SPILL_SIZE
+}
+
+// 删除异常退出时遗留的事务落盘文件
+func (db *DB) removeSpillFiles() {
+    files, _ := db.fs.ReadDir(db.path)
+    for _, file := range files {
+        if ok, _ := filepath.Match(gTX_SPILL_FILE_PATTERN, file.Name()); ok && !file.IsDir() {
+            db.fs.Remove(db.path + gfile.Separator + file.Name())
+        }
+    }
+}
+
+// 在数据库目录下创建一个新的事务落盘文件，文件名称中的*替换为随机数
+func (db *DB) createSpillFile() (gvfs.File, error) {
+    for i := 0; ; i++ {
+        name    := strings.Replace(gTX_SPILL_FILE_PATTERN, "*", strconv.FormatUint(uint64(rand.Int63()), 36), 1)
+        pf, err := db.fs.OpenFile(db.path + gfile.Separator + name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+        if os.IsExist(err) && i < 100 {
+            continue
+        }
+        return pf, err
+    }
+}
+
+// 将事务内存中的数据写入落盘文件(内部调用，调用方加锁)；
+// 合并操作数需要先与已提交的键值合并(提交时检查已提交的键值是否被修改)，落盘之后的事务不再保存合并操作数
+func (tx *Transaction) spillOut() error {
+    for name, m := range tx.merges {
+        for k, _ := range m {
+            value, err := tx.read([]byte(k), name)
+            if err != nil {
+                return err
+            }
+            tx.put([]byte(k), value, name)
+        }
+    }
+    // 落盘之后事务内存中的数据被清空，回滚到保存点时需要恢复保存点之前写入的数据
+    for name, m := range tx.tables {
+        for k, _ := range m {
+            tx.logUndo(name, k)
+        }
+    }
+    tx.merges = make(map[string]map[string][][]byte)
+    if tx.spill == nil {
+        file, err := tx.db.createSpillFile()
+        if err != nil {
+            return err
+        }
+        tx.spill = &_TxSpill {
+            fs    : tx.db.fs,
+            file  : file,
+            index : make(map[string]map[string]_TxSpillRef),
+        }
+    }
+    format := tx.db.format
+    buffer := make([]byte, 0, tx.bytes)
+    err    := error(nil)
+    for n, m := range tx.tables {
+        if _, ok := tx.spill.index[n]; !ok {
+            tx.spill.index[n] = make(map[string]_TxSpillRef)
+        }
+        for k, v := range m {
+            // 键值在数据项的末尾，加密后的长度与原有长度不同
+            offset := len(buffer) + format.binlogHeadSize + len(n) + len(k)
+            if buffer, err = appendBinLogItem(format, buffer, 0, n, k, v); err != nil {
+                tx.spill.truncate(tx.spill.size, format)
+                return err
+            }
+            vlen   := len(buffer) - offset
+            tx.spill.index[n][k] = _TxSpillRef{tx.spill.size + int64(offset), vlen, format.cipher != nil && vlen > 0}
+        }
+    }
+    if _, err := tx.spill.file.WriteAt(buffer, tx.spill.size); err != nil {
+        // 写入失败时重建索引，丢弃写入失败的数据，事务内存中的数据保留
+        tx.spill.truncate(tx.spill.size, format)
+        return err
+    }
+    tx.spill.size += int64(len(buffer))
+    tx.tables      = make(map[string]map[string][]byte)
+    tx.bytes       = 0
+    return nil
+}
+
+// 查询事务中已写入的数据(内部调用，调用方加锁)，内存中的数据优先，其次为落盘文件中的数据，
+// 返回的bool表示键名是否在事务中写入过
+func (tx *Transaction) pending(key []byte, name string) ([]byte, bool, error) {
+    if m, ok := tx.tables[name]; ok {
+        if v, ok := m[string(key)]; ok {
+            return v, true, nil
+        }
+    }
+    if tx.spill != nil {
+        if ref, ok := tx.spill.index[name][string(key)]; ok {
+            v, err := tx.spill.read(ref, key, tx.db.format)
+            return v, true, err
+        }
+    }
+    return nil, false, nil
+}
+
+// 读取落盘文件中的键值(已解密)
+func (spill *_TxSpill) read(ref _TxSpillRef, key []byte, format *_Format) ([]byte, error) {
+    if ref.vlen == 0 {
+        return nil, nil
+    }
+    value := make([]byte, ref.vlen)
+    if _, err := spill.file.ReadAt(value, ref.offset); err != nil {
+        return nil, err
+    }
+    return format.open(key, value, ref.encrypted)
+}
+
+// 按照写入顺序遍历落盘文件中的数据项(键值已解密)
+func (spill *_TxSpill) iterate(format *_Format, f func(name, key string, value []byte) error) error {
+    return iterateBinLogItems(io.NewSectionReader(spill.file, 0, spill.size), format, func(flags int, name, key string, value []byte, offset int64) error {
+        value, err := format.open([]byte(key), value, flags & gBINLOG_FLAG_ENCRYPTED > 0)
+        if err != nil {
+            return err
+        }
+        return f(name, key, value)
+    })
+}
+
+// 截断落盘文件(回滚到保存点)，并重新构建键名索引
+func (spill *_TxSpill) truncate(size int64, format *_Format) error {
+    if err := spill.file.Truncate(size); err != nil {
+        return err
+    }
+    spill.size  = size
+    spill.index = make(map[string]map[string]_TxSpillRef)
+    return iterateBinLogItems(io.NewSectionReader(spill.file, 0, spill.size), format, func(flags int, name, key string, value []byte, offset int64) error {
+        if _, ok := spill.index[name]; !ok {
+            spill.index[name] = make(map[string]_TxSpillRef)
+        }
+        spill.index[name][key] = _TxSpillRef{offset, len(value), flags & gBINLOG_FLAG_ENCRYPTED > 0}
+        return nil
+    })
+}
+
+// 关闭并删除落盘文件
+func (spill *_TxSpill) close() {
+    spill.file.Close()
+    spill.fs.Remove(spill.file.Name())
+}
+
+// 按照写入顺序遍历binlog数据项流，offset为键值在数据流中的位置
+func iterateBinLogItems(reader io.Reader, format *_Format, f func(flags int, name, key string, value []byte, offset int64) error) error {
+    buffer := bufio.NewReaderSize(reader, gSTREAM_BUFFER_SIZE)
+    head   := make([]byte, format.binlogHeadSize)
+    offset := int64(0)
+    for {
+        if _, err := io.ReadFull(buffer, head); err != nil {
+            if err == io.EOF {
+                return nil
+            }
+            return err
+        }
+        flags, nlen, klen, vlen := format.decodeBinLogHead(head)
+        data := make([]byte, nlen + klen + vlen)
+        if _, err := io.ReadFull(buffer, data); err != nil {
+            return err
+        }
+        offset += int64(len(head) + nlen + klen)
+        value  := data[nlen + klen : ]
+        if vlen == 0 {
+            value = nil
+        }
+        if err := f(flags, string(data[0 : nlen]), string(data[nlen : nlen + klen]), value, offset); err != nil {
+            return err
+        }
+        offset += int64(vlen)
+    }
+}
+
+// 流式写入大事务，大事务的binlog数据直接从落盘文件复制，写入并fsync之后立即同步到数据文件；
+// 写入到同步完成期间通过写入闸门阻塞其他事务的写入(提交前的读取检查需要读取到大事务的数据)，
+// 通过查询闸门只阻塞大事务修改的数据表的查询，保证大事务整体可见，同时保证大事务之前的事务已同步(memtable中不存在旧数据)；
+// 写入binlog之前ctx取消或者超时时返回ctx的错误(事务未写入)，写入binlog之后同步失败或者ctx取消、超时时释放闸门并返回ErrApplyPending，
+// 此时大事务已提交，由后台的同步线程继续重试同步，重试完成之前大事务的数据可能只有部分可见
+func (binlog *BinLog) writeStream(ctx context.Context, tx *Transaction) error {
+    if err := lockContext(ctx, binlog.gate.Lock, binlog.gate.Unlock); err != nil {
+        return err
+    }
+    defer binlog.gate.Unlock()
+    // 按照表名顺序加锁，避免与其他查询死锁
+    for _, name := range tx.writtenTables() {
+        gate := binlog.readGate(name)
+        if err := lockContext(ctx, gate.Lock, gate.Unlock); err != nil {
+            return err
+        }
+        defer gate.Unlock()
+    }
+
+    failed := make(chan error, 1)
+    binlog.wmu.Lock()
+    binlog.waiter = failed
+    binlog.wmu.Unlock()
+    defer func() {
+        binlog.wmu.Lock()
+        binlog.waiter = nil
+        binlog.wmu.Unlock()
+    }()
+
+    applied, err := binlog.appendStream(tx)
+    if err != nil {
+        return err
+    }
+    binlog.sync()
+    select {
+        case <- applied:
+            return nil
+        case err := <- failed:
+            // 同步成功时同样关闭applied，优先返回同步成功
+            select {
+                case <- applied:
+                    return nil
+                default:
+            }
+            binlog.syncEvents <- struct{}{}
+            binlog.db.logger().Errorf("large transaction written to binlog but failed to apply, retrying in background: %v", err)
+            return ErrApplyPending
+        case <- ctx.Done():
+            select {
+                case <- applied:
+                    return nil
+                default:
+            }
+            binlog.syncEvents <- struct{}{}
+            return ErrApplyPending
+    }
+}
+
+// 事务写入的所有数据表名称(按照名称排序，内部调用，调用方加锁)
+func (tx *Transaction) writtenTables() []string {
+    set := make(map[string]struct{})
+    for name, _ := range tx.tables {
+        set[name] = struct{}{}
+    }
+    for name, _ := range tx.merges {
+        set[name] = struct{}{}
+    }
+    if tx.spill != nil {
+        for name, _ := range tx.spill.index {
+            set[name] = struct{}{}
+        }
+    }
+    names := make([]string, 0, len(set))
+    for name, _ := range set {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// 将大事务追加到binlog文件末尾，事务头的数据长度为0xFFFFFFFF，实际的数据长度(64bit)保存在事务头之后，
+// 返回大事务同步完成的通知
+func (binlog *BinLog) appendStream(tx *Transaction) (chan struct{}, error) {
+    blpf, err := binlog.db.getBinlogFilePointer()
+    if err != nil {
+        return nil, err
+    }
+    defer blpf.Close()
+
+    binlog.Lock()
+    defer binlog.Unlock()
+
+    if err := tx.checkReads(); err != nil {
+        return nil, err
+    }
+    start, err := blpf.Seek(0, 2)
+    if err != nil {
+        return nil, err
+    }
+    size, err := binlog.writeStreamTo(blpf, tx)
+    if err == nil {
+        err = blpf.Sync()
+    }
+    if err != nil {
+        binlog.db.fs.Truncate(binlog.db.getBinLogFilePath(), start)
+        return nil, err
+    }
+    applied := make(chan struct{})
+    binlog.queue.PushFront(BinLogItem {
+        txstart : start,
+        large   : true,
+        applied : applied,
+    })
+    atomic.AddInt64(&binlog.wbytes, size)
+    atomic.AddInt64(&binlog.written, 1)
+    return applied, nil
+}
+
+// 将大事务写入到binlog文件当前位置，返回写入的数据大小
+func (binlog *BinLog) writeStreamTo(blpf gvfs.File, tx *Transaction) (int64, error) {
+    format := binlog.db.format
+    writer := bufio.NewWriterSize(blpf, gSTREAM_BUFFER_SIZE)
+    buffer := beginBinLogTx(make([]byte, 0, 13 + 8), tx.id)
+    binary.LittleEndian.PutUint32(buffer[1 : 5], math.MaxUint32)
+    buffer  = append(buffer, 0, 0, 0, 0, 0, 0, 0, 0)
+    if _, err := writer.Write(buffer); err != nil {
+        return 0, err
+    }
+    // 落盘文件中的数据
+    if _, err := io.Copy(writer, io.NewSectionReader(tx.spill.file, 0, tx.spill.size)); err != nil {
+        return 0, err
+    }
+    // 内存中的数据(合并操作数在落盘时已经合并)
+    blsize := tx.spill.size
+    for n, m := range tx.tables {
+        for k, v := range m {
+            buffer, err := appendBinLogItem(format, buffer[0 : 0], 0, n, k, v)
+            if err != nil {
+                return 0, err
+            }
+            if _, err := writer.Write(buffer); err != nil {
+                return 0, err
+            }
+            blsize += int64(len(buffer))
+        }
+    }
+    buffer = buffer[0 : 8]
+    binary.LittleEndian.PutUint64(buffer, uint64(tx.id))
+    if _, err := writer.Write(buffer); err != nil {
+        return 0, err
+    }
+    if err := writer.Flush(); err != nil {
+        return 0, err
+    }
+    // 回写实际的数据长度
+    start, err := blpf.Seek(0, 1)
+    if err != nil {
+        return 0, err
+    }
+    start -= 13 + 8 + blsize + 8
+    binary.LittleEndian.PutUint64(buffer, uint64(blsize))
+    if _, err := blpf.WriteAt(buffer, start + 13); err != nil {
+        return 0, err
+    }
+    return 13 + 8 + blsize + 8, nil
+}
+
+// 将binlog文件中的大事务流式写入数据文件，返回写入的数据表名称
+func (binlog *BinLog) applyStream(txstart int64) (map[string]struct{}, error) {
+    blpf, err := binlog.db.getBinlogFilePointer()
+    if err != nil {
+        return nil, err
+    }
+    defer blpf.Close()
+
+    buffer := make([]byte, 8)
+    if _, err := blpf.ReadAt(buffer, txstart + 13); err != nil {
+        return nil, err
+    }
+    blsize := int64(binary.LittleEndian.Uint64(buffer))
+    names  := make(map[string]struct{})
+    reader := io.NewSectionReader(blpf, txstart + 13 + 8, blsize)
+    err     = iterateBinLogItems(reader, binlog.db.format, func(flags int, name, key string, value []byte, offset int64) error {
+        if flags & gBINLOG_FLAG_MERGE > 0 {
+            return errors.New("unexpected merge operand in large transaction")
+        }
+        table, err := binlog.db.table(name)
+        if err != nil {
+            return err
+        }
+        names[name] = struct{}{}
+        if len(value) == 0 {
+            return table.remove([]byte(key))
+        }
+        value, err = binlog.db.format.open([]byte(key), value, flags & gBINLOG_FLAG_ENCRYPTED > 0)
+        if err != nil {
+            return err
+        }
+        return table.set([]byte(key), value)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return names, nil
+}
@@ -0,0 +1,281 @@
+package gkvdb
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+// 数据文件写入失败的文件系统，failing不为0时数据文件的所有写入返回错误，
+// blocking不为nil时写入blocked数据文件时等待blocking关闭
+type failingFS struct {
+    gvfs.FS
+    failing  int32
+    mu       sync.Mutex
+    blocked  string
+    blocking chan struct{}
+}
+
+type failingFile struct {
+    gvfs.File
+    fs *failingFS
+}
+
+func (fs *failingFS) OpenFile(name string, flag int, perm os.FileMode) (gvfs.File, error) {
+    file, err := fs.FS.OpenFile(name, flag, perm)
+    if err != nil {
+        return nil, err
+    }
+    return &failingFile{file, fs}, nil
+}
+
+func (f *failingFile) failed() bool {
+    return atomic.LoadInt32(&f.fs.failing) != 0 && strings.HasSuffix(f.Name(), ".db")
+}
+
+// 写入数据文件时等待阻塞结束
+func (f *failingFile) wait() {
+    f.fs.mu.Lock()
+    blocking := f.fs.blocking
+    blocked  := f.fs.blocked
+    f.fs.mu.Unlock()
+    if blocking != nil && strings.HasSuffix(f.Name(), blocked) {
+        <- blocking
+    }
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+    f.wait()
+    if f.failed() {
+        return 0, errInjected
+    }
+    return f.File.Write(b)
+}
+
+func (f *failingFile) WriteAt(b []byte, offset int64) (int, error) {
+    f.wait()
+    if f.failed() {
+        return 0, errInjected
+    }
+    return f.File.WriteAt(b, offset)
+}
+
+func TestSpillCommit(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs, TxSpillSize : 4096, MergeOperators : map[string]string{"c" : "add"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("c")
+    table.Set([]byte("n"), []byte("10"))
+    table.Set([]byte("old"), []byte("x"))
+
+    value := strings.Repeat("v", 100)
+    tx    := db.Begin("c")
+    tx.Merge([]byte("n"), []byte("1"))
+    for i := 0; i < 500; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(value))
+    }
+    if tx.spill == nil || tx.spill.size == 0 {
+        t.Fatal("transaction was not spilled")
+    }
+    tx.Set([]byte("k2"), []byte("two"))
+    tx.Remove([]byte("k3"))
+    tx.Remove([]byte("old"))
+    tx.Merge([]byte("n"), []byte("5"))
+    if string(tx.Get([]byte("n"))) != "16" || string(tx.Get([]byte("k2"))) != "two" || tx.Exists([]byte("k3")) {
+        t.Fatal("unexpected reads of spilled transaction")
+    }
+    if n := len(tx.Items(-1)); n != 500 {
+        t.Fatalf("spilled items: got %d, want 500", n)
+    }
+    // 提交期间并发写入
+    done := make(chan struct{})
+    go func() {
+        for i := 0; i < 100; i++ {
+            table.Set([]byte(fmt.Sprintf("w%d", i)), []byte("1"))
+        }
+        close(done)
+    }()
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    <- done
+    if string(table.Get([]byte("k499"))) != value || string(table.Get([]byte("n"))) != "16" {
+        t.Fatal("unexpected committed data")
+    }
+    if table.Get([]byte("old")) != nil || table.Get([]byte("k3")) != nil {
+        t.Fatal("removed keys still exist")
+    }
+    if n := len(table.Items(-1)); n != 600 {
+        t.Fatalf("items: got %d, want 600", n)
+    }
+    infos, _ := fs.ReadDir("/db")
+    for _, info := range infos {
+        if strings.HasSuffix(info.Name(), ".spill") {
+            t.Fatalf("spill file left: %s", info.Name())
+        }
+    }
+    db.Close()
+}
+
+func TestSpillCommitSyncFailure(t *testing.T) {
+    fs := &failingFS{FS : gvfs.NewMemFS()}
+    db, err := New("/db", Options{FS : fs, TxSpillSize : 4096, Logger : crashLogger{}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    table.Set([]byte("a"), []byte("1"))
+    db.binlog.sync()
+
+    value := strings.Repeat("v", 100)
+    tx    := db.Begin("c")
+    for i := 0; i < 500; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(value))
+    }
+    // 大事务已写入binlog但同步到数据文件失败时返回错误，并且不阻塞之后的写入
+    atomic.StoreInt32(&fs.failing, 1)
+    result := make(chan error, 1)
+    go func() {
+        result <- tx.Commit()
+    }()
+    select {
+        case err := <- result:
+            if err != ErrApplyPending {
+                t.Fatalf("commit with data files failing: got %v, want ErrApplyPending", err)
+            }
+        case <- time.After(10*time.Second):
+            t.Fatal("commit blocked on sync failure")
+    }
+    // 已提交的事务被重置，不能重复提交
+    if err := tx.Commit(); err != nil || tx.spill != nil {
+        t.Fatalf("transaction not reset after ErrApplyPending: %v", err)
+    }
+    other, _ := db.Table("o")
+    if err := other.Set([]byte("x"), []byte("y")); err != nil {
+        t.Fatal(err)
+    }
+    // 后台重试同步成功之后数据可见
+    atomic.StoreInt32(&fs.failing, 0)
+    deadline := time.Now().Add(10*time.Second)
+    for string(table.Get([]byte("k499"))) != value {
+        if time.Now().After(deadline) {
+            t.Fatal("large transaction was not applied after recovering")
+        }
+        time.Sleep(100*time.Millisecond)
+    }
+    if v := other.Get([]byte("x")); string(v) != "y" {
+        t.Fatalf("got %q, want y", v)
+    }
+}
+
+func TestSpillCommitContext(t *testing.T) {
+    fs := &failingFS{FS : gvfs.NewMemFS()}
+    db, err := New("/db", Options{FS : fs, TxSpillSize : 4096, Logger : crashLogger{}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    value    := strings.Repeat("v", 100)
+    tx       := db.Begin("c")
+    for i := 0; i < 500; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(value))
+    }
+    // 写入binlog之前取消时事务未写入，可以重试提交
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err := tx.CommitCtx(ctx); err != context.Canceled {
+        t.Fatalf("commit with canceled context: got %v, want context.Canceled", err)
+    }
+    if tx.spill == nil || table.Get([]byte("k0")) != nil {
+        t.Fatal("canceled transaction was written or reset")
+    }
+    // 写入binlog之后同步失败或者取消时事务已提交，返回ErrApplyPending而不是ctx的错误
+    atomic.StoreInt32(&fs.failing, 1)
+    ctx, cancel = context.WithCancel(context.Background())
+    defer cancel()
+    time.AfterFunc(100*time.Millisecond, cancel)
+    if err := tx.CommitCtx(ctx); err != ErrApplyPending {
+        t.Fatalf("commit canceled after writing binlog: got %v, want ErrApplyPending", err)
+    }
+    atomic.StoreInt32(&fs.failing, 0)
+    deadline := time.Now().Add(10*time.Second)
+    for string(table.Get([]byte("k499"))) != value {
+        if time.Now().After(deadline) {
+            t.Fatal("large transaction was not applied after recovering")
+        }
+        time.Sleep(100*time.Millisecond)
+    }
+}
+
+func TestSpillCommitReadGate(t *testing.T) {
+    fs := &failingFS{FS : gvfs.NewMemFS()}
+    db, err := New("/db", Options{FS : fs, TxSpillSize : 4096})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    other, _ := db.Table("o")
+    table.Set([]byte("a"), []byte("1"))
+    other.Set([]byte("x"), []byte("y"))
+    db.binlog.sync()
+
+    tx := db.Begin("c")
+    for i := 0; i < 500; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(strings.Repeat("v", 100)))
+    }
+    // 大事务同步到数据文件期间阻塞
+    blocking := make(chan struct{})
+    fs.mu.Lock()
+    fs.blocked, fs.blocking = "/c.db", blocking
+    fs.mu.Unlock()
+    result := make(chan error, 1)
+    go func() {
+        result <- tx.Commit()
+    }()
+    for gvfs.Size(fs, "/db/binlog") < 50000 {
+        time.Sleep(10*time.Millisecond)
+    }
+    // 其他数据表的查询不受影响，大事务修改的数据表的查询等待同步完成
+    done := make(chan struct{})
+    go func() {
+        if v := other.Get([]byte("x")); string(v) != "y" || other.Len() != 1 || !other.Exists([]byte("x")) {
+            t.Errorf("read of other table: got %q", v)
+        }
+        close(done)
+    }()
+    select {
+        case <- done:
+        case <- time.After(10*time.Second):
+            t.Fatal("read of other table blocked by large transaction")
+    }
+    read := make(chan []byte, 1)
+    go func() {
+        read <- table.Get([]byte("k0"))
+    }()
+    select {
+        case v := <- read:
+            t.Fatalf("read of table being applied did not wait: %q", v)
+        case <- time.After(100*time.Millisecond):
+    }
+    fs.mu.Lock()
+    fs.blocking = nil
+    fs.mu.Unlock()
+    close(blocking)
+    if err := <- result; err != nil {
+        t.Fatal(err)
+    }
+    if v := <- read; v == nil {
+        t.Fatal("read after large transaction applied returned nil")
+    }
+}
@@ -0,0 +1,96 @@
+package gkvdb
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    gBINLOG_THROTTLE_SIZE      = gBINLOG_MAX_SIZE/2     // BackpressureThrottle策略下开始延迟写入的binlog队列大小(byte)
+    gBINLOG_THROTTLE_MAX_DELAY = 10*time.Millisecond    // BackpressureThrottle策略下单次写入的最大延迟时间
+)
+
+// 数据库运行统计
+type Stats struct {
+    QueueSize        int64         // binlog队列中未同步到数据文件的数据大小(byte)
+    QueueLength      int           // binlog队列中未同步到数据文件的事务数量
+    StallCount       int64         // 写入因binlog队列达到上限而阻塞的次数
+    StallDuration    time.Duration // 写入因binlog队列达到上限而阻塞的累计时间
+    ThrottleCount    int64         // 写入被延迟的次数(BackpressureThrottle)
+    ThrottleDuration time.Duration // 写入被延迟的累计时间(BackpressureThrottle)
+    BusyCount        int64         // 返回ErrBusy的次数(BackpressureFail)
+}
+
+// binlog写入背压统计，字段通过原子操作更新
+type _BinLogStats struct {
+    stalls     int64 // 阻塞次数
+    stallNs    int64 // 阻塞累计时间(纳秒)
+    throttles  int64 // 延迟次数
+    throttleNs int64 // 延迟累计时间(纳秒)
+    busy       int64 // 返回ErrBusy的次数
+}
+
+// 获取数据库运行统计
+func (db *DB) Stats() Stats {
+    stats := &db.binlog.stats
+    return Stats {
+        QueueSize        : atomic.LoadInt64(&db.binlog.queuesize),
+        QueueLength      : db.binlog.queue.Len(),
+        StallCount       : atomic.LoadInt64(&stats.stalls),
+        StallDuration    : time.Duration(atomic.LoadInt64(&stats.stallNs)),
+        ThrottleCount    : atomic.LoadInt64(&stats.throttles),
+        ThrottleDuration : time.Duration(atomic.LoadInt64(&stats.throttleNs)),
+        BusyCount        : atomic.LoadInt64(&stats.busy),
+    }
+}
+
+// 按照数据库的背压策略处理binlog队列过大时的写入，等待时响应ctx的取消及超时
+func (binlog *BinLog) backpressure(ctx context.Context) error {
+    size := atomic.LoadInt64(&binlog.queuesize)
+    switch binlog.db.options.Backpressure {
+        case BackpressureFail:
+            if size >= gBINLOG_MAX_SIZE {
+                atomic.AddInt64(&binlog.stats.busy, 1)
+                return ErrBusy
+            }
+        case BackpressureThrottle:
+            // 延迟时间与超过延迟起点的队列大小成正比
+            if size >= gBINLOG_THROTTLE_SIZE && size < gBINLOG_MAX_SIZE {
+                delay := gBINLOG_THROTTLE_MAX_DELAY*time.Duration(size - gBINLOG_THROTTLE_SIZE)/(gBINLOG_MAX_SIZE - gBINLOG_THROTTLE_SIZE)
+                start := time.Now()
+                timer := time.NewTimer(delay)
+                defer timer.Stop()
+                defer binlog.stats.add(&binlog.stats.throttles, &binlog.stats.throttleNs, start)
+                select {
+                    case <- timer.C:
+                        return nil
+                    case <- ctx.Done():
+                        return ctx.Err()
+                }
+            }
+    }
+    if size < gBINLOG_MAX_SIZE {
+        return nil
+    }
+    binlog.lmu.Lock()
+    events := binlog.limitFreeEvents
+    binlog.lmu.Unlock()
+    start := time.Now()
+    defer func() {
+        binlog.stats.add(&binlog.stats.stalls, &binlog.stats.stallNs, start)
+        binlog.db.emit(Event{Type: EventWriteStall, File: "binlog", Size: size, Duration: time.Since(start)})
+    }()
+    select {
+        case <- events:
+            return nil
+        case <- ctx.Done():
+            return ctx.Err()
+    }
+}
+
+// 增加统计次数及从start开始的累计时间
+func (stats *_BinLogStats) add(count *int64, duration *int64, start time.Time) {
+    atomic.AddInt64(count, 1)
+    atomic.AddInt64(duration, int64(time.Since(start)))
+}
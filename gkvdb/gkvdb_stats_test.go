@@ -0,0 +1,83 @@
+package gkvdb
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// 通知等待binlog队列空闲的写入
+func freeBinLogLimit(binlog *BinLog) {
+    binlog.lmu.Lock()
+    close(binlog.limitFreeEvents)
+    binlog.limitFreeEvents = make(chan struct{})
+    binlog.lmu.Unlock()
+}
+
+func TestBackpressureFail(t *testing.T) {
+    db, err := NewInMemory(Options{Backpressure : BackpressureFail})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    atomic.StoreInt64(&db.binlog.queuesize, gBINLOG_MAX_SIZE)
+    if err := db.Set([]byte("a"), []byte("1")); err != ErrBusy {
+        t.Fatalf("set with full binlog queue: got %v, want ErrBusy", err)
+    }
+    wb := db.NewWriteBatch()
+    wb.Put([]byte("b"), []byte("1"))
+    if err := wb.Commit(); err != ErrBusy {
+        t.Fatalf("batch commit with full binlog queue: got %v, want ErrBusy", err)
+    }
+    if stats := db.Stats(); stats.BusyCount != 2 || db.Get([]byte("a")) != nil {
+        t.Fatalf("unexpected stats: %+v", stats)
+    }
+    atomic.StoreInt64(&db.binlog.queuesize, 0)
+    if err := db.Set([]byte("a"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestBackpressureThrottle(t *testing.T) {
+    db, err := NewInMemory(Options{Backpressure : BackpressureThrottle})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    atomic.StoreInt64(&db.binlog.queuesize, gBINLOG_MAX_SIZE*3/4)
+    start := time.Now()
+    if err := db.Set([]byte("a"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+    stats := db.Stats()
+    if stats.ThrottleCount != 1 || stats.ThrottleDuration < gBINLOG_THROTTLE_MAX_DELAY/4 || time.Since(start) > time.Second {
+        t.Fatalf("unexpected stats: %+v", stats)
+    }
+}
+
+func TestBackpressureStall(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    atomic.StoreInt64(&db.binlog.queuesize, gBINLOG_MAX_SIZE)
+    done := make(chan error)
+    go func() {
+        done <- db.Set([]byte("b"), []byte("1"))
+    }()
+    time.Sleep(50*time.Millisecond)
+    select {
+        case err := <- done:
+            t.Fatalf("write did not stall: %v", err)
+        default:
+    }
+    atomic.StoreInt64(&db.binlog.queuesize, 0)
+    freeBinLogLimit(db.binlog)
+    if err := <- done; err != nil {
+        t.Fatal(err)
+    }
+    if stats := db.Stats(); stats.StallCount != 1 || stats.StallDuration < 40*time.Millisecond {
+        t.Fatalf("unexpected stats: %+v", stats)
+    }
+}
@@ -0,0 +1,274 @@
+package gkvdb
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+var errFsync = errors.New("injected fsync error")
+
+// 统计binlog文件fsync次数的文件系统，failing不为0时binlog的fsync返回错误，
+// failAt不为0时第failAt次fsync返回错误，block不为nil时fsync等待block关闭之后再执行
+type countingFS struct {
+    gvfs.FS
+    fsyncs  int64
+    failing int32
+    failAt  int64
+    block   chan struct{}
+}
+
+type countingFile struct {
+    gvfs.File
+    fs *countingFS
+}
+
+func newCountingFS() *countingFS {
+    return &countingFS{FS : gvfs.NewMemFS()}
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (gvfs.File, error) {
+    file, err := fs.FS.OpenFile(name, flag, perm)
+    if err != nil {
+        return nil, err
+    }
+    return &countingFile{file, fs}, nil
+}
+
+func (fs *countingFS) count() int64 {
+    return atomic.LoadInt64(&fs.fsyncs)
+}
+
+func (f *countingFile) Sync() error {
+    if filepath.Base(f.Name()) != "binlog" {
+        return f.File.Sync()
+    }
+    n := atomic.AddInt64(&f.fs.fsyncs, 1)
+    if f.fs.block != nil {
+        <- f.fs.block
+    }
+    if atomic.LoadInt32(&f.fs.failing) != 0 || n == f.fs.failAt {
+        return errFsync
+    }
+    return f.File.Sync()
+}
+
+// 已fsync的事务序号
+func syncedSeq(db *DB) int64 {
+    db.binlog.gmu.Lock()
+    defer db.binlog.gmu.Unlock()
+    return db.binlog.synced
+}
+
+// 等待条件成立，超时返回false
+func waitFor(timeout time.Duration, f func() bool) bool {
+    deadline := time.Now().Add(timeout)
+    for !f() {
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(5*time.Millisecond)
+    }
+    return true
+}
+
+func TestSyncAlways(t *testing.T) {
+    fs := newCountingFS()
+    db, err := New("/db", Options{FS : fs, Sync : SyncAlways})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    // 串行提交时每一次提交都执行fsync
+    for i := 1; i <= 3; i++ {
+        if err := db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+            t.Fatal(err)
+        }
+        if n := fs.count(); n != int64(i) {
+            t.Fatalf("fsyncs after commit %d: got %d, want %d", i, n, i)
+        }
+    }
+    // 事务指定的参数优先于持久化策略
+    tx := db.Begin()
+    tx.Set([]byte("x"), []byte("v"))
+    if err := tx.Commit(false); err != nil {
+        t.Fatal(err)
+    }
+    if n := fs.count(); n != 3 {
+        t.Fatalf("fsyncs after Commit(false): got %d, want 3", n)
+    }
+}
+
+func TestSyncNone(t *testing.T) {
+    fs := newCountingFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    for i := 0; i < 3; i++ {
+        db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    if n := fs.count(); n != 0 {
+        t.Fatalf("fsyncs: got %d, want 0", n)
+    }
+    tx := db.Begin()
+    tx.Set([]byte("x"), []byte("v"))
+    if err := tx.Commit(true); err != nil {
+        t.Fatal(err)
+    }
+    if n := fs.count(); n != 1 {
+        t.Fatalf("fsyncs after Commit(true): got %d, want 1", n)
+    }
+}
+
+func TestSyncPeriodicBytes(t *testing.T) {
+    fs := newCountingFS()
+    db, err := New("/db", Options{FS : fs, Sync : SyncPeriodic, SyncBytes : 1000})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    // 未fsync的数据达到SyncBytes时在提交时执行fsync，之后重新计算
+    value  := make([]byte, 300)
+    fsyncs := 0
+    for i := 0; i < 12; i++ {
+        if err := db.Set([]byte(fmt.Sprintf("k%d", i)), value); err != nil {
+            t.Fatal(err)
+        }
+        unsynced := atomic.LoadInt64(&db.binlog.wbytes) - atomic.LoadInt64(&db.binlog.sbytes)
+        if unsynced >= 1000 {
+            t.Fatalf("commit %d: %d bytes left unsynced", i, unsynced)
+        }
+        if unsynced == 0 {
+            fsyncs++
+        }
+    }
+    if n := fs.count(); n != int64(fsyncs) || n < 3 || n > 4 {
+        t.Fatalf("fsyncs: got %d, want %d (3 or 4)", n, fsyncs)
+    }
+}
+
+func TestSyncPeriodicInterval(t *testing.T) {
+    fs := newCountingFS()
+    var events int32
+    db, err := New("/db", Options {
+        FS           : fs,
+        Sync         : SyncPeriodic,
+        SyncInterval : 10*time.Millisecond,
+        Logger       : crashLogger{},
+        OnEvent      : func(event Event) {
+            if event.Type == EventFsyncError {
+                atomic.AddInt32(&events, 1)
+            }
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if err := db.Set([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    // 没有设置SyncBytes时提交不执行fsync
+    if db.binlog.needSync() {
+        t.Fatal("commit should not fsync without SyncBytes")
+    }
+    // 定时fsync线程按照时间间隔执行fsync
+    if !waitFor(5*time.Second, func() bool { return fs.count() > 0 }) {
+        t.Fatal("periodic fsync not executed")
+    }
+    if !waitFor(5*time.Second, func() bool { return syncedSeq(db) == 1 }) {
+        t.Fatalf("synced: got %d, want 1", syncedSeq(db))
+    }
+    // 定时fsync失败时触发EventFsyncError事件
+    atomic.StoreInt32(&fs.failing, 1)
+    db.Set([]byte("k"), []byte("v2"))
+    if !waitFor(5*time.Second, func() bool { return atomic.LoadInt32(&events) > 0 }) {
+        t.Fatal("fsync error event not delivered")
+    }
+    atomic.StoreInt32(&fs.failing, 0)
+}
+
+// 阻塞第一次fsync，等待其他n个同步提交写入binlog之后再释放，返回所有提交的结果(第一个为leader的结果)
+func runGroupCommit(t *testing.T, fs *countingFS, n int) (*DB, []error) {
+    fs.block = make(chan struct{})
+    db, err := New("/db", Options{FS : fs, Sync : SyncAlways, Logger : crashLogger{}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 暂停binlog同步(同步过程中也会fsync binlog)，只统计提交时的fsync
+    db.binlog.smu.Lock()
+    defer db.binlog.smu.Unlock()
+    errs := make([]error, n + 1)
+    var wg sync.WaitGroup
+    commit := func(i int) {
+        defer wg.Done()
+        errs[i] = db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+    }
+    wg.Add(1)
+    go commit(0)
+    if !waitFor(5*time.Second, func() bool { return fs.count() == 1 }) {
+        t.Fatalf("leader fsync not started: %d", fs.count())
+    }
+    for i := 1; i <= n; i++ {
+        wg.Add(1)
+        go commit(i)
+    }
+    if !waitFor(5*time.Second, func() bool { return atomic.LoadInt64(&db.binlog.written) == int64(n + 1) }) {
+        t.Fatal("followers not written")
+    }
+    close(fs.block)
+    wg.Wait()
+    return db, errs
+}
+
+func TestGroupCommit(t *testing.T) {
+    fs := newCountingFS()
+    db, errs := runGroupCommit(t, fs, 9)
+    defer db.Close()
+    for i, err := range errs {
+        if err != nil {
+            t.Fatalf("commit %d: %v", i, err)
+        }
+    }
+    // leader的fsync之后等待中的提交共用一次fsync
+    if n := fs.count(); n != 2 {
+        t.Fatalf("fsyncs: got %d, want 2", n)
+    }
+    if n := syncedSeq(db); n != 10 {
+        t.Fatalf("synced: got %d, want 10", n)
+    }
+}
+
+func TestGroupCommitError(t *testing.T) {
+    fs       := newCountingFS()
+    fs.failAt = 2
+    db, errs := runGroupCommit(t, fs, 9)
+    defer db.Close()
+    if errs[0] != nil {
+        t.Fatalf("leader commit: %v", errs[0])
+    }
+    // 共用的fsync失败时所有等待中的提交都返回该错误，不再各自重试
+    for i, err := range errs[1 : ] {
+        if err != errFsync {
+            t.Fatalf("commit %d: got %v, want %v", i + 1, err, errFsync)
+        }
+    }
+    if n := fs.count(); n != 2 {
+        t.Fatalf("fsyncs: got %d, want 2", n)
+    }
+    // 之后的提交重新执行fsync
+    if err := db.Set([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    if n := syncedSeq(db); n != 11 {
+        t.Fatalf("synced: got %d, want 11", n)
+    }
+}
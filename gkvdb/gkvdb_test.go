@@ -0,0 +1,115 @@
+package gkvdb
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "gitee.com/johng/gkvdb/gkvdb/gvfs"
+)
+
+func TestCloseFlushesAndReturnsErrClosed(t *testing.T) {
+    fs := gvfs.NewMemFS()
+    db, err := New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    table, _ := db.Table("t")
+    for i := 0; i < 500; i++ {
+        if err := db.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+            t.Fatal(err)
+        }
+        table.Set([]byte(fmt.Sprintf("k%d", i)), []byte("t"))
+    }
+    if err := db.Close(); err != nil {
+        t.Fatal(err)
+    }
+    // 关闭时binlog中的数据已全部同步到数据文件
+    if db.binlog.queue.Len() != 0 {
+        t.Fatalf("binlog queue not flushed: %d", db.binlog.queue.Len())
+    }
+    if err := db.Close(); err != ErrClosed {
+        t.Fatalf("second close: %v", err)
+    }
+    if err := db.Set([]byte("a"), []byte("b")); err != ErrClosed {
+        t.Fatalf("set after close: %v", err)
+    }
+    if err := table.Set([]byte("a"), []byte("b")); err != ErrClosed {
+        t.Fatalf("table set after close: %v", err)
+    }
+    if err := db.Begin().Commit(); err != ErrClosed {
+        t.Fatalf("commit after close: %v", err)
+    }
+    if _, err := db.Table("t"); err != ErrClosed {
+        t.Fatalf("table after close: %v", err)
+    }
+    if db.Get([]byte("k1")) != nil {
+        t.Fatal("get after close should return nil")
+    }
+
+    db, err = New("/db", Options{FS : fs})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if n := len(db.Items(-1)); n != 500 {
+        t.Fatalf("items after reopen: got %d, want 500", n)
+    }
+    if v := db.GetFrom([]byte("k499"), "t"); string(v) != "t" {
+        t.Fatalf("table value after reopen: %q", v)
+    }
+}
+
+func TestTableClose(t *testing.T) {
+    db, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("t")
+    table.Set([]byte("x"), []byte("y"))
+    if err := table.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := table.Set([]byte("x"), []byte("z")); err != ErrClosed {
+        t.Fatalf("set on closed table: %v", err)
+    }
+    // 重新打开数据表
+    table, _ = db.Table("t")
+    if v := table.Get([]byte("x")); string(v) != "y" {
+        t.Fatalf("get after reopen: %q", v)
+    }
+}
+
+func TestNewInMemory(t *testing.T) {
+    // 选项中的文件系统被忽略
+    fs      := gvfs.NewMemFS()
+    db, err := NewInMemory(Options{FS : fs, TxSpillSize : 512})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("t")
+    table.Set([]byte("a"), []byte("1"))
+    tx := db.Begin("t")
+    for i := 0; i < 50; i++ {
+        tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(strings.Repeat("x", 50)))
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    if n := len(table.Items(-1)); n != 51 || string(table.Get([]byte("a"))) != "1" {
+        t.Fatalf("items: got %d, want 51", n)
+    }
+    if gvfs.Exists(gvfs.OS, gMEMORY_DB_PATH) || gvfs.Exists(fs, gMEMORY_DB_PATH) {
+        t.Fatal("in-memory database wrote outside its own filesystem")
+    }
+    // 每一个内存数据库使用独立的文件系统
+    other, err := NewInMemory()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer other.Close()
+    if other.Get([]byte("a")) != nil {
+        t.Fatal("in-memory databases share data")
+    }
+}
@@ -1,18 +1,30 @@
 package gkvdb
 
 import (
+    "context"
     "sync"
-    "github.com/gogf/gf/g/os/glog"
     "github.com/gogf/gf/g/os/gtime"
 )
 
 // 事务操作对象
 type Transaction struct {
-    mu     sync.RWMutex                 // 并发互斥锁
-    db     *DB                          // 所属数据库
-    id     int64                        // 事务编号
-    table  string                       // 事务默认表
-    tables map[string]map[string][]byte // 事务数据项，键名为表名，键值为对应表的键值对数据
+    mu         sync.RWMutex                   // 并发互斥锁
+    db         *DB                            // 所属数据库
+    id         int64                          // 事务编号
+    table      string                         // 事务默认表
+    tables     map[string]map[string][]byte   // 事务数据项，键名为表名，键值为对应表的键值对数据
+    reads      map[string]map[string][]byte   // 原子操作读取到的已提交数据，提交时检查数据是否被其他事务修改
+    merges     map[string]map[string][][]byte // 事务中的合并操作数，键名为表名，键值为对应表的键名与合并操作数列表
+    parent     *Transaction                   // 父事务(嵌套事务)，子事务提交时合并到父事务中
+    savepoints []*_Savepoint                  // 按照创建顺序排列的保存点
+    bytes      int64                          // 事务内存中的数据大小(byte)，超过落盘大小时写入落盘文件
+    spill      *_TxSpill                      // 事务落盘文件(大事务)
+    ireads     map[string]map[string][]byte   // 计算二级索引时读取的已提交数据，提交时检查数据是否被其他事务修改
+    iwrites    map[string][]string            // 计算得到的二级索引修改(表名->键名列表)，重新计算时删除
+    igen       int64                          // 计算二级索引时的索引版本，提交时索引已被修改则重新计算
+    internal   bool                           // 内部事务(允许写入索引表)
+    undo       []_Undo                        // 撤销日志(存在保存点时记录)
+    logged     map[string]map[string]struct{} // 最近的保存点之后已记录撤销日志的键名
 }
 
 // 创建一个事务
@@ -32,6 +44,8 @@ func (db *DB) newTransaction() *Transaction {
         db     : db,
         id     : db.txid(),
         tables : make(map[string]map[string][]byte),
+        reads  : make(map[string]map[string][]byte),
+        merges : make(map[string]map[string][][]byte),
     }
     return tx
 }
@@ -50,18 +64,43 @@ func (tx *Transaction) Set(key, value []byte) error{
 func (tx *Transaction) SetTo(key, value []byte, name string) error {
     tx.mu.Lock()
     defer tx.mu.Unlock()
+    return tx.set(key, value, name)
+}
 
+// 添加数据(内部调用，调用方加锁)
+func (tx *Transaction) set(key, value []byte, name string) error {
+    if tx.db.readonly {
+        return ErrReadOnly
+    }
     // 每一次操作都要执行表名、键名、键值长度检查
     if err := checkTableValid(name); err != nil {
         return err
     }
-    if err := checkKeyValid(key); err != nil {
+    if err := tx.checkWritable(name); err != nil {
+        return err
+    }
+    if err := checkKeyValid(key, tx.db.format.maxKeySize); err != nil {
         return err
     }
-    if err := checkValueValid(key); err != nil {
+    if err := checkValueValid(value, tx.db.format.maxValueSize); err != nil {
         return err
     }
 
+    // 写入的数据覆盖之前的合并操作数，put中已记录撤销信息(包括操作数)
+    tx.put(key, value, name)
+    if m, ok := tx.merges[name]; ok {
+        delete(m, string(key))
+    }
+    // 事务数据过大时写入落盘文件
+    if tx.bytes >= tx.db.getTxSpillSize() {
+        return tx.spillOut()
+    }
+    return nil
+}
+
+// 将数据写入事务内存中(内部调用，调用方加锁)
+func (tx *Transaction) put(key, value []byte, name string) {
+    tx.logUndo(name, string(key))
     if _, ok := tx.tables[name]; !ok {
         tx.tables[name] = make(map[string][]byte)
     }
@@ -71,27 +110,74 @@ func (tx *Transaction) SetTo(key, value []byte, name string) error {
     } else {
         tx.tables[name][string(key)] = nil
     }
-    return nil
+    tx.bytes += int64(tx.db.format.binlogHeadSize + len(name) + len(key) + len(value))
 }
 
 // 查询数据
 func (tx *Transaction) Get(key []byte) []byte {
-    return tx.GetFrom(key, gDEFAULT_TABLE_NAME)
+    return tx.GetFrom(key, tx.table)
 }
 
-// 查询数据(针对数据表)
+// 查询数据(针对数据表)，事务中已写入的数据优先，否则查询已提交的数据
 func (tx *Transaction) GetFrom(key []byte, name string) []byte {
+    value, err := tx.GetFromCtx(context.Background(), key, name)
+    if err != nil {
+        tx.db.logger().Errorf("transaction get error: %v", err)
+    }
+    return value
+}
+
+// 查询数据，等待锁时响应ctx的取消及超时
+func (tx *Transaction) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+    return tx.GetFromCtx(ctx, key, tx.table)
+}
+
+// 查询数据(针对数据表)，等待锁时响应ctx的取消及超时
+func (tx *Transaction) GetFromCtx(ctx context.Context, key []byte, name string) ([]byte, error) {
     tx.mu.RLock()
     defer tx.mu.RUnlock()
-    if _, ok := tx.tables[name]; ok {
-        return tx.tables[name][string(key)]
+    return tx.get(ctx, key, name)
+}
+
+// 查询数据(内部调用，调用方加锁)
+func (tx *Transaction) get(ctx context.Context, key []byte, name string) ([]byte, error) {
+    if v, ok, err := tx.pending(key, name); ok {
+        return v, err
+    }
+    table, err := tx.db.Table(name)
+    if err != nil {
+        return nil, err
+    }
+    // 子事务中未写入的数据从父事务中查询
+    var value []byte
+    if tx.parent != nil {
+        value, err = tx.parent.GetFromCtx(ctx, key, name)
+    } else {
+        value, err = table.GetCtx(ctx, key)
     }
-    return tx.db.GetFrom(key, name)
+    if err != nil {
+        return nil, err
+    }
+    // 事务中存在该键名的合并操作数时，返回合并后的键值
+    if operands, ok := tx.merges[name][string(key)]; ok {
+        return table.fold(key, value, operands)
+    }
+    return value, nil
+}
+
+// 判断键名是否存在
+func (tx *Transaction) Exists(key []byte) bool {
+    return tx.ExistsFrom(key, tx.table)
+}
+
+// 判断键名是否存在(针对数据表)
+func (tx *Transaction) ExistsFrom(key []byte, name string) bool {
+    return tx.GetFrom(key, name) != nil
 }
 
 // 删除数据
 func (tx *Transaction) Remove(key []byte) error {
-    return tx.RemoveFrom(key, gDEFAULT_TABLE_NAME)
+    return tx.RemoveFrom(key, tx.table)
 }
 
 // 删除数据(针对数据表)
@@ -99,17 +185,173 @@ func (tx *Transaction) RemoveFrom(key []byte, name string) error {
     return tx.SetTo(key, nil, name)
 }
 
+// 遍历数据，f返回false时停止遍历
+func (tx *Transaction) Iterate(f func(key, value []byte) bool) {
+    tx.IterateFrom(tx.table, f)
+}
+
+// 遍历数据(针对数据表)，在已提交的数据上叠加事务中写入、删除及合并的数据，
+// 事务中的数据在遍历开始时确定，遍历过程中事务的修改不影响本次遍历
+func (tx *Transaction) IterateFrom(name string, f func(key, value []byte) bool) {
+    if err := tx.IterateFromCtx(context.Background(), name, f); err != nil {
+        tx.db.logger().Errorf("transaction iterate error: %v", err)
+    }
+}
+
+// 遍历数据，f返回false时停止遍历，ctx取消或者超时时停止遍历并返回ctx的错误
+func (tx *Transaction) IterateCtx(ctx context.Context, f func(key, value []byte) bool) error {
+    return tx.IterateFromCtx(ctx, tx.table, f)
+}
+
+// 遍历数据(针对数据表)，f返回false时停止遍历，ctx取消或者超时时停止遍历并返回ctx的错误
+func (tx *Transaction) IterateFromCtx(ctx context.Context, name string, f func(key, value []byte) bool) error {
+    table, err := tx.db.Table(name)
+    if err != nil {
+        return err
+    }
+    tx.mu.RLock()
+    pending := make(map[string][]byte, len(tx.tables[name]))
+    for k, v := range tx.tables[name] {
+        pending[k] = v
+    }
+    for k, _ := range tx.merges[name] {
+        if pending[k], err = tx.get(ctx, []byte(k), name); err != nil {
+            tx.mu.RUnlock()
+            return err
+        }
+    }
+    // 落盘的数据在遍历时才从落盘文件读取
+    spill   := tx.spill
+    spilled := make(map[string]_TxSpillRef)
+    if spill != nil {
+        for k, ref := range spill.index[name] {
+            if _, ok := pending[k]; !ok {
+                spilled[k] = ref
+            }
+        }
+    }
+    tx.mu.RUnlock()
+
+    for k, v := range pending {
+        if v != nil && !f([]byte(k), v) {
+            return nil
+        }
+    }
+    for k, ref := range spilled {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        v, err := spill.read(ref, []byte(k), tx.db.format)
+        if err != nil {
+            return err
+        }
+        if v != nil && !f([]byte(k), v) {
+            return nil
+        }
+    }
+    overlay := func(key, value []byte) bool {
+        if _, ok := pending[string(key)]; ok {
+            return true
+        }
+        if _, ok := spilled[string(key)]; ok {
+            return true
+        }
+        return f(key, value)
+    }
+    // 子事务在父事务的数据上进行叠加
+    if tx.parent != nil {
+        return tx.parent.IterateFromCtx(ctx, name, overlay)
+    }
+    return table.scan(ctx, overlay)
+}
+
+// 获取max条随机键值对，max=-1时获取所有数据返回
+func (tx *Transaction) Items(max int) map[string][]byte {
+    return tx.ItemsFrom(max, tx.table)
+}
+
+// 获取max条随机键值对(针对数据表)，max=-1时获取所有数据返回
+func (tx *Transaction) ItemsFrom(max int, name string) map[string][]byte {
+    m := make(map[string][]byte)
+    if max == 0 {
+        return m
+    }
+    tx.IterateFrom(name, func(key, value []byte) bool {
+        m[string(key)] = value
+        return len(m) != max
+    })
+    return m
+}
+
+// 获取最多max个随机键名，构成列表返回
+func (tx *Transaction) Keys(max int) []string {
+    return tx.KeysFrom(max, tx.table)
+}
+
+// 获取最多max个随机键名(针对数据表)，构成列表返回
+func (tx *Transaction) KeysFrom(max int, name string) []string {
+    m    := tx.ItemsFrom(max, name)
+    keys := make([]string, 0, len(m))
+    for k, _ := range m {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
 // 提交数据
 func (tx *Transaction) Commit(sync...bool) error {
+    return tx.CommitCtx(context.Background(), sync...)
+}
+
+// 提交数据，写入binlog之前的等待(队列长度上限、大事务同步)响应ctx的取消及超时，
+// 取消时事务未写入且保持不变，可以重试提交；写入binlog之后不再响应取消(大事务返回ErrApplyPending，事务已提交并重置)
+func (tx *Transaction) CommitCtx(ctx context.Context, sync...bool) error {
     tx.mu.Lock()
     defer tx.mu.Unlock()
 
-    if len(tx.tables) == 0 {
+    // 数据库关闭时会等待正在提交的事务完成
+    tx.db.mu.RLock()
+    defer tx.db.mu.RUnlock()
+    if tx.db.closed.Val() {
+        return ErrClosed
+    }
+    if tx.db.readonly {
+        return ErrReadOnly
+    }
+    if len(tx.tables) == 0 && len(tx.merges) == 0 && tx.spill == nil {
         return nil
     }
-    // 写Binlog
-    if err := tx.db.binlog.writeByTx(tx, sync...); err != nil {
-        glog.Error(err)
+    // 子事务提交时合并到父事务中，由父事务写入binlog
+    if tx.parent != nil {
+        if err := tx.parent.absorb(tx); err != nil {
+            return err
+        }
+        tx.reset()
+        return nil
+    }
+    // 写Binlog，已落盘的大事务流式写入binlog(写入后总是执行fsync)；
+    // 二级索引与数据在同一个binlog事务中写入，计算索引时读取的数据被其他事务修改时重新计算
+    var err error
+    for {
+        if err = tx.updateIndexes(); err != nil {
+            break
+        }
+        if tx.spill != nil {
+            err = tx.db.binlog.writeStream(ctx, tx)
+        } else {
+            err = tx.db.binlog.writeByTx(ctx, tx, sync...)
+        }
+        if err != errIndexConflict {
+            break
+        }
+    }
+    if err != nil {
+        // 原子操作读取的数据已被修改，事务已经无法提交，自动回滚；大事务已提交但未同步完成时同样重置事务，不能重复提交
+        if err == ErrConflict || err == ErrApplyPending {
+            tx.reset()
+            return err
+        }
+        tx.db.logger().Errorf("transaction commit error: %v", err)
         return err
     }
 
@@ -128,6 +370,18 @@ func (tx *Transaction) Rollback() {
 
 // 重置事务(内部调用)
 func (tx *Transaction) reset() {
-    tx.id     = tx.db.txid()
-    tx.tables = make(map[string]map[string][]byte)
+    tx.id         = tx.db.txid()
+    tx.tables     = make(map[string]map[string][]byte)
+    tx.reads      = make(map[string]map[string][]byte)
+    tx.merges     = make(map[string]map[string][][]byte)
+    tx.savepoints = nil
+    tx.undo       = nil
+    tx.logged     = nil
+    tx.bytes      = 0
+    tx.ireads     = nil
+    tx.iwrites    = nil
+    if tx.spill != nil {
+        tx.spill.close()
+        tx.spill = nil
+    }
 }
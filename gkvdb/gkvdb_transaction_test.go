@@ -0,0 +1,116 @@
+package gkvdb
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// 事务中的读取叠加未提交的写入、删除及合并操作数
+func TestTransactionOverlay(t *testing.T) {
+    db, err := NewInMemory(Options{MergeOperators : map[string]string{"c" : "add"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    table, _ := db.Table("c")
+    // 已提交的数据分别位于数据文件及memtable中
+    table.Set([]byte("disk"), []byte("1"))
+    table.Set([]byte("gone"), []byte("1"))
+    if err := db.binlog.sync(); err != nil {
+        t.Fatal(err)
+    }
+    table.Set([]byte("mem"), []byte("1"))
+    table.Set([]byte("n"), []byte("1"))
+
+    tx := db.Begin("c")
+    tx.Set([]byte("new"), []byte("2"))
+    tx.Set([]byte("disk"), []byte("2"))
+    tx.Remove([]byte("gone"))
+    tx.Remove([]byte("mem"))
+    tx.Merge([]byte("n"), []byte("5"))
+    want := map[string]string{"disk" : "2", "new" : "2", "n" : "6"}
+
+    if tx.Exists([]byte("gone")) || tx.Exists([]byte("mem")) || !tx.Exists([]byte("new")) || !tx.Exists([]byte("n")) {
+        t.Fatal("unexpected Exists in transaction")
+    }
+    items := tx.Items(-1)
+    if len(items) != len(want) {
+        t.Fatalf("items: got %d, want %d", len(items), len(want))
+    }
+    for k, v := range want {
+        if string(items[k]) != v {
+            t.Fatalf("items[%s]: got %q, want %q", k, items[k], v)
+        }
+    }
+    if n := len(tx.Items(2)); n != 2 {
+        t.Fatalf("items with max 2: got %d", n)
+    }
+    keys := tx.Keys(-1)
+    sort.Strings(keys)
+    if strings.Join(keys, ",") != "disk,n,new" {
+        t.Fatalf("keys: got %v", keys)
+    }
+    seen := make(map[string]int)
+    err   = tx.IterateFromCtx(context.Background(), "c", func(key, value []byte) bool {
+        seen[string(key)]++
+        if string(value) != want[string(key)] {
+            t.Fatalf("iterate %s: got %q, want %q", key, value, want[string(key)])
+        }
+        return true
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(seen) != len(want) {
+        t.Fatalf("iterated keys: got %v", seen)
+    }
+    for k, n := range seen {
+        if n != 1 {
+            t.Fatalf("key %s iterated %d times", k, n)
+        }
+    }
+    // 未提交的数据对事务之外不可见
+    if table.Get([]byte("new")) != nil || string(table.Get([]byte("mem"))) != "1" {
+        t.Fatal("pending data visible outside transaction")
+    }
+    if err := tx.Commit(); err != nil {
+        t.Fatal(err)
+    }
+    items = table.Items(-1)
+    if len(items) != len(want) {
+        t.Fatalf("committed items: got %d, want %d", len(items), len(want))
+    }
+    for k, v := range want {
+        if string(items[k]) != v {
+            t.Fatalf("committed %s: got %q, want %q", k, items[k], v)
+        }
+    }
+}
+
+// 写入覆盖合并操作数后回滚，恢复写入之前的操作数
+func TestTransactionSetOverMergeRollback(t *testing.T) {
+    db, err := NewInMemory(Options{MergeOperators : map[string]string{"c" : "add"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    tx := db.Begin("c")
+    tx.Merge([]byte("n"), []byte("3"))
+    tx.Savepoint("s")
+    tx.Set([]byte("n"), []byte("10"))
+    tx.Merge([]byte("n"), []byte("1"))
+    if v := tx.Get([]byte("n")); string(v) != "11" {
+        t.Fatalf("before rollback: got %q, want 11", v)
+    }
+    if len(tx.undo) != 1 {
+        t.Fatalf("undo records: got %d, want 1", len(tx.undo))
+    }
+    if err := tx.RollbackTo("s"); err != nil {
+        t.Fatal(err)
+    }
+    if v := tx.Get([]byte("n")); string(v) != "3" {
+        t.Fatalf("after rollback: got %q, want 3", v)
+    }
+}
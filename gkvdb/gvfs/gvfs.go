@@ -0,0 +1,128 @@
+// Copyright 2017 gkvdb Author(https://gitee.com/johng/gkvdb). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://gitee.com/johng/gkvdb.
+
+// 虚拟文件系统，数据库的所有文件读写都通过该接口进行，
+// 默认实现为操作系统文件系统，同时提供内存文件系统的实现，
+// 也可以对接口进行包装以实现加密、统计等功能.
+package gvfs
+
+import (
+    "io"
+    "os"
+    "io/ioutil"
+)
+
+// 文件系统接口
+type FS interface {
+    // 打开文件，flag及perm与os.OpenFile一致
+    OpenFile(name string, flag int, perm os.FileMode) (File, error)
+    // 获取文件(或者目录)信息，不存在时返回的错误满足os.IsNotExist
+    Stat(name string) (os.FileInfo, error)
+    // 删除文件(或者空目录)
+    Remove(name string) error
+    // 重命名文件，目标文件已存在时覆盖
+    Rename(oldpath, newpath string) error
+    // 截断文件到指定大小
+    Truncate(name string, size int64) error
+    // 递归创建目录
+    MkdirAll(path string, perm os.FileMode) error
+    // 获取目录下的文件列表(按照名称排序)
+    ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// 文件接口
+type File interface {
+    io.Reader
+    io.ReaderAt
+    io.Writer
+    io.WriterAt
+    io.Seeker
+    io.Closer
+    // 文件名称(打开时的路径)
+    Name() string
+    // 获取文件信息
+    Stat() (os.FileInfo, error)
+    // 将文件内容同步到存储设备
+    Sync() error
+    // 截断文件到指定大小
+    Truncate(size int64) error
+}
+
+// 操作系统文件系统
+var OS FS = osFS{}
+
+// 操作系统文件系统的实现，直接调用os包
+type osFS struct {}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+    file, err := os.OpenFile(name, flag, perm)
+    if err != nil {
+        // 避免返回值为包含nil指针的非nil接口
+        return nil, err
+    }
+    return file, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+    return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+    return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+    return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+    return os.Truncate(name, size)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+    return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+    return ioutil.ReadDir(dirname)
+}
+
+// 判断文件(或者目录)是否存在
+func Exists(fs FS, name string) bool {
+    _, err := fs.Stat(name)
+    return err == nil
+}
+
+// 获取文件大小，文件不存在时返回0
+func Size(fs FS, name string) int64 {
+    if info, err := fs.Stat(name); err == nil {
+        return info.Size()
+    }
+    return 0
+}
+
+// 读取文件的全部内容
+func ReadFile(fs FS, name string) ([]byte, error) {
+    file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    return ioutil.ReadAll(file)
+}
+
+// 将内容写入文件，文件已存在时清空原有内容
+func WriteFile(fs FS, name string, data []byte, perm os.FileMode) error {
+    file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+    if _, err = file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
@@ -0,0 +1,363 @@
+// Copyright 2017 gkvdb Author(https://gitee.com/johng/gkvdb). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://gitee.com/johng/gkvdb.
+
+package gvfs
+
+import (
+    "io"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "path/filepath"
+)
+
+// 内存文件系统，所有文件内容保存在内存中，适用于测试以及不需要持久化的场景；
+// 文件的Sync操作不做任何处理，文件系统对象释放之后数据随之释放
+type MemFS struct {
+    mu    sync.RWMutex
+    files map[string]*memNode // 文件列表，键名为清理后的文件路径
+    dirs  map[string]time.Time // 目录列表，键值为目录的修改时间
+}
+
+// 内存文件内容，同一文件的多个打开指针共享内容
+type memNode struct {
+    mu      sync.RWMutex
+    data    []byte
+    modTime time.Time
+}
+
+// 内存文件打开指针
+type memFile struct {
+    fs     *MemFS
+    node   *memNode
+    name   string
+    flag   int
+    offset int64
+    closed bool
+}
+
+// 内存文件信息
+type memFileInfo struct {
+    name    string
+    size    int64
+    dir     bool
+    modTime time.Time
+}
+
+var errFileClosed = errors.New("file already closed")
+
+// 创建一个空的内存文件系统
+func NewMemFS() *MemFS {
+    return &MemFS {
+        files : make(map[string]*memNode),
+        dirs  : map[string]time.Time{string(filepath.Separator) : time.Now(), "." : time.Now()},
+    }
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+    path := filepath.Clean(name)
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if _, ok := fs.dirs[path]; ok {
+        if flag & (os.O_WRONLY|os.O_RDWR) != 0 {
+            return nil, &os.PathError{Op : "open", Path : name, Err : errors.New("is a directory")}
+        }
+        return nil, &os.PathError{Op : "open", Path : name, Err : errors.New("cannot open directory in memory filesystem")}
+    }
+    node, ok := fs.files[path]
+    if ok && flag & (os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+        return nil, &os.PathError{Op : "open", Path : name, Err : os.ErrExist}
+    }
+    if !ok {
+        if flag & os.O_CREATE == 0 {
+            return nil, &os.PathError{Op : "open", Path : name, Err : os.ErrNotExist}
+        }
+        if _, ok := fs.dirs[filepath.Dir(path)]; !ok {
+            return nil, &os.PathError{Op : "open", Path : name, Err : os.ErrNotExist}
+        }
+        node = &memNode{modTime : time.Now()}
+        fs.files[path] = node
+    }
+    if flag & os.O_TRUNC != 0 && flag & (os.O_WRONLY|os.O_RDWR) != 0 {
+        node.mu.Lock()
+        node.data    = node.data[0 : 0]
+        node.modTime = time.Now()
+        node.mu.Unlock()
+    }
+    return &memFile{fs : fs, node : node, name : name, flag : flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+    path := filepath.Clean(name)
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+    if t, ok := fs.dirs[path]; ok {
+        return &memFileInfo{name : filepath.Base(path), dir : true, modTime : t}, nil
+    }
+    if node, ok := fs.files[path]; ok {
+        return node.stat(filepath.Base(path)), nil
+    }
+    return nil, &os.PathError{Op : "stat", Path : name, Err : os.ErrNotExist}
+}
+
+func (fs *MemFS) Remove(name string) error {
+    path := filepath.Clean(name)
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if _, ok := fs.files[path]; ok {
+        // 已打开的文件指针仍然可以访问文件内容
+        delete(fs.files, path)
+        return nil
+    }
+    if _, ok := fs.dirs[path]; ok {
+        for p := range fs.files {
+            if filepath.Dir(p) == path {
+                return &os.PathError{Op : "remove", Path : name, Err : errors.New("directory not empty")}
+            }
+        }
+        for p := range fs.dirs {
+            if p != path && filepath.Dir(p) == path {
+                return &os.PathError{Op : "remove", Path : name, Err : errors.New("directory not empty")}
+            }
+        }
+        delete(fs.dirs, path)
+        return nil
+    }
+    return &os.PathError{Op : "remove", Path : name, Err : os.ErrNotExist}
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+    src := filepath.Clean(oldpath)
+    dst := filepath.Clean(newpath)
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    node, ok := fs.files[src]
+    if !ok {
+        return &os.LinkError{Op : "rename", Old : oldpath, New : newpath, Err : os.ErrNotExist}
+    }
+    if _, ok := fs.dirs[filepath.Dir(dst)]; !ok {
+        return &os.LinkError{Op : "rename", Old : oldpath, New : newpath, Err : os.ErrNotExist}
+    }
+    delete(fs.files, src)
+    fs.files[dst] = node
+    return nil
+}
+
+func (fs *MemFS) Truncate(name string, size int64) error {
+    fs.mu.RLock()
+    node, ok := fs.files[filepath.Clean(name)]
+    fs.mu.RUnlock()
+    if !ok {
+        return &os.PathError{Op : "truncate", Path : name, Err : os.ErrNotExist}
+    }
+    return node.truncate(size)
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+    path = filepath.Clean(path)
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    for p := path; ; p = filepath.Dir(p) {
+        if _, ok := fs.files[p]; ok {
+            return &os.PathError{Op : "mkdir", Path : p, Err : errors.New("not a directory")}
+        }
+        if _, ok := fs.dirs[p]; ok {
+            break
+        }
+        fs.dirs[p] = time.Now()
+    }
+    return nil
+}
+
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+    path := filepath.Clean(dirname)
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+    if _, ok := fs.dirs[path]; !ok {
+        return nil, &os.PathError{Op : "open", Path : dirname, Err : os.ErrNotExist}
+    }
+    infos := make([]os.FileInfo, 0)
+    for p, node := range fs.files {
+        if filepath.Dir(p) == path {
+            infos = append(infos, node.stat(filepath.Base(p)))
+        }
+    }
+    for p, t := range fs.dirs {
+        if p != path && filepath.Dir(p) == path {
+            infos = append(infos, &memFileInfo{name : filepath.Base(p), dir : true, modTime : t})
+        }
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].Name() < infos[j].Name()
+    })
+    return infos, nil
+}
+
+// 获取文件信息
+func (node *memNode) stat(name string) *memFileInfo {
+    node.mu.RLock()
+    defer node.mu.RUnlock()
+    return &memFileInfo{name : name, size : int64(len(node.data)), modTime : node.modTime}
+}
+
+// 截断(或者扩展)文件内容，扩展的部分填充0
+func (node *memNode) truncate(size int64) error {
+    if size < 0 {
+        return errors.New("negative truncate size")
+    }
+    node.mu.Lock()
+    defer node.mu.Unlock()
+    node.resize(size)
+    node.data    = node.data[0 : size]
+    node.modTime = time.Now()
+    return nil
+}
+
+// 调整文件内容长度(调用方加锁)，扩展的部分填充0
+func (node *memNode) resize(size int64) {
+    if size <= int64(len(node.data)) {
+        return
+    }
+    if size > int64(cap(node.data)) {
+        buffer := make([]byte, size, size + size/4)
+        copy(buffer, node.data)
+        node.data = buffer
+        return
+    }
+    old      := len(node.data)
+    node.data = node.data[0 : size]
+    for i := old; i < int(size); i++ {
+        node.data[i] = 0
+    }
+}
+
+func (f *memFile) Name() string {
+    return f.name
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+    n, err := f.ReadAt(b, f.offset)
+    f.offset += int64(n)
+    if err == io.EOF && n > 0 {
+        err = nil
+    }
+    return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+    if f.closed {
+        return 0, errFileClosed
+    }
+    if f.flag & os.O_WRONLY != 0 {
+        return 0, &os.PathError{Op : "read", Path : f.name, Err : errors.New("bad file descriptor")}
+    }
+    if off < 0 {
+        return 0, &os.PathError{Op : "readat", Path : f.name, Err : errors.New("negative offset")}
+    }
+    f.node.mu.RLock()
+    defer f.node.mu.RUnlock()
+    if off >= int64(len(f.node.data)) {
+        return 0, io.EOF
+    }
+    n := copy(b, f.node.data[off:])
+    if n < len(b) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+    if f.flag & os.O_APPEND != 0 {
+        f.node.mu.RLock()
+        f.offset = int64(len(f.node.data))
+        f.node.mu.RUnlock()
+    }
+    n, err := f.WriteAt(b, f.offset)
+    f.offset += int64(n)
+    return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+    if f.closed {
+        return 0, errFileClosed
+    }
+    if f.flag & (os.O_WRONLY|os.O_RDWR) == 0 {
+        return 0, &os.PathError{Op : "write", Path : f.name, Err : errors.New("bad file descriptor")}
+    }
+    if off < 0 {
+        return 0, &os.PathError{Op : "writeat", Path : f.name, Err : errors.New("negative offset")}
+    }
+    f.node.mu.Lock()
+    defer f.node.mu.Unlock()
+    f.node.resize(off + int64(len(b)))
+    copy(f.node.data[off:], b)
+    f.node.modTime = time.Now()
+    return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+    if f.closed {
+        return 0, errFileClosed
+    }
+    switch whence {
+        case io.SeekCurrent: offset += f.offset
+        case io.SeekEnd:
+            f.node.mu.RLock()
+            offset += int64(len(f.node.data))
+            f.node.mu.RUnlock()
+    }
+    if offset < 0 {
+        return 0, &os.PathError{Op : "seek", Path : f.name, Err : errors.New("invalid argument")}
+    }
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+    if f.closed {
+        return nil, errFileClosed
+    }
+    return f.node.stat(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+    if f.closed {
+        return errFileClosed
+    }
+    return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+    if f.closed {
+        return errFileClosed
+    }
+    if f.flag & (os.O_WRONLY|os.O_RDWR) == 0 {
+        return &os.PathError{Op : "truncate", Path : f.name, Err : errors.New("bad file descriptor")}
+    }
+    return f.node.truncate(size)
+}
+
+func (f *memFile) Close() error {
+    if f.closed {
+        return errFileClosed
+    }
+    f.closed = true
+    return nil
+}
+
+func (info *memFileInfo) Name() string       { return info.name }
+func (info *memFileInfo) Size() int64        { return info.size }
+func (info *memFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memFileInfo) IsDir() bool        { return info.dir }
+func (info *memFileInfo) Sys() interface{}   { return nil }
+func (info *memFileInfo) Mode() os.FileMode {
+    if info.dir {
+        return os.ModeDir|0755
+    }
+    return 0644
+}
@@ -0,0 +1,119 @@
+package gvfs
+
+import (
+    "io"
+    "os"
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// 对同一组操作分别在操作系统文件系统及内存文件系统上执行，检查结果一致
+func testFS(t *testing.T, fs FS, dir string) {
+    path := filepath.Join(dir, "a", "b")
+    if err := fs.MkdirAll(path, 0755); err != nil {
+        t.Fatal(err)
+    }
+    name := filepath.Join(path, "file")
+    if _, err := fs.OpenFile(name, os.O_RDONLY, 0); !os.IsNotExist(err) {
+        t.Fatalf("open missing file: %v", err)
+    }
+    pf, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+        t.Fatalf("exclusive create: %v", err)
+    }
+    pf.WriteAt([]byte("world"), 6)
+    pf.WriteAt([]byte("hello"), 0)
+    buffer := make([]byte, 11)
+    if n, err := pf.ReadAt(buffer, 0); n != 11 || err != nil || !bytes.Equal(buffer, []byte("hello\x00world")) {
+        t.Fatalf("ReadAt = %d, %v, %q", n, err, buffer)
+    }
+    if n, err := pf.ReadAt(buffer, 5); n != 6 || err != io.EOF {
+        t.Fatalf("ReadAt beyond end = %d, %v", n, err)
+    }
+    if end, _ := pf.Seek(0, io.SeekEnd); end != 11 {
+        t.Fatalf("Seek end = %d", end)
+    }
+    pf.Write([]byte("!"))
+    if err := pf.Sync(); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := pf.Stat(); err != nil || info.Size() != 12 {
+        t.Fatalf("Stat = %v, %v", info, err)
+    }
+    if err := pf.Truncate(5); err != nil {
+        t.Fatal(err)
+    }
+    pf.Close()
+    if err := fs.Truncate(name, 3); err != nil {
+        t.Fatal(err)
+    }
+    if content, err := ReadFile(fs, name); err != nil || string(content) != "hel" {
+        t.Fatalf("ReadFile = %q, %v", content, err)
+    }
+    ro, _ := fs.OpenFile(name, os.O_RDONLY, 0)
+    if _, err := ro.WriteAt([]byte("x"), 0); err == nil {
+        t.Fatal("write to read-only file")
+    }
+    ro.Close()
+
+    if err := WriteFile(fs, name + ".tmp", []byte("data"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := fs.Rename(name + ".tmp", name); err != nil {
+        t.Fatal(err)
+    }
+    if Exists(fs, name + ".tmp") || Size(fs, name) != 4 {
+        t.Fatal("rename")
+    }
+    infos, err := fs.ReadDir(filepath.Join(dir, "a"))
+    if err != nil || len(infos) != 1 || infos[0].Name() != "b" || !infos[0].IsDir() {
+        t.Fatalf("ReadDir = %v, %v", infos, err)
+    }
+    if err := fs.Remove(path); err == nil {
+        t.Fatal("remove non-empty directory")
+    }
+    if err := fs.Remove(name); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := fs.Stat(name); !os.IsNotExist(err) {
+        t.Fatalf("Stat removed file: %v", err)
+    }
+}
+
+func TestOSFS(t *testing.T) {
+    dir, err := ioutil.TempDir("", "gvfs")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    testFS(t, OS, dir)
+}
+
+func TestMemFS(t *testing.T) {
+    testFS(t, NewMemFS(), "/tmp/gvfs")
+}
+
+func TestMemFSSharedContent(t *testing.T) {
+    fs := NewMemFS()
+    a, _ := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0644)
+    b, _ := fs.OpenFile("/f", os.O_RDWR, 0644)
+    a.WriteAt([]byte("abc"), 0)
+    buffer := make([]byte, 3)
+    if _, err := b.ReadAt(buffer, 0); err != nil || string(buffer) != "abc" {
+        t.Fatalf("shared content = %q, %v", buffer, err)
+    }
+    // 删除之后已打开的文件指针仍然可以读取
+    fs.Remove("/f")
+    if _, err := a.ReadAt(buffer, 0); err != nil {
+        t.Fatal(err)
+    }
+    a.Close()
+    if err := a.Close(); err == nil {
+        t.Fatal("double close")
+    }
+}
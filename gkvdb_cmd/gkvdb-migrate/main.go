@@ -0,0 +1,29 @@
+// gkvdb数据库格式迁移工具，将旧格式的数据库升级为当前版本使用的最新格式。
+//
+// 原地升级：
+//     gkvdb-migrate -src /tmp/gkvdb
+// 升级到新目录：
+//     gkvdb-migrate -src /tmp/gkvdb -dst /tmp/gkvdb-new
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "gitee.com/johng/gkvdb/gkvdb"
+)
+
+func main() {
+    src := flag.String("src", "", "source database directory")
+    dst := flag.String("dst", "", "destination database directory, migrate in place if empty")
+    flag.Parse()
+    if *src == "" {
+        flag.Usage()
+        os.Exit(2)
+    }
+    if err := gkvdb.Migrate(*src, *dst); err != nil {
+        fmt.Fprintln(os.Stderr, "migrate failed:", err)
+        os.Exit(1)
+    }
+    fmt.Println("migrate done")
+}
@@ -0,0 +1,42 @@
+// gkvdb数据库离线rehash工具，将数据库的所有数据表转换为使用指定的键名哈希函数。
+// 转换过程中数据库不能被其他进程打开。
+//
+// 原地转换：
+//     gkvdb-rehash -src /tmp/gkvdb -hash siphash
+// 转换到新目录并指定种子(十六进制)：
+//     gkvdb-rehash -src /tmp/gkvdb -dst /tmp/gkvdb-new -hash xxhash64 -seed 0123456789abcdef
+package main
+
+import (
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "os"
+    "gitee.com/johng/gkvdb/gkvdb"
+)
+
+func main() {
+    src  := flag.String("src",  "", "source database directory")
+    dst  := flag.String("dst",  "", "destination database directory, rehash in place if empty")
+    hash := flag.String("hash", "", "hash function name: bkdr64, xxhash64 or siphash")
+    seed := flag.String("seed", "", "hash seed in hex, generated randomly if empty")
+    flag.Parse()
+    if *src == "" || *hash == "" {
+        flag.Usage()
+        os.Exit(2)
+    }
+    options := gkvdb.Options{ Hash : *hash }
+    if *seed != "" {
+        b, err := hex.DecodeString(*seed)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "invalid seed:", err)
+            os.Exit(2)
+        }
+        options.HashSeed = b
+    }
+    if err := gkvdb.Migrate(*src, *dst, options); err != nil {
+        fmt.Fprintln(os.Stderr, "rehash failed:", err)
+        os.Exit(1)
+    }
+    fmt.Println("rehash done")
+}
@@ -18,6 +18,17 @@ func BenchmarkSet(b *testing.B) {
     }
 }
 
+func BenchmarkBatchSet(b *testing.B) {
+    wb := db.NewWriteBatch()
+    for i := 0; i < b.N; i++ {
+        wb.Put([]byte("key_" + strconv.Itoa(i)), []byte("value_" + strconv.Itoa(i)))
+        if wb.Len() == 10000 {
+            wb.Commit()
+        }
+    }
+    wb.Commit()
+}
+
 func BenchmarkGet(b *testing.B) {
     for i := 0; i < b.N; i++ {
         db.Get([]byte("key_" + strconv.Itoa(i)))
@@ -39,6 +39,24 @@ func TestSet(count int) {
     fmt.Println("TestSet:", gtime.Microsecond() - t)
 }
 
+// 测试批量写入，每batch条数据在一个事务中提交，对比gkvdb的WriteBatch
+func TestBatchSet(count int) {
+    t     := gtime.Microsecond()
+    batch := 10000
+    for i := 0; i < count; i += batch {
+        db.Update(func(tx *bolt.Tx) error {
+            b := tx.Bucket([]byte("test"))
+            for j := i; j < i + batch && j < count; j++ {
+                if err := b.Put([]byte("key_" + strconv.Itoa(j)), []byte("value_" + strconv.Itoa(j))); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+    }
+    fmt.Println("TestBatchSet:", gtime.Microsecond() - t)
+}
+
 // 测试默认带缓存情况下的数据库查询
 func TestGet(count int) {
     t := gtime.Microsecond()
@@ -75,6 +93,7 @@ func TestRemove(count int) {
 func main() {
     count := 10000
     //TestSet(count)
+    //TestBatchSet(count)
     TestGet(count)
     //TestRemove(count)
 
@@ -58,6 +58,69 @@ func TestSet(count int) {
     fmt.Println("TestSet:", gtime.Microsecond() - t)
 }
 
+// 测试数据库批量写入(WriteBatch)，对比leveldb.Batch及boltdb批量事务
+func TestBatchSet(count int) {
+    var wg sync.WaitGroup
+    t  := gtime.Microsecond()
+    p  := count/group
+    p  += group - p%group
+    for g := 0; g < group; g++ {
+        ss := g*p + 1
+        se := (g + 1)*p
+        if se > count {
+            se = count
+        }
+        wg.Add(1)
+        go func(start, end int) {
+            wb := db.NewWriteBatch()
+            for i := start; i <= end; i++ {
+                key   := []byte("key_" + strconv.Itoa(i))
+                value := []byte("value_" + strconv.Itoa(i))
+                wb.Put(key, value)
+                if i % batch == 0 {
+                    if err := wb.Commit(); err != nil {
+                        fmt.Println(err)
+                    }
+                }
+            }
+            if err := wb.Commit(); err != nil {
+                fmt.Println(err)
+            }
+            wg.Done()
+        }(ss, se)
+    }
+    wg.Wait()
+    fmt.Println("TestBatchSet:", gtime.Microsecond() - t)
+}
+
+// 测试并发的同步提交(每个事务一条数据，Commit(true))，并发的同步提交通过组提交共用fsync
+func TestSyncSet(count int) {
+    var wg sync.WaitGroup
+    t  := gtime.Microsecond()
+    p  := count/group
+    p  += group - p%group
+    for g := 0; g < group; g++ {
+        ss := g*p + 1
+        se := (g + 1)*p
+        if se > count {
+            se = count
+        }
+        wg.Add(1)
+        go func(start, end int) {
+            for i := start; i <= end; i++ {
+                tx := db.Begin()
+                tx.Set([]byte("key_" + strconv.Itoa(i)), []byte("value_" + strconv.Itoa(i)))
+                if err := tx.Commit(true); err != nil {
+                    fmt.Println(err)
+                }
+            }
+            wg.Done()
+        }(ss, se)
+    }
+    wg.Wait()
+    fmt.Println("TestSyncSet:", gtime.Microsecond() - t)
+}
+
 // 测试数据库查询，及结果匹配
 func TestGet(count int) {
     var wg sync.WaitGroup
@@ -125,6 +188,9 @@ func main() {
     TestSet(count)
     TestGet(count)
     TestRemove(count)
+    TestBatchSet(count)
+    TestGet(count)
+    //TestSyncSet(10000)
 
     //select {
     //
@@ -21,6 +21,7 @@ func init() {
     fmt.Println("db init:", gtime.Microsecond() - t)
 }
 
+// 使用leveldb.Batch批量写入，对比gkvdb的WriteBatch
 func TestSet(count int) {
     var wg sync.WaitGroup
     t  := gtime.Microsecond()